@@ -0,0 +1,160 @@
+// This file contains the alignment of the retention times of
+// identifications of a reference run (parameter -refmzml)
+
+package main
+
+import (
+	"log"
+	"math"
+	"sort"
+
+	"github.com/524D/mzrecal/internal/mzml"
+)
+
+// Maximum retention time shift (s) of a calibrant between the reference
+// run and the recalibrated run
+const alignMaxShift = 600.0
+
+// Number of calibrants per node of the piecewise linear alignment
+const alignAnchorsPerNode = 20
+
+// Minimum number of calibrants that are found in both runs for aligning
+// the retention times
+const alignMinAnchors = 3
+
+// rtAnchor is the retention time of a calibrant in the reference run
+// and its shift in the recalibrated run
+type rtAnchor struct {
+	refRT float64
+	shift float64
+}
+
+// rtAlignment maps retention times of the reference run to the
+// recalibrated run by linear interpolation of the shift between nodes.
+// Beyond the first and last node, the shift is constant.
+type rtAlignment struct {
+	refRT []float64 // Retention times of the nodes in the reference run
+	shift []float64 // Retention time shifts at the nodes
+}
+
+// fitAlignment fits a piecewise linear alignment to the anchors. The
+// anchors are divided in groups of about alignAnchorsPerNode by retention
+// time, and the median retention time and median shift of each group
+// form a node. The medians make the alignment robust against calibrants
+// that were matched to the wrong peak.
+func fitAlignment(anchors []rtAnchor) rtAlignment {
+	sort.Slice(anchors, func(i, j int) bool { return anchors[i].refRT < anchors[j].refRT })
+	nrNodes := max(len(anchors)/alignAnchorsPerNode, 1)
+	var a rtAlignment
+	for n := 0; n < nrNodes; n++ {
+		group := anchors[n*len(anchors)/nrNodes : (n+1)*len(anchors)/nrNodes]
+		rts := make([]float64, len(group))
+		shifts := make([]float64, len(group))
+		for i, anchor := range group {
+			rts[i] = anchor.refRT
+			shifts[i] = anchor.shift
+		}
+		a.refRT = append(a.refRT, median(rts))
+		a.shift = append(a.shift, median(shifts))
+	}
+	return a
+}
+
+// align returns the retention time in the recalibrated run of retention
+// time rt in the reference run
+func (a rtAlignment) align(rt float64) float64 {
+	n := len(a.refRT)
+	switch {
+	case rt <= a.refRT[0]:
+		return rt + a.shift[0]
+	case rt >= a.refRT[n-1]:
+		return rt + a.shift[n-1]
+	}
+	k := sort.SearchFloat64s(a.refRT, rt)
+	f := (rt - a.refRT[k-1]) / (a.refRT[k] - a.refRT[k-1])
+	return rt + a.shift[k-1] + f*(a.shift[k]-a.shift[k-1])
+}
+
+// alignCalibrants aligns the retention times of the calibrants that were
+// identified in a reference run (parameter -refmzml) to the recalibrated
+// run. Each calibrant is located at the apex of its XIC in the reference
+// run, and at the most intense point of its XIC within alignMaxShift in
+// the recalibrated run. The shifts of these calibrants are fitted by a
+// piecewise linear alignment (see fitAlignment), which is applied to all
+// calibrants. If too few calibrants are found, the retention times are
+// not changed.
+// specs are the MS1 spectra of the recalibrated run (see ms1Spectra).
+func alignCalibrants(refMzML *mzml.MzML, mzML *mzml.MzML, specs []ms1Spectrum,
+	cals []identifiedCalibrant, par params) error {
+	refSpecs, err := ms1Spectra(refMzML)
+	if err != nil {
+		return err
+	}
+	order := identifiedOrder(cals)
+	refXICs := make([][]xicPoint, len(cals))
+	err = forEachXICPoint(refMzML, refSpecs, cals, order, xicSearchRange, par,
+		func(i int, p xicPoint) { refXICs[i] = append(refXICs[i], p) })
+	if err != nil {
+		return err
+	}
+
+	// Search the calibrants in the recalibrated run around their apex
+	// in the reference run
+	apexCals := make([]identifiedCalibrant, len(cals))
+	copy(apexCals, cals)
+	var apexOrder []int
+	for _, i := range order {
+		apex := xicApex(refXICs[i], cals[i].retentionTime, idRTEnd(&cals[i]))
+		if apex < 0 {
+			continue
+		}
+		apexCals[i].retentionTime = refXICs[i][apex].rt
+		apexCals[i].rtEnd = refXICs[i][apex].rt
+		apexOrder = append(apexOrder, i)
+	}
+	sort.Slice(apexOrder, func(a, b int) bool {
+		return apexCals[apexOrder[a]].retentionTime < apexCals[apexOrder[b]].retentionTime
+	})
+	best := make([]xicPoint, len(cals))
+	err = forEachXICPoint(mzML, specs, apexCals, apexOrder, alignMaxShift, par,
+		func(i int, p xicPoint) {
+			if p.intens > best[i].intens {
+				best[i] = p
+			}
+		})
+	if err != nil {
+		return err
+	}
+
+	var anchors []rtAnchor
+	for _, i := range apexOrder {
+		if best[i].intens > 0 {
+			refRT := apexCals[i].retentionTime
+			anchors = append(anchors, rtAnchor{refRT: refRT, shift: best[i].rt - refRT})
+		}
+	}
+	if len(anchors) < alignMinAnchors {
+		if par.verbosity != infoSilent {
+			log.Printf("WARNING: %d calibrants found in both the reference run and the recalibrated run, which is too few to align retention times",
+				len(anchors))
+		}
+		return nil
+	}
+	alignment := fitAlignment(anchors)
+	if par.verbosity != infoSilent {
+		shifts := make([]float64, len(alignment.shift))
+		copy(shifts, alignment.shift)
+		log.Printf("Retention times aligned to reference run with %d calibrants, median shift %.1f s",
+			len(anchors), median(shifts))
+	}
+
+	for i := range cals {
+		if cals[i].retentionTime == -math.MaxFloat64 {
+			continue
+		}
+		end := idRTEnd(&cals[i])
+		cals[i].retentionTime = alignment.align(cals[i].retentionTime)
+		cals[i].rtEnd = math.Max(alignment.align(end), cals[i].retentionTime)
+	}
+	return nil
+}
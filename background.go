@@ -0,0 +1,97 @@
+// This file contains the discovery of persistent background ions
+// from the calibrant library (parameter -discover)
+
+package main
+
+import (
+	"log"
+	"math"
+
+	"github.com/524D/mzrecal/internal/mzml"
+)
+
+// backgroundIon keeps track of the occurrence of a library ion in the
+// MS1 spectra
+type backgroundIon struct {
+	cal       *chargedCalibrant
+	count     int     // Number of spectra in which the ion was found
+	sumErr    float64 // Sum of m/z errors (ppm)
+	sumSqrErr float64 // Sum of squared m/z errors (ppm^2)
+}
+
+// discoverBackgroundIons returns the library calibrants that are found in
+// at least a fraction of the MS1 spectra specs (parameter -discover), with a
+// stable m/z: the standard deviation of the m/z error must be less than
+// a third of the m/z window (parameter -ppmuncal). Random peaks in the
+// m/z window have a larger standard deviation.
+// Calibrants that may have multiple charge states are returned for each
+// charge state that was found.
+func discoverBackgroundIons(mzML *mzml.MzML, specs []ms1Spectrum,
+	libCals []identifiedCalibrant, par params) ([]identifiedCalibrant, error) {
+	// Charged calibrants per polarity
+	polarityCals := make(map[int][]calibrant)
+	ions := make(map[float64]*backgroundIon)
+	for _, polarity := range []int{1, -1} {
+		cals := make([]identifiedCalibrant, len(libCals))
+		copy(cals, libCals)
+		cals = calibsWithPolarity(cals, polarity)
+		calibrants, err := makeChargedCalibrants(cals, par)
+		if err != nil {
+			return nil, err
+		}
+		// Calibrants of both polarities share their backgroundIon
+		for i := range calibrants {
+			if ions[calibrants[i].mz] == nil {
+				ions[calibrants[i].mz] = &backgroundIon{cal: &calibrants[i].chargedCals[0]}
+			}
+		}
+		polarityCals[polarity] = calibrants
+	}
+
+	for _, spec := range specs {
+		peaks, err := mzML.ReadScan(spec.idx)
+		if err != nil {
+			return nil, err
+		}
+		for _, cal := range calibrantsMatchPeaks(peaks, polarityCals[spec.polarity], par) {
+			ion := ions[cal.mz]
+			errPPM := (cal.mzMeasured - cal.mz) / cal.mz * 1e6
+			ion.count++
+			ion.sumErr += errPPM
+			ion.sumSqrErr += errPPM * errPPM
+		}
+	}
+
+	var discovered []identifiedCalibrant
+	for _, polarity := range []int{1, -1} {
+		for _, cal := range polarityCals[polarity] {
+			ion := ions[cal.mz]
+			if ion == nil {
+				continue // Already evaluated for the other polarity
+			}
+			delete(ions, cal.mz)
+			if ion.count == 0 || float64(ion.count) < *par.discoverFrac*float64(len(specs)) {
+				continue
+			}
+			n := float64(ion.count)
+			meanErr := ion.sumErr / n
+			stdDev := math.Sqrt(math.Max(ion.sumSqrErr/n-meanErr*meanErr, 0))
+			if stdDev > *par.mzErrPPM/3 {
+				continue
+			}
+			idCal := *ion.cal.idCal
+			idCal.idCharge = ion.cal.charge
+			idCal.identChargeOnly = true
+			idCal.singleCharged = false
+			discovered = append(discovered, idCal)
+			if par.verbosity != infoSilent {
+				log.Printf("Discovered background ion %s, charge %d (m/z %f) in %.0f%% of MS1 spectra, m/z error %.2f ppm (sd %.2f)",
+					idCal.name, idCal.idCharge, cal.mz, 100*n/float64(len(specs)), meanErr, stdDev)
+			}
+		}
+	}
+	if len(discovered) == 0 && par.verbosity != infoSilent {
+		log.Print("No persistent background ions discovered")
+	}
+	return discovered, nil
+}
@@ -0,0 +1,349 @@
+// This file contains the reader of tabular calibrant lists, which are
+// used for calibrants that are not identified by a search engine
+
+package main
+
+import (
+	"bufio"
+	_ "embed"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/524D/mzrecal/internal/chem"
+	"github.com/524D/mzrecal/internal/mzidentml"
+)
+
+// Name of the built-in calibrant library for parameter -lib
+const defaultLibraryName = `default`
+
+// Name of the optional built-in library of LC-MS background ions
+const contaminantLibraryName = `contaminants`
+
+// Name of the optional built-in library of peptide contaminants
+const peptideLibraryName = `peptides`
+
+// The built-in calibrant library with the cyclosiloxanes that mzRecal
+// always used
+//
+//go:embed library/default.tsv
+var defaultLibrary string
+
+// The built-in library of other common LC-MS background ions
+//
+//go:embed library/contaminants.tsv
+var contaminantLibrary string
+
+// The built-in library of trypsin autolysis and keratin peptides
+//
+//go:embed library/peptides.tsv
+var peptideLibrary string
+
+// formulaMass computes the monoisotopic mass of an uncharged elemental
+// formula, e.g. C6H12O6 (see chem.ParseFormula)
+func formulaMass(formula string) (float64, error) {
+	f, err := chem.ParseFormula(formula)
+	if err != nil {
+		return 0.0, err
+	}
+	if f.Charge != 0 {
+		return 0.0, errors.New(`charged formula ` + formula + `, specify ions by adducts`)
+	}
+	return f.Mass(), nil
+}
+
+// readCalibrantList reads calibrants from a tab or comma separated list.
+// Lines starting with "#" are comments.
+// The first line contains the column names (case insensitive):
+//
+//	name      name of the calibrant (required)
+//	sequence  peptide sequence
+//	mods      modifications of the peptide, separated by ";". Each is a
+//	          UNIMOD/PSI-MOD accession, modification name, mass shift or
+//	          elemental formula of the mass shift, e.g. "H-2O-1"
+//	formula   elemental formula, e.g. "C6H12O6" or "C4[13C]2H12O6"
+//	mass      uncharged monoisotopic mass
+//	charge    charge state(s), e.g. "2", "1;2" or "1:3". If empty, the
+//	          charge states of parameter -charge are used.
+//	adducts   ion forms, separated by ";", e.g. "[M+H]+;[M+Na]+;[2M+NH4]+".
+//	          These replace charge.
+//	polarity  "+" or "-": the calibrant is only used in spectra of this
+//	          polarity. Negative ions must be specified by adducts.
+//	rt        retention time (s) or range, e.g. "600" or "600:660".
+//	          If empty, the calibrant is used at all retention times.
+//	score     score of the calibrant, only used if the score filter
+//	          contains "score", e.g. -scorefilter 'score(0.9:)'
+//
+// The mass of a calibrant is taken from the first of sequence (with mods),
+// formula or mass that is not empty.
+func readCalibrantList(reader io.Reader, scoreFilt scoreFilter) ([]identifiedCalibrant, error) {
+	s := bufio.NewScanner(reader)
+	header := ``
+	lineNr := 1
+	for ; s.Scan(); lineNr++ {
+		if !strings.HasPrefix(s.Text(), `#`) {
+			header = strings.TrimRight(s.Text(), "\r")
+			break
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if header == `` {
+		return nil, errors.New("calibrant list is empty")
+	}
+	sep := `,`
+	if strings.Contains(header, "\t") {
+		sep = "\t"
+	}
+	cols := make(map[string]int)
+	for i, name := range strings.Split(header, sep) {
+		cols[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	if _, ok := cols[`name`]; !ok {
+		return nil, errors.New(`calibrant list has no column "name"`)
+	}
+	nrMass := 0
+	for _, name := range []string{`sequence`, `formula`, `mass`} {
+		if _, ok := cols[name]; ok {
+			nrMass++
+		}
+	}
+	if nrMass == 0 {
+		return nil, errors.New(`calibrant list needs column "sequence", "formula" or "mass"`)
+	}
+	useScore := scoreFilt.usesScore(`score`)
+
+	var cals []identifiedCalibrant
+	for lineNr++; s.Scan(); lineNr++ {
+		line := strings.TrimRight(s.Text(), "\r")
+		if strings.TrimSpace(line) == `` || strings.HasPrefix(line, `#`) {
+			continue
+		}
+		fields := strings.Split(line, sep)
+		field := func(name string) string {
+			i, ok := cols[name]
+			if !ok || i >= len(fields) {
+				return ``
+			}
+			return strings.TrimSpace(fields[i])
+		}
+		lineErr := func(msg string) error {
+			return errors.New(`calibrant list line ` + strconv.Itoa(lineNr) + `: ` + msg)
+		}
+
+		if useScore && field(`score`) != `` {
+			// Only the score of a calibrant is known to the filter
+			ident := mzidentml.Identification{Cv: []mzidentml.CVParam{
+				{Name: `score`, Value: field(`score`)}}}
+			scoreOK, err := scoreFilterPasses(&ident, scoreFilt)
+			if err != nil {
+				return nil, lineErr(`invalid score`)
+			}
+			if !scoreOK {
+				continue
+			}
+		}
+
+		var cal identifiedCalibrant
+		cal.name = field(`name`)
+		m, err := calListMass(field(`sequence`), field(`mods`),
+			field(`formula`), field(`mass`))
+		if err != nil {
+			return nil, lineErr(err.Error())
+		}
+		cal.mass = m
+
+		cal.retentionTime = -math.MaxFloat64 // Any retention time
+		if rt := field(`rt`); rt != `` {
+			rtMin, rtMax, err := parseFloat64Range(rt, 0, math.MaxFloat64)
+			if err != nil || !strings.Contains(rt, `:`) {
+				rtMin, err = strconv.ParseFloat(rt, 64)
+				if err != nil {
+					return nil, lineErr(`invalid retention time`)
+				}
+				rtMax = rtMin
+			}
+			cal.retentionTime = rtMin
+			cal.rtEnd = rtMax
+		}
+
+		switch field(`polarity`) {
+		case ``:
+		case `+`:
+			cal.polarity = 1
+		case `-`:
+			cal.polarity = -1
+		default:
+			return nil, lineErr(`invalid polarity ` + field(`polarity`))
+		}
+
+		if adducts := field(`adducts`); adducts != `` {
+			adductCals, err := adductCalibrants(cal, adducts)
+			if err != nil {
+				return nil, lineErr(err.Error())
+			}
+			cals = append(cals, adductCals...)
+			continue
+		}
+		if cal.polarity < 0 {
+			return nil, lineErr(`negative ions must be specified by adducts`)
+		}
+		charges, err := parseCharges(field(`charge`))
+		if err != nil {
+			return nil, lineErr(err.Error())
+		}
+		if len(charges) == 0 {
+			cals = append(cals, cal)
+		}
+		for _, charge := range charges {
+			cal.idCharge = charge
+			cal.identChargeOnly = true
+			cals = append(cals, cal)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return cals, nil
+}
+
+// adductCalibrants returns a calibrant for each adduct of cal.
+// The mass of an adduct calibrant is set such that the usual m/z
+// computation, (mass + charge * massProton) / charge, yields the m/z of
+// the adduct ion.
+func adductCalibrants(cal identifiedCalibrant, adducts string) ([]identifiedCalibrant, error) {
+	var cals []identifiedCalibrant
+	for _, adductStr := range strings.Split(adducts, `;`) {
+		adductStr = strings.TrimSpace(adductStr)
+		if adductStr == `` {
+			continue
+		}
+		adduct, err := chem.ParseAdduct(adductStr)
+		if err != nil {
+			return nil, err
+		}
+		polarity := adduct.Polarity()
+		if cal.polarity != 0 && cal.polarity != polarity {
+			return nil, errors.New(chem.ErrInvalidAdduct.Error() + ` ` + adductStr)
+		}
+		charge := polarity * adduct.Charge
+
+		adductCal := cal
+		adductCal.name = cal.name + ` ` + adductStr
+		adductCal.mass = adduct.IonMass(cal.mass) - float64(charge)*chem.MassProton
+		adductCal.idCharge = charge
+		adductCal.identChargeOnly = true
+		adductCal.polarity = polarity
+		cals = append(cals, adductCal)
+	}
+	return cals, nil
+}
+
+// readCalibrantLibraries reads the calibrant libraries of parameter -lib,
+// a comma separated list of files or names of built-in libraries.
+func readCalibrantLibraries(libs string) ([]identifiedCalibrant, error) {
+	var cals []identifiedCalibrant
+	for _, lib := range strings.Split(libs, `,`) {
+		lib = strings.TrimSpace(lib)
+		var libCals []identifiedCalibrant
+		var err error
+		switch lib {
+		case ``:
+			continue
+		case defaultLibraryName:
+			libCals, err = readCalibrantList(strings.NewReader(defaultLibrary), scoreFilter{})
+		case contaminantLibraryName:
+			libCals, err = readCalibrantList(strings.NewReader(contaminantLibrary), scoreFilter{})
+		case peptideLibraryName:
+			libCals, err = readCalibrantList(strings.NewReader(peptideLibrary), scoreFilter{})
+		default:
+			var f *os.File
+			f, err = os.Open(lib)
+			if err != nil {
+				return nil, err
+			}
+			libCals, err = readCalibrantList(f, scoreFilter{})
+			f.Close()
+		}
+		if err != nil {
+			return nil, errors.New(lib + `: ` + err.Error())
+		}
+		cals = append(cals, libCals...)
+	}
+	return cals, nil
+}
+
+// calListMass computes the uncharged mass of a calibrant from its
+// sequence and modifications, formula or mass
+func calListMass(seq, mods, formula, mass string) (float64, error) {
+	switch {
+	case seq != ``:
+		m, err := pepMass(seq)
+		if err != nil {
+			return 0.0, err
+		}
+		for _, mod := range strings.Split(mods, `;`) {
+			mod = strings.TrimSpace(mod)
+			if mod == `` {
+				continue
+			}
+			modMass, err := strconv.ParseFloat(mod, 64)
+			if err != nil {
+				var ok bool
+				modMass, ok = mzidentml.LookupModMass(mod, mod)
+				if !ok {
+					// Elemental formula of the mass shift, e.g. H-2O-1
+					modMass, err = formulaMass(mod)
+					if err != nil {
+						return 0.0, errors.New(`unknown modification ` + mod)
+					}
+				}
+			}
+			m += modMass
+		}
+		return m, nil
+	case formula != ``:
+		return formulaMass(formula)
+	case mass != ``:
+		m, err := strconv.ParseFloat(mass, 64)
+		if err != nil {
+			return 0.0, errors.New(`invalid mass`)
+		}
+		return m, nil
+	}
+	return 0.0, errors.New(`no sequence, formula or mass`)
+}
+
+// parseCharges parses a list of charge states, e.g. "2", "1;2" or "1:3"
+func parseCharges(s string) ([]int, error) {
+	var charges []int
+	for _, part := range strings.Split(s, `;`) {
+		part = strings.TrimSpace(part)
+		if part == `` {
+			continue
+		}
+		if strings.Contains(part, `:`) {
+			if strings.HasPrefix(part, `:`) || strings.HasSuffix(part, `:`) {
+				return nil, errors.New(`open charge range ` + part)
+			}
+			minCharge, maxCharge, err := parseIntRange(part, 1, math.MaxInt32)
+			if err != nil {
+				return nil, errors.New(`invalid charge ` + part)
+			}
+			for c := minCharge; c <= maxCharge; c++ {
+				charges = append(charges, c)
+			}
+			continue
+		}
+		c, err := strconv.Atoi(part)
+		if err != nil || c <= 0 {
+			return nil, errors.New(`invalid charge ` + part)
+		}
+		charges = append(charges, c)
+	}
+	return charges, nil
+}
@@ -0,0 +1,168 @@
+// This file contains the code for combining the identifications of
+// multiple identification files (parameter -consensus)
+
+package main
+
+import (
+	"errors"
+	"math"
+	"math/bits"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/524D/mzrecal/internal/mzidentml"
+	"github.com/524D/mzrecal/internal/mzml"
+)
+
+// How identifications of multiple files are combined
+type consensusMode int
+
+const (
+	consensusUnion        consensusMode = iota // PSMs that pass in any file
+	consensusIntersection                      // PSMs that pass in all files
+	consensusAgree                             // PSMs that another file confirms and none contradicts
+)
+
+// Maximum number of identification files that can be combined
+const maxIdentFiles = 64
+
+// splitFilenames splits a list of filenames separated by commas.
+// Filenames may contain commas themselves: the shortest sequence of
+// parts that is an existing file is taken as one filename.
+func splitFilenames(s string) []string {
+	parts := strings.Split(s, `,`)
+	var names []string
+	for i := 0; i < len(parts); {
+		// Parts that are no existing file (in any combination) are
+		// taken as one filename each
+		n := 1
+		for j := i + 1; j <= len(parts); j++ {
+			if _, err := os.Stat(strings.Join(parts[i:j], `,`)); err == nil {
+				n = j - i
+				break
+			}
+		}
+		names = append(names, strings.Join(parts[i:i+n], `,`))
+		i += n
+	}
+	return names
+}
+
+// parseConsensusMode converts the name of a consensus mode
+func parseConsensusMode(s string) (consensusMode, error) {
+	switch strings.ToLower(s) {
+	case `union`:
+		return consensusUnion, nil
+	case `intersection`:
+		return consensusIntersection, nil
+	case `agree`:
+		return consensusAgree, nil
+	}
+	return consensusUnion, errors.New(`invalid consensus mode ` + s)
+}
+
+// consensusPSM is a PSM with the files in which it was found
+type consensusPSM struct {
+	ident   mzidentml.Identification // As found in the first file
+	specKey string                   // See spectrumKey
+	files   uint64                   // Bit set of files
+}
+
+// psmCombiner combines the PSMs of multiple files. The PSMs of each
+// file are added as soon as they are read, so that only one copy of
+// each PSM is kept in memory.
+type psmCombiner struct {
+	mzML      *mzml.MzML
+	nrFiles   int
+	psms      []*consensusPSM
+	specPSMs  map[string]map[string]*consensusPSM // PSMs per spectrum and peptide
+	specFiles map[string]uint64                   // Files that identify a spectrum
+}
+
+// newPSMCombiner returns a psmCombiner. Spectra are matched by their
+// index in mzML, if not nil (see spectrumKey).
+func newPSMCombiner(mzML *mzml.MzML) *psmCombiner {
+	return &psmCombiner{
+		mzML:      mzML,
+		specPSMs:  make(map[string]map[string]*consensusPSM),
+		specFiles: make(map[string]uint64),
+	}
+}
+
+// add adds the selected identifications of the next file
+func (c *psmCombiner) add(idents []mzidentml.Identification) {
+	f := c.nrFiles
+	c.nrFiles++
+	for i := range idents {
+		sk := spectrumKey(&idents[i], c.mzML)
+		pk := peptideKey(&idents[i])
+		if c.specPSMs[sk] == nil {
+			c.specPSMs[sk] = make(map[string]*consensusPSM)
+		}
+		psm, ok := c.specPSMs[sk][pk]
+		if !ok {
+			psm = &consensusPSM{ident: idents[i], specKey: sk}
+			c.specPSMs[sk][pk] = psm
+			c.psms = append(c.psms, psm)
+		}
+		psm.files |= 1 << f
+		c.specFiles[sk] |= 1 << f
+	}
+}
+
+// spectrumKey identifies the spectrum of a PSM. Spectra are matched by
+// their index in mzML, so that different spectrum ID formats of
+// different search engines (e.g. index= and scan=) match. For PSMs
+// without spectrum (e.g. DIA reports), the retention time is used.
+func spectrumKey(ident *mzidentml.Identification, mzML *mzml.MzML) string {
+	if mzML != nil && ident.SpecID != `` {
+		if specIdx, err := mzML.ScanIndex(ident.SpecID); err == nil {
+			return `#` + strconv.Itoa(specIdx)
+		}
+	}
+	if ident.SpecID != `` {
+		return ident.SpecID
+	}
+	return `rt=` + strconv.FormatFloat(ident.RetentionTime, 'f', 3, 64)
+}
+
+// peptideKey identifies the peptide (or small molecule) and charge of
+// a PSM. I and L are not distinguished, and modifications are compared
+// by their total mass, because search engines report these differently.
+func peptideKey(ident *mzidentml.Identification) string {
+	name := strings.ReplaceAll(strings.ToUpper(ident.PepSeq), `I`, `L`)
+	if name == `` {
+		name = ident.PepID + ident.Adduct
+	}
+	modMass := strconv.FormatFloat(math.Round(ident.ModMass*100)/100, 'f', 2, 64)
+	return name + `/` + modMass + `/` + strconv.Itoa(ident.Charge)
+}
+
+// combined returns the PSMs of the files that were added:
+//
+//	union: PSMs that pass in any file
+//	intersection: PSMs (same spectrum, peptide and charge) that pass in all files
+//	agree: PSMs of spectra that are identified by at least two files,
+//	       which all report the same peptide and charge
+//
+// PSMs that are found in multiple files are returned once.
+func (c *psmCombiner) combined(mode consensusMode) []mzidentml.Identification {
+	allFiles := uint64(1)<<c.nrFiles - 1
+	var combined []mzidentml.Identification
+	for _, psm := range c.psms {
+		switch mode {
+		case consensusIntersection:
+			if psm.files != allFiles {
+				continue
+			}
+		case consensusAgree:
+			specFiles := c.specFiles[psm.specKey]
+			if bits.OnesCount64(specFiles) < 2 || specFiles&^psm.files != 0 {
+				continue
+			}
+		}
+		combined = append(combined, psm.ident)
+	}
+	return combined
+}
@@ -10,6 +10,7 @@ import (
 	"math"
 	"sync"
 
+	"github.com/524D/mzrecal/internal/chem"
 	"github.com/524D/mzrecal/internal/mzml"
 )
 
@@ -130,7 +131,7 @@ func debugListUnusedCalibrants(allCals []identifiedCalibrant) {
 		for _, ac := range allCals {
 			_, ok := calUsed4Spec[ac]
 			if !ok {
-				fmt.Printf("%+v mz:%f\n", ac, (ac.mass+float64(ac.idCharge)*massProton)/float64(ac.idCharge))
+				fmt.Printf("%+v mz:%f\n", ac, (ac.mass+float64(ac.idCharge)*chem.MassProton)/float64(ac.idCharge))
 			}
 		}
 		calUsed4SpecMux.Unlock()
@@ -0,0 +1,240 @@
+// This file contains the code for selecting calibrants by their
+// target-decoy q-value, as an alternative for a fixed score filter
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/524D/mzrecal/internal/mzidentml"
+)
+
+// CV terms that contain a PSM-level q-value, in order of preference
+var qValueCvTerms = []string{
+	`MS:1002354`, // PSM-level q-value
+	`MS:1001491`, // percolator:Q value
+	`MS:1002054`, // MS-GF:QValue
+}
+
+// Scores that can be used to compute q-values, with their direction.
+// In order of preference when the score is not specified by the user.
+var fdrScores = []struct {
+	accession    string
+	higherBetter bool
+}{
+	{`MS:1002466`, true},  // PeptideShaker PSM score
+	{`MS:1002053`, false}, // MS-GF:EValue
+	{`MS:1002052`, false}, // MS-GF:SpecEValue
+	{`MS:1002257`, false}, // Comet:expectation value
+	{`MS:1001330`, false}, // X!Tandem:expectation value
+	{`MS:1001159`, false}, // SEQUEST:expectation value
+	{`MS:1001172`, false}, // Mascot:expectation value
+	{`MS:1001328`, false}, // OMSSA:evalue
+	{`MS:1001493`, false}, // posterior error probability
+	{`MS:1002338`, true},  // Andromeda:score
+	{`MS:1002319`, true},  // Amanda:AmandaScore
+	{`MS:1001171`, true},  // Mascot:score
+	{`MS:1001331`, true},  // X!Tandem:hyperscore
+	{`MS:1002252`, true},  // Comet:xcorr
+	{`MS:1001155`, true},  // SEQUEST:xcorr
+}
+
+// scoreDirector is implemented by identification readers for formats
+// that specify whether higher or lower values of a score are better
+type scoreDirector interface {
+	ScoreDirection(score string) (higherBetter bool, ok bool)
+}
+
+var ErrNoDecoys = errors.New("no decoy PSMs found, can't compute q-values. Use -scorefilter instead of -fdr")
+
+// psmScore holds the values needed to compute the q-value of a PSM
+type psmScore struct {
+	idx   int // Index of the identification
+	score float64
+	decoy bool
+}
+
+// cvValue returns the value of the CV term with the given accession or
+// name, and whether it was found
+func cvValue(ident *mzidentml.Identification, term string) (float64, bool, error) {
+	for _, cv := range ident.Cv {
+		if cv.Accession == term || cv.Name == term {
+			v, err := strconv.ParseFloat(cv.Value, 64)
+			if err != nil {
+				return 0.0, false, errors.New("Invalid score value " + cv.Value)
+			}
+			return v, true, nil
+		}
+	}
+	return 0.0, false, nil
+}
+
+// parseFdrScore parses the -fdrscore option, which has the format
+// <CVterm|scorename>[:higher|:lower]. If no direction is specified,
+// it is taken from the known scores or from the file (sd may be nil).
+func parseFdrScore(s string, sd scoreDirector) (string, bool, error) {
+	term := s
+	dir := ``
+	if i := strings.LastIndex(s, `:`); i >= 0 {
+		switch strings.ToLower(s[i+1:]) {
+		case `higher`, `lower`:
+			term = s[:i]
+			dir = strings.ToLower(s[i+1:])
+		}
+	}
+	if dir != `` {
+		return term, dir == `higher`, nil
+	}
+	for _, fs := range fdrScores {
+		if fs.accession == term {
+			return term, fs.higherBetter, nil
+		}
+	}
+	if sd != nil {
+		if higherBetter, ok := sd.ScoreDirection(term); ok {
+			return term, higherBetter, nil
+		}
+	}
+	return ``, false, fmt.Errorf("unknown direction of score %s, append :higher or :lower", s)
+}
+
+// computeQValues computes the target-decoy q-value of each PSM.
+// The slice of scores is sorted in place. PSMs with equal score
+// get the same q-value.
+func computeQValues(scores []psmScore, higherBetter bool) map[int]float64 {
+	sort.SliceStable(scores, func(i, j int) bool {
+		if higherBetter {
+			return scores[i].score > scores[j].score
+		}
+		return scores[i].score < scores[j].score
+	})
+	fdr := make([]float64, len(scores))
+	nrTarget, nrDecoy := 0, 0
+	for i := 0; i < len(scores); {
+		// Process groups of equal scores at once
+		j := i
+		for ; j < len(scores) && scores[j].score == scores[i].score; j++ {
+			if scores[j].decoy {
+				nrDecoy++
+			} else {
+				nrTarget++
+			}
+		}
+		f := float64(1.0)
+		if nrTarget > 0 {
+			f = math.Min(1.0, float64(nrDecoy)/float64(nrTarget))
+		}
+		for k := i; k < j; k++ {
+			fdr[k] = f
+		}
+		i = j
+	}
+	// The q-value is the lowest FDR at which the PSM is accepted
+	qValues := make(map[int]float64, len(scores))
+	minFdr := float64(1.0)
+	for i := len(scores) - 1; i >= 0; i-- {
+		minFdr = math.Min(minFdr, fdr[i])
+		qValues[scores[i].idx] = minFdr
+	}
+	return qValues
+}
+
+// identQValues returns the q-value for each identification (by index in idents).
+// If the file contains q-values, and no score was specified by the user,
+// these are used. Otherwise q-values are computed from target and decoy
+// PSMs. Only rank 1 PSMs take part in the target-decoy competition,
+// other PSMs get no q-value.
+func identQValues(idents []mzidentml.Identification, sd scoreDirector,
+	par params) (map[int]float64, error) {
+	var scoreTerm string
+	var higherBetter bool
+	var err error
+	if *par.fdrScore != `` {
+		scoreTerm, higherBetter, err = parseFdrScore(*par.fdrScore, sd)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Use q-values from the file if present
+	if scoreTerm == `` {
+		for _, term := range qValueCvTerms {
+			qValues := make(map[int]float64)
+			for i := range idents {
+				q, ok, err := cvValue(&idents[i], term)
+				if err != nil {
+					return nil, err
+				}
+				if ok {
+					qValues[i] = q
+				}
+			}
+			if len(qValues) > 0 {
+				if par.verbosity != infoSilent {
+					log.Printf("Using q-values from %s", term)
+				}
+				return qValues, nil
+			}
+		}
+	}
+
+	// Find the score to compute q-values from
+	if scoreTerm == `` {
+	findScore:
+		for _, fs := range fdrScores {
+			for i := range idents {
+				if _, ok, _ := cvValue(&idents[i], fs.accession); ok {
+					scoreTerm = fs.accession
+					higherBetter = fs.higherBetter
+					break findScore
+				}
+			}
+		}
+		// Otherwise use the first score for which the file specifies
+		// the direction
+		if scoreTerm == `` && sd != nil && len(idents) > 0 {
+			for _, cv := range idents[0].Cv {
+				if hb, ok := sd.ScoreDirection(cv.Name); ok {
+					scoreTerm = cv.Name
+					higherBetter = hb
+					break
+				}
+			}
+		}
+		if scoreTerm == `` {
+			return nil, errors.New("no q-values or known score found for computing q-values, use -fdrscore")
+		}
+	}
+
+	scores := make([]psmScore, 0, len(idents))
+	nrDecoy := 0
+	for i := range idents {
+		if idents[i].Rank > 1 {
+			continue
+		}
+		score, ok, err := cvValue(&idents[i], scoreTerm)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			scores = append(scores, psmScore{idx: i, score: score, decoy: idents[i].Decoy})
+			if idents[i].Decoy {
+				nrDecoy++
+			}
+		}
+	}
+	if nrDecoy == 0 {
+		return nil, ErrNoDecoys
+	}
+	if par.verbosity != infoSilent {
+		log.Printf("Computing q-values from score %s (%d targets, %d decoys)",
+			scoreTerm, len(scores)-nrDecoy, nrDecoy)
+	}
+	return computeQValues(scores, higherBetter), nil
+}
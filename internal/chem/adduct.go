@@ -0,0 +1,83 @@
+package chem
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+)
+
+// Adduct notation, e.g. [M+H]+, [2M+Na]+, [M-H2O+H]+ or [M-2H]2-
+var adductRe = regexp.MustCompile(`^\[(\d*)M((?:[+-]\d*[A-Z\[(][A-Za-z0-9\[\]()]*)*)\](\d*)([+-])$`)
+
+// Atoms that are added or removed in an adduct, e.g. "+Na" or "-H2O"
+var adductGroupRe = regexp.MustCompile(`([+-])(\d*)([A-Z\[(][A-Za-z0-9\[\]()]*)`)
+
+// Adduct is an ion form of a molecule M, e.g. [M+Na]+
+type Adduct struct {
+	NrM    int     // Number of molecules, e.g. 2 for [2M+H]+
+	Delta  Formula // Atoms that are added (or removed, if negative)
+	Charge int     // Signed charge of the ion
+}
+
+// ParseAdduct parses an adduct in the usual notation, e.g. "[M+H]+",
+// "[2M+NH4]+", "[M-H2O+H]+" or "[M-2H]2-". Added and removed groups are
+// elemental formulas without charge.
+func ParseAdduct(s string) (Adduct, error) {
+	a := Adduct{NrM: 1, Delta: Formula{Atoms: make(map[Atom]int)}, Charge: 1}
+	m := adductRe.FindStringSubmatch(s)
+	if m == nil {
+		return a, errors.New(ErrInvalidAdduct.Error() + ` ` + s)
+	}
+	if m[1] != `` {
+		a.NrM, _ = strconv.Atoi(m[1])
+	}
+	for _, g := range adductGroupRe.FindAllStringSubmatch(m[2], -1) {
+		group, err := ParseFormula(g[3])
+		if err != nil || group.Charge != 0 {
+			return a, errors.New(ErrInvalidAdduct.Error() + ` ` + s + `: ` + g[3])
+		}
+		count := 1
+		if g[2] != `` {
+			count, _ = strconv.Atoi(g[2])
+		}
+		if g[1] == `-` {
+			count = -count
+		}
+		a.Delta = a.Delta.Add(group, count)
+	}
+	if m[3] != `` {
+		a.Charge, _ = strconv.Atoi(m[3])
+	}
+	if m[4] == `-` {
+		a.Charge = -a.Charge
+	}
+	if a.Charge == 0 || a.NrM <= 0 {
+		return a, errors.New(ErrInvalidAdduct.Error() + ` ` + s)
+	}
+	return a, nil
+}
+
+// Polarity returns 1 for positive and -1 for negative ions
+func (a Adduct) Polarity() int {
+	if a.Charge < 0 {
+		return -1
+	}
+	return 1
+}
+
+// IonMass returns the mass of the ion of a molecule with monoisotopic
+// mass m, including the electrons that were lost or gained
+func (a Adduct) IonMass(m float64) float64 {
+	return float64(a.NrM)*m + a.Delta.Mass() - float64(a.Charge)*MassElectron
+}
+
+// Mz returns the m/z of the ion of a molecule with monoisotopic mass m
+func (a Adduct) Mz(m float64) float64 {
+	return a.IonMass(m) / float64(abs(a.Charge))
+}
+
+// Ion returns the formula of the ion of molecule f
+func (a Adduct) Ion(f Formula) Formula {
+	ion := Formula{Atoms: make(map[Atom]int), Charge: a.Charge}
+	return ion.Add(f, a.NrM).Add(a.Delta, 1)
+}
@@ -0,0 +1,391 @@
+// Package chem parses elemental formulas and adducts, and computes
+// their exact masses and isotope distributions
+package chem
+
+import (
+	"bufio"
+	_ "embed"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Masses of elementary particles (u)
+const (
+	MassProton   = float64(1.007276466879)
+	MassElectron = float64(0.000548579909)
+)
+
+var (
+	// ErrInvalidFormula means that an elemental formula could not be parsed
+	ErrInvalidFormula = errors.New("invalid elemental formula")
+	// ErrInvalidAdduct means that an adduct could not be parsed
+	ErrInvalidAdduct = errors.New("invalid adduct")
+)
+
+// Isotopes of the elements, from elements.tsv
+//
+//go:embed elements.tsv
+var elementTable string
+
+// isotope of an element
+type isotope struct {
+	massNumber int
+	mass       float64
+	abundance  float64
+}
+
+// element with its isotopes, ordered by mass number
+type element struct {
+	isotopes []isotope
+	mono     int // index of the most abundant isotope
+}
+
+var elements = readElements(elementTable)
+
+// readElements parses the element table
+func readElements(table string) map[string]*element {
+	elems := make(map[string]*element)
+	s := bufio.NewScanner(strings.NewReader(table))
+	for s.Scan() {
+		if strings.HasPrefix(s.Text(), `#`) || strings.HasPrefix(s.Text(), `symbol`) {
+			continue
+		}
+		f := strings.Split(s.Text(), "\t")
+		if len(f) != 4 {
+			panic(`element table: invalid line ` + s.Text())
+		}
+		var iso isotope
+		var err [3]error
+		iso.massNumber, err[0] = strconv.Atoi(f[1])
+		iso.mass, err[1] = strconv.ParseFloat(f[2], 64)
+		iso.abundance, err[2] = strconv.ParseFloat(f[3], 64)
+		if err[0] != nil || err[1] != nil || err[2] != nil {
+			panic(`element table: invalid line ` + s.Text())
+		}
+		e, ok := elems[f[0]]
+		if !ok {
+			e = &element{}
+			elems[f[0]] = e
+		}
+		e.isotopes = append(e.isotopes, iso)
+		if iso.abundance > e.isotopes[e.mono].abundance {
+			e.mono = len(e.isotopes) - 1
+		}
+	}
+	return elems
+}
+
+// Atom is an element, or a specific isotope of it if MassNumber isn't 0
+type Atom struct {
+	Element    string
+	MassNumber int // 0 for the natural isotope distribution
+}
+
+// Formula is an elemental formula with its charge
+type Formula struct {
+	Atoms  map[Atom]int
+	Charge int
+}
+
+// ParseFormula parses an elemental formula, e.g. "C6H12O6".
+//
+// Specific isotopes are written in brackets, e.g. "C4[13C]2H12O6".
+// Groups in parentheses can be repeated, e.g. "H(C2H4O)5OH".
+// Negative counts (e.g. "H-1") are accepted, for mass differences.
+// A charge is specified at the end by one or more signs, e.g. "C6H13O6+"
+// or "SO4--", or in parentheses, e.g. "SO4(2-)".
+func ParseFormula(s string) (Formula, error) {
+	f := Formula{Atoms: make(map[Atom]int)}
+	s = strings.TrimSpace(s)
+	s, f.Charge = cutCharge(s)
+	if s == `` {
+		return f, ErrInvalidFormula
+	}
+	p := formulaParser{s: s}
+	if err := p.parse(&f, 1); err != nil {
+		return f, err
+	}
+	if p.pos != len(p.s) {
+		return f, errors.New(ErrInvalidFormula.Error() + `: unexpected "` + p.s[p.pos:] + `"`)
+	}
+	return f, nil
+}
+
+// MustParseFormula is like ParseFormula but panics if the formula
+// cannot be parsed. It is intended for formulas that are constants.
+func MustParseFormula(s string) Formula {
+	f, err := ParseFormula(s)
+	if err != nil {
+		panic(`chem: ParseFormula(` + s + `): ` + err.Error())
+	}
+	return f
+}
+
+// cutCharge removes the charge from the end of a formula
+func cutCharge(s string) (string, int) {
+	if strings.HasSuffix(s, `)`) {
+		if i := strings.LastIndex(s, `(`); i >= 0 {
+			c := s[i+1 : len(s)-1]
+			sign := 0
+			switch {
+			case strings.HasSuffix(c, `+`) || strings.HasPrefix(c, `+`):
+				sign = 1
+			case strings.HasSuffix(c, `-`) || strings.HasPrefix(c, `-`):
+				sign = -1
+			}
+			c = strings.Trim(c, `+-`)
+			n := 1
+			if c != `` {
+				var err error
+				n, err = strconv.Atoi(c)
+				if err != nil || n <= 0 {
+					sign = 0
+				}
+			}
+			if sign != 0 {
+				return s[:i], sign * n
+			}
+		}
+	}
+	charge := 0
+	for len(s) > 0 {
+		switch s[len(s)-1] {
+		case '+':
+			charge++
+		case '-':
+			charge--
+		default:
+			return s, charge
+		}
+		s = s[:len(s)-1]
+	}
+	return s, charge
+}
+
+// formulaParser parses a formula without charge
+type formulaParser struct {
+	s   string
+	pos int
+}
+
+// parse adds the atoms up to the end of the formula or group to f,
+// multiplied by mult
+func (p *formulaParser) parse(f *Formula, mult int) error {
+	for p.pos < len(p.s) && p.s[p.pos] != ')' {
+		c := p.s[p.pos]
+		switch {
+		case c == '(':
+			p.pos++
+			group := Formula{Atoms: make(map[Atom]int)}
+			if err := p.parse(&group, 1); err != nil {
+				return err
+			}
+			if p.pos >= len(p.s) {
+				return errors.New(ErrInvalidFormula.Error() + `: missing ")"`)
+			}
+			p.pos++
+			n, err := p.count()
+			if err != nil {
+				return err
+			}
+			for a, cnt := range group.Atoms {
+				f.Atoms[a] += mult * n * cnt
+			}
+		case c == '[':
+			end := strings.IndexByte(p.s[p.pos:], ']')
+			if end < 0 {
+				return errors.New(ErrInvalidFormula.Error() + `: missing "]"`)
+			}
+			iso := p.s[p.pos+1 : p.pos+end]
+			i := strings.IndexFunc(iso, func(r rune) bool { return !unicode.IsDigit(r) })
+			massNumber, err := strconv.Atoi(iso[:max(i, 0)])
+			if err != nil || i <= 0 {
+				return errors.New(ErrInvalidFormula.Error() + `: invalid isotope ` + iso)
+			}
+			a := Atom{Element: iso[i:], MassNumber: massNumber}
+			if _, ok := a.isotope(); !ok {
+				return errors.New(ErrInvalidFormula.Error() + `: unknown isotope ` + iso)
+			}
+			p.pos += end + 1
+			n, err := p.count()
+			if err != nil {
+				return err
+			}
+			f.Atoms[a] += mult * n
+		case unicode.IsUpper(rune(c)):
+			n := p.pos + 1
+			for n < len(p.s) && unicode.IsLower(rune(p.s[n])) {
+				n++
+			}
+			symbol := p.s[p.pos:n]
+			if _, ok := elements[symbol]; !ok {
+				return errors.New(ErrInvalidFormula.Error() + `: unknown element ` + symbol)
+			}
+			p.pos = n
+			cnt, err := p.count()
+			if err != nil {
+				return err
+			}
+			f.Atoms[Atom{Element: symbol}] += mult * cnt
+		default:
+			return errors.New(ErrInvalidFormula.Error() + `: unexpected "` + p.s[p.pos:] + `"`)
+		}
+	}
+	return nil
+}
+
+// count parses the optional (possibly negative) count after an atom
+// or group
+func (p *formulaParser) count() (int, error) {
+	n := p.pos
+	if n < len(p.s) && p.s[n] == '-' {
+		n++
+	}
+	for n < len(p.s) && unicode.IsDigit(rune(p.s[n])) {
+		n++
+	}
+	if n == p.pos {
+		return 1, nil
+	}
+	cnt, err := strconv.Atoi(p.s[p.pos:n])
+	if err != nil {
+		return 0, errors.New(ErrInvalidFormula.Error() + `: invalid count ` + p.s[p.pos:n])
+	}
+	p.pos = n
+	return cnt, nil
+}
+
+// isotope returns the isotope of the atom: its specific isotope, or
+// else the most abundant one
+func (a Atom) isotope() (isotope, bool) {
+	e, ok := elements[a.Element]
+	if !ok {
+		return isotope{}, false
+	}
+	if a.MassNumber == 0 {
+		return e.isotopes[e.mono], true
+	}
+	for _, iso := range e.isotopes {
+		if iso.massNumber == a.MassNumber {
+			return iso, true
+		}
+	}
+	return isotope{}, false
+}
+
+// Mass returns the monoisotopic mass of the formula. For charged formulas,
+// the mass of the electrons that were lost or gained is included.
+// The atoms are summed in Hill order, so that the mass does not depend
+// on the (random) iteration order of the map.
+func (f Formula) Mass() float64 {
+	m := 0.0
+	for _, a := range f.hillOrder() {
+		iso, _ := a.isotope()
+		m += float64(f.Atoms[a]) * iso.mass
+	}
+	return m - float64(f.Charge)*MassElectron
+}
+
+// Mz returns the m/z of a charged formula, or its mass if it has no charge
+func (f Formula) Mz() float64 {
+	if f.Charge == 0 {
+		return f.Mass()
+	}
+	return f.Mass() / float64(abs(f.Charge))
+}
+
+// Add returns the sum of f and n times g. The charges are added too.
+func (f Formula) Add(g Formula, n int) Formula {
+	sum := Formula{Atoms: make(map[Atom]int, len(f.Atoms)+len(g.Atoms)),
+		Charge: f.Charge + n*g.Charge}
+	for a, cnt := range f.Atoms {
+		sum.Atoms[a] = cnt
+	}
+	for a, cnt := range g.Atoms {
+		sum.Atoms[a] += n * cnt
+		if sum.Atoms[a] == 0 {
+			delete(sum.Atoms, a)
+		}
+	}
+	return sum
+}
+
+// Label returns the formula in which a fraction of the atoms of an
+// element is replaced by one of its isotopes, e.g. Label("N", 15, 1) for
+// uniform 15N labeling. Counts are rounded to whole atoms.
+func (f Formula) Label(elem string, massNumber int, fraction float64) (Formula, error) {
+	a := Atom{Element: elem, MassNumber: massNumber}
+	if _, ok := a.isotope(); !ok || massNumber == 0 {
+		return f, errors.New(`unknown isotope ` + strconv.Itoa(massNumber) + elem)
+	}
+	n := int(float64(f.Atoms[Atom{Element: elem}])*fraction + 0.5)
+	label := Formula{Atoms: map[Atom]int{{Element: elem}: -n, a: n}}
+	return f.Add(label, 1), nil
+}
+
+// hillOrder returns the atoms of the formula with a non-zero count in
+// Hill order: C and H first, the other elements in alphabetical order,
+// isotopes after their element
+func (f Formula) hillOrder() []Atom {
+	atoms := make([]Atom, 0, len(f.Atoms))
+	for a, n := range f.Atoms {
+		if n != 0 {
+			atoms = append(atoms, a)
+		}
+	}
+	_, hasC := f.Atoms[Atom{Element: `C`}]
+	order := func(a Atom) string {
+		if hasC && a.Element == `C` {
+			return "\x00"
+		}
+		if hasC && a.Element == `H` {
+			return "\x01"
+		}
+		return a.Element
+	}
+	sort.Slice(atoms, func(i, j int) bool {
+		oi, oj := order(atoms[i]), order(atoms[j])
+		if oi != oj {
+			return oi < oj
+		}
+		return atoms[i].MassNumber < atoms[j].MassNumber
+	})
+	return atoms
+}
+
+// String returns the formula in Hill notation: C and H first, the other
+// elements in alphabetical order, isotopes after their element
+func (f Formula) String() string {
+	var sb strings.Builder
+	for _, a := range f.hillOrder() {
+		if a.MassNumber == 0 {
+			sb.WriteString(a.Element)
+		} else {
+			sb.WriteString(`[` + strconv.Itoa(a.MassNumber) + a.Element + `]`)
+		}
+		if n := f.Atoms[a]; n != 1 {
+			sb.WriteString(strconv.Itoa(n))
+		}
+	}
+	switch {
+	case f.Charge == 1:
+		sb.WriteString(`+`)
+	case f.Charge == -1:
+		sb.WriteString(`-`)
+	case f.Charge > 1:
+		sb.WriteString(`(` + strconv.Itoa(f.Charge) + `+)`)
+	case f.Charge < -1:
+		sb.WriteString(`(` + strconv.Itoa(-f.Charge) + `-)`)
+	}
+	return sb.String()
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -0,0 +1,136 @@
+package chem
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseFormula(t *testing.T) {
+	tests := []struct {
+		formula string
+		mass    float64
+		charge  int
+		hill    string
+	}{
+		{"C6H12O6", 180.063388, 0, "C6H12O6"},
+		{"C4[13C]2H12O6", 182.070098, 0, "C4[13C]2H12O6"},
+		{"H(C2H4O)5OH", 238.141638, 0, "C10H22O6"},
+		{"H-2O-1", -18.010565, 0, "H-2O-1"},
+		{"C6H13O6+", 181.070665, 1, "C6H13O6+"},
+		{"SO4(2-)", 95.952827, -2, "O4S(2-)"},
+		{"SO4--", 95.952827, -2, "O4S(2-)"},
+		{"NaCl", 57.958622, 0, "ClNa"},
+	}
+	for _, tc := range tests {
+		f, err := ParseFormula(tc.formula)
+		if err != nil {
+			t.Errorf("ParseFormula(%s): error return %v", tc.formula, err)
+			continue
+		}
+		if math.Abs(f.Mass()-tc.mass) > 1e-5 || f.Charge != tc.charge || f.String() != tc.hill {
+			t.Errorf("ParseFormula(%s): got mass %f charge %d %s, expected %f %d %s",
+				tc.formula, f.Mass(), f.Charge, f.String(), tc.mass, tc.charge, tc.hill)
+		}
+	}
+	if mz := MustParseFormula("SO4(2-)").Mz(); math.Abs(mz-47.976413) > 1e-5 {
+		t.Errorf("Mz of SO4(2-) is %f, expected 47.976413", mz)
+	}
+	for _, bad := range []string{"", "C6Xx12", "c6", "C6(H2", "C[14C]", "[C]2", "C6H12O6)"} {
+		if _, err := ParseFormula(bad); err == nil {
+			t.Errorf("ParseFormula(%s): expected error", bad)
+		}
+	}
+}
+
+func TestLabel(t *testing.T) {
+	lys := MustParseFormula("C6H12N2O")
+	heavy, err := lys.Label("C", 13, 1)
+	if err != nil || math.Abs(heavy.Mass()-lys.Mass()-6.020129) > 1e-5 {
+		t.Errorf("13C6 Lys: mass difference %f (%v), expected 6.020129",
+			heavy.Mass()-lys.Mass(), err)
+	}
+	heavy, err = heavy.Label("N", 15, 1)
+	if err != nil || math.Abs(heavy.Mass()-lys.Mass()-8.014199) > 1e-5 {
+		t.Errorf("13C6 15N2 Lys: mass difference %f (%v), expected 8.014199",
+			heavy.Mass()-lys.Mass(), err)
+	}
+	if _, err = lys.Label("C", 14, 1); err == nil {
+		t.Errorf("Label 14C: expected error")
+	}
+}
+
+func TestParseAdduct(t *testing.T) {
+	glucose := MustParseFormula("C6H12O6")
+	tests := []struct {
+		adduct string
+		mz     float64
+		charge int
+	}{
+		{"[M+H]+", 181.070665, 1},
+		{"[M+Na]+", 203.052609, 1},
+		{"[M-H]-", 179.056112, -1},
+		{"[2M+H]+", 361.134053, 1},
+		{"[M-H2O+H]+", 163.060100, 1},
+		{"[M+2H]2+", 91.038971, 2},
+	}
+	for _, tc := range tests {
+		a, err := ParseAdduct(tc.adduct)
+		if err != nil {
+			t.Errorf("ParseAdduct(%s): error return %v", tc.adduct, err)
+			continue
+		}
+		if math.Abs(a.Mz(glucose.Mass())-tc.mz) > 1e-5 || a.Charge != tc.charge {
+			t.Errorf("%s: got m/z %f charge %d, expected %f %d",
+				tc.adduct, a.Mz(glucose.Mass()), a.Charge, tc.mz, tc.charge)
+		}
+		if ion := a.Ion(glucose); math.Abs(ion.Mz()-tc.mz) > 1e-5 {
+			t.Errorf("%s: ion %s has m/z %f, expected %f", tc.adduct, ion, ion.Mz(), tc.mz)
+		}
+	}
+	for _, bad := range []string{"M+H", "[M+H]", "[M+Xx]+", "[0M+H]+", "[M+H+]+"} {
+		if _, err := ParseAdduct(bad); err == nil {
+			t.Errorf("ParseAdduct(%s): expected error", bad)
+		}
+	}
+}
+
+func TestIsotopeDistribution(t *testing.T) {
+	// For C100, the ratio of the 2nd and 1st peak is 100 * 13C/12C
+	dist, err := MustParseFormula("C100").IsotopeDistribution(3)
+	if err != nil || len(dist) != 3 {
+		t.Fatalf("IsotopeDistribution: %d peaks, error return %v", len(dist), err)
+	}
+	if r := dist[1].Abundance / dist[0].Abundance; math.Abs(r-100*0.0107/0.9893) > 1e-9 {
+		t.Errorf("C100: ratio of peaks is %f, expected %f", r, 100*0.0107/0.9893)
+	}
+	if math.Abs(dist[1].Mass-1201.003355) > 1e-6 {
+		t.Errorf("C100: mass of 2nd peak is %f, expected 1201.003355", dist[1].Mass)
+	}
+
+	// The complete distribution adds up to 1, and starts at the
+	// monoisotopic mass for elements whose lightest isotope is the most
+	// abundant one
+	glucose := MustParseFormula("C6H12O6")
+	dist, err = glucose.IsotopeDistribution(40)
+	if err != nil {
+		t.Fatalf("IsotopeDistribution: error return %v", err)
+	}
+	sum := 0.0
+	for _, p := range dist {
+		sum += p.Abundance
+	}
+	if math.Abs(sum-1) > 1e-9 || math.Abs(dist[0].Mass-glucose.Mass()) > 1e-9 {
+		t.Errorf("Glucose: sum of abundances %f, first mass %f, expected 1 and %f",
+			sum, dist[0].Mass, glucose.Mass())
+	}
+
+	// Labeled atoms shift the distribution
+	labeled, err := MustParseFormula("C4[13C]2H12O6").IsotopeDistribution(2)
+	if err != nil || math.Abs(labeled[0].Mass-glucose.Mass()-2*1.0033548378) > 1e-9 {
+		t.Errorf("Labeled glucose: first mass %f (%v)", labeled[0].Mass, err)
+	}
+
+	if _, err = MustParseFormula("H-2O-1").IsotopeDistribution(2); err != ErrNegativeCount {
+		t.Errorf("Expected ErrNegativeCount, got: %v", err)
+	}
+}
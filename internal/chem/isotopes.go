@@ -0,0 +1,91 @@
+package chem
+
+import "errors"
+
+// ErrNegativeCount means that a formula with negative atom counts has
+// no isotope distribution
+var ErrNegativeCount = errors.New("formula has negative atom count")
+
+// Peak is a peak of an isotope distribution
+type Peak struct {
+	Mass      float64 // Abundance weighted average mass of the isotopologues
+	Abundance float64 // Fraction of the molecules
+}
+
+// IsotopeDistribution returns the first n peaks of the isotope
+// distribution of the formula, at nominal mass differences of 1 starting
+// from the lightest isotopologue. Atoms with a specific isotope
+// (e.g. [13C]) don't contribute to the distribution.
+// The abundances add up to 1 for the complete distribution.
+// For charged formulas, the masses include the electrons.
+func (f Formula) IsotopeDistribution(n int) ([]Peak, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	dist := []Peak{{Mass: 0, Abundance: 1}}
+	fixedMass := -float64(f.Charge) * MassElectron
+	for a, cnt := range f.Atoms {
+		if cnt < 0 {
+			return nil, ErrNegativeCount
+		}
+		if cnt == 0 {
+			continue
+		}
+		if a.MassNumber != 0 {
+			iso, _ := a.isotope()
+			fixedMass += float64(cnt) * iso.mass
+			continue
+		}
+		dist = convolve(dist, elementDistribution(elements[a.Element], cnt, n), n)
+	}
+	for len(dist) < n {
+		dist = append(dist, Peak{Mass: dist[len(dist)-1].Mass + 1})
+	}
+	for i := range dist {
+		dist[i].Mass += fixedMass
+	}
+	return dist, nil
+}
+
+// elementDistribution returns the isotope distribution of cnt atoms of
+// an element, truncated to n peaks
+func elementDistribution(e *element, cnt int, n int) []Peak {
+	lightest := e.isotopes[0].massNumber
+	single := make([]Peak, e.isotopes[len(e.isotopes)-1].massNumber-lightest+1)
+	for _, iso := range e.isotopes {
+		single[iso.massNumber-lightest] = Peak{Mass: iso.mass, Abundance: iso.abundance}
+	}
+	// Exponentiation by squaring
+	result := []Peak{{Mass: 0, Abundance: 1}}
+	for ; cnt > 0; cnt >>= 1 {
+		if cnt&1 == 1 {
+			result = convolve(result, single, n)
+		}
+		if cnt > 1 {
+			single = convolve(single, single, n)
+		}
+	}
+	return result
+}
+
+// convolve returns the distribution of the combination of molecules
+// with distributions a and b, truncated to n peaks
+func convolve(a, b []Peak, n int) []Peak {
+	c := make([]Peak, min(len(a)+len(b)-1, n))
+	for i := range a {
+		for j := 0; j < len(b) && i+j < len(c); j++ {
+			p := a[i].Abundance * b[j].Abundance
+			c[i+j].Abundance += p
+			c[i+j].Mass += p * (a[i].Mass + b[j].Mass)
+		}
+	}
+	for k := range c {
+		if c[k].Abundance > 0 {
+			c[k].Mass /= c[k].Abundance
+		} else {
+			// No isotopologue at this nominal mass, e.g. between 32S and 34S
+			c[k].Mass = c[0].Mass + float64(k)
+		}
+	}
+	return c
+}
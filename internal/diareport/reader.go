@@ -0,0 +1,262 @@
+// Package diareport reads precursor identifications from DIA-NN
+// (report.tsv) and Spectronaut long-format reports
+package diareport
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/524D/mzrecal/internal/mzidentml"
+)
+
+var (
+	// ErrNoHeader means the file doesn't start with a header line
+	ErrNoHeader = errors.New("diareport: missing header line")
+	// ErrUnknownFormat means the columns are not those of a known report
+	ErrUnknownFormat = errors.New("diareport: unknown report format")
+	// ErrInvalidLine means a line could not be parsed
+	ErrInvalidLine = errors.New("diareport: invalid line")
+	// ErrRunNotFound means no row has the requested run name
+	ErrRunNotFound = errors.New("diareport: no identifications of run")
+)
+
+// reportColumns contains the names of the columns of a report format
+type reportColumns struct {
+	software string
+	run      string
+	modSeq   string
+	charge   string
+	mz       string
+	rt       string // Apex retention time, in minutes
+	qValue   string
+	pep      string
+	decoy    string
+	protein  string
+}
+
+// Known report formats. The format is detected from the presence of
+// the charge, retention time and modified sequence columns.
+var reportFormats = []reportColumns{
+	{
+		software: `DIA-NN`,
+		run:      `Run`,
+		modSeq:   `Modified.Sequence`,
+		charge:   `Precursor.Charge`,
+		mz:       `Precursor.Mz`,
+		rt:       `RT`,
+		qValue:   `Q.Value`,
+		pep:      `PEP`,
+		decoy:    `Decoy`,
+		protein:  `Protein.Ids`,
+	},
+	{
+		software: `Spectronaut`,
+		run:      `R.FileName`,
+		modSeq:   `EG.ModifiedSequence`,
+		charge:   `FG.Charge`,
+		mz:       `FG.PrecMz`,
+		rt:       `EG.ApexRT`,
+		qValue:   `EG.Qvalue`,
+		pep:      `EG.PEP`,
+		decoy:    `EG.IsDecoy`,
+		protein:  `PG.ProteinAccessions`,
+	},
+}
+
+// Reader reads precursor identifications from a DIA report one at a time
+type Reader struct {
+	s         *bufio.Scanner
+	cols      map[string]int
+	rc        *reportColumns
+	matched   bool            // A row of Run was found
+	otherRuns map[string]bool // Runs of the other rows
+	// If not empty, only rows with this run name are returned. If there
+	// are no such rows, Next returns an error that lists the runs of
+	// the report.
+	Run string
+}
+
+// NewReader creates a Reader for DIA report content from an io.Reader
+func NewReader(reader io.Reader) *Reader {
+	s := bufio.NewScanner(reader)
+	s.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	return &Reader{s: s, otherRuns: make(map[string]bool)}
+}
+
+// Next returns the next precursor identification in the file.
+// The retention time is the apex retention time of the precursor,
+// so that the retention time window of the calibrant is centred on
+// the apex. Rows without retention time are skipped.
+// At the end of the file, io.EOF is returned.
+func (r *Reader) Next() (mzidentml.Identification, error) {
+	if r.cols == nil {
+		err := r.readHeader()
+		if err != nil {
+			return mzidentml.Identification{}, err
+		}
+	}
+	for r.s.Scan() {
+		line := strings.TrimRight(r.s.Text(), "\r")
+		if line == `` {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if r.Run != `` {
+			if run, ok := r.field(fields, r.rc.run); ok && run != r.Run {
+				r.otherRuns[run] = true
+				continue
+			}
+			r.matched = true
+		}
+		ident, ok, err := r.identification(fields)
+		if err != nil {
+			return ident, err
+		}
+		if ok {
+			return ident, nil
+		}
+	}
+	if err := r.s.Err(); err != nil {
+		return mzidentml.Identification{}, err
+	}
+	if r.Run != `` && !r.matched && len(r.otherRuns) > 0 {
+		runs := make([]string, 0, len(r.otherRuns))
+		for run := range r.otherRuns {
+			runs = append(runs, run)
+		}
+		sort.Strings(runs)
+		return mzidentml.Identification{}, errors.New(ErrRunNotFound.Error() + ` ` +
+			r.Run + ` (runs in report: ` + strings.Join(runs, `, `) + `)`)
+	}
+	return mzidentml.Identification{}, io.EOF
+}
+
+// readHeader reads the column names from the first line and
+// determines the report format
+func (r *Reader) readHeader() error {
+	if !r.s.Scan() {
+		if err := r.s.Err(); err != nil {
+			return err
+		}
+		return ErrNoHeader
+	}
+	r.cols = make(map[string]int)
+	for i, name := range strings.Split(strings.TrimRight(r.s.Text(), "\r"), "\t") {
+		r.cols[strings.TrimSpace(name)] = i
+	}
+	for i := range reportFormats {
+		rc := &reportFormats[i]
+		_, okCharge := r.cols[rc.charge]
+		_, okRT := r.cols[rc.rt]
+		_, okSeq := r.cols[rc.modSeq]
+		if okCharge && okRT && okSeq {
+			r.rc = rc
+			return nil
+		}
+	}
+	return ErrUnknownFormat
+}
+
+// field returns the value of a named column, ok is false if the
+// column is absent or empty
+func (r *Reader) field(fields []string, name string) (string, bool) {
+	i, ok := r.cols[name]
+	if !ok || i >= len(fields) {
+		return ``, false
+	}
+	v := strings.TrimSpace(fields[i])
+	return v, v != `` && v != `NaN`
+}
+
+// floatField returns the value of a numeric column, ok is false if
+// the column is absent or empty
+func (r *Reader) floatField(fields []string, name string) (float64, bool, error) {
+	v, ok := r.field(fields, name)
+	if !ok {
+		return 0.0, false, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0.0, false, errors.New(ErrInvalidLine.Error() + `: ` + name + ` "` + v + `"`)
+	}
+	return f, !math.IsNaN(f), nil
+}
+
+// identification converts a row into an Identification.
+// ok is false if the row has no retention time.
+func (r *Reader) identification(fields []string) (ident mzidentml.Identification, ok bool, err error) {
+	rc := r.rc
+	rt, ok, err := r.floatField(fields, rc.rt)
+	if err != nil || !ok {
+		return ident, false, err
+	}
+	// Both DIA-NN and Spectronaut report retention times in minutes
+	ident.RetentionTime = rt * 60
+
+	modSeq, _ := r.field(fields, rc.modSeq)
+	ident.PepID = strings.Trim(modSeq, `_`)
+	ident.PepSeq, ident.ModMass, ident.UnknownMods = mzidentml.ParseModSeq(ident.PepID, lookupMod)
+
+	charge, ok, err := r.floatField(fields, rc.charge)
+	if err != nil {
+		return ident, false, err
+	}
+	if ok {
+		ident.Charge = int(charge)
+	}
+	// Older DIA-NN versions don't report the precursor m/z,
+	// the mass is then computed from the sequence
+	mz, ok, err := r.floatField(fields, rc.mz)
+	if err != nil {
+		return ident, false, err
+	}
+	if ok {
+		ident.CalculatedMz = mz
+	}
+	ident.Rank = 1
+	ident.PassThreshold = true
+	if d, ok := r.field(fields, rc.decoy); ok {
+		ident.Decoy = d == `1` || strings.EqualFold(d, `true`)
+	}
+	if prot, ok := r.field(fields, rc.protein); ok {
+		ident.Proteins = strings.Split(prot, `;`)
+	}
+	if q, ok := r.field(fields, rc.qValue); ok {
+		ident.Cv = append(ident.Cv, mzidentml.CVParam{
+			Accession: `MS:1002354`,
+			Name:      rc.qValue,
+			Value:     q,
+		})
+	}
+	if pep, ok := r.field(fields, rc.pep); ok {
+		ident.Cv = append(ident.Cv, mzidentml.CVParam{
+			Name:  rc.pep,
+			Value: pep,
+		})
+	}
+	return ident, true, nil
+}
+
+// AnalysisSoftware returns the software that produced the report. It
+// is known after the first call of Next.
+func (r *Reader) AnalysisSoftware() []mzidentml.AnalysisSoftware {
+	if r.rc == nil {
+		return nil
+	}
+	return []mzidentml.AnalysisSoftware{{Name: r.rc.software}}
+}
+
+// lookupMod returns the mass shift of a DIA-NN modification, e.g.
+// "UniMod:35", or a Spectronaut modification, e.g. "Oxidation (M)"
+func lookupMod(mod string) (float64, bool) {
+	name := mod
+	if k := strings.Index(name, ` (`); k >= 0 {
+		name = name[:k]
+	}
+	return mzidentml.LookupModMass(name, name)
+}
@@ -0,0 +1,96 @@
+package diareport
+
+import (
+	"io"
+	"math"
+	"strings"
+	"testing"
+)
+
+const testDIANN = "File.Name\tRun\tProtein.Ids\tModified.Sequence\tStripped.Sequence\tPrecursor.Id\tPrecursor.Charge\tQ.Value\tPEP\tRT\tRT.Start\tRT.Stop\tPrecursor.Mz\n" +
+	"/data/run1.raw\trun1\tP1;P2\t(UniMod:1)PEM(UniMod:35)TC(UniMod:4)IDE\tPEMTCIDE\tx2\t2\t0.001\t0.002\t30.5\t30.2\t30.8\t500.1\n" +
+	"/data/run2.raw\trun2\tP3\tPEPTIDE\tPEPTIDE\tPEPTIDE2\t2\t0.001\t0.002\t31.0\t30.8\t31.2\t400.2\n" +
+	"/data/run1.raw\trun1\tP4\tEDITPEP(UniMod:9999)\tEDITPEP\tx3\t3\t0.02\t0.1\t32.0\t31.8\t32.2\t\n"
+
+const testSpectronaut = "R.FileName\tPG.ProteinAccessions\tEG.ModifiedSequence\tFG.Charge\tFG.PrecMz\tEG.ApexRT\tEG.Qvalue\tEG.IsDecoy\n" +
+	"run1\tP1\t_[Acetyl (Protein N-term)]PEM[Oxidation (M)]TIDE_\t2\t450.2\t12.5\t0.0005\tFalse\n" +
+	"run1\tP2\t_EDITPEP_\t2\t400.2\t13.0\t0.5\tTrue\n"
+
+func TestDIANN(t *testing.T) {
+	r := NewReader(strings.NewReader(testDIANN))
+	r.Run = "run1"
+	ident, err := r.Next()
+	if err != nil {
+		t.Fatalf("Next: error return %v", err)
+	}
+	if ident.PepSeq != "PEMTCIDE" || ident.Charge != 2 || ident.Decoy ||
+		ident.RetentionTime != 1830 || ident.CalculatedMz != 500.1 ||
+		len(ident.Proteins) != 2 || len(ident.UnknownMods) != 0 {
+		t.Errorf("Unexpected identification %+v", ident)
+	}
+	if math.Abs(ident.ModMass-(42.010565+15.994915+57.021464)) > 1e-6 {
+		t.Errorf("ModMass is %f", ident.ModMass)
+	}
+	if len(ident.Cv) != 2 || ident.Cv[0].Accession != "MS:1002354" ||
+		ident.Cv[0].Name != "Q.Value" || ident.Cv[0].Value != "0.001" {
+		t.Errorf("Unexpected scores %+v", ident.Cv)
+	}
+	if as := r.AnalysisSoftware(); len(as) != 1 || as[0].Name != "DIA-NN" {
+		t.Errorf("AnalysisSoftware: got %+v, expected DIA-NN", as)
+	}
+
+	// Row of run2 is skipped
+	ident, err = r.Next()
+	if err != nil {
+		t.Fatalf("Next: error return %v", err)
+	}
+	if ident.PepSeq != "EDITPEP" || ident.Charge != 3 || ident.CalculatedMz != 0 ||
+		len(ident.UnknownMods) != 1 {
+		t.Errorf("Unexpected identification %+v", ident)
+	}
+
+	_, err = r.Next()
+	if err != io.EOF {
+		t.Errorf("Expected io.EOF, got %v", err)
+	}
+
+	// A run that is not in the report
+	r = NewReader(strings.NewReader(testDIANN))
+	r.Run = "run3"
+	_, err = r.Next()
+	if err == nil || !strings.HasPrefix(err.Error(), ErrRunNotFound.Error()) ||
+		!strings.Contains(err.Error(), "run1, run2") {
+		t.Errorf("Expected ErrRunNotFound listing run1, run2, got %v", err)
+	}
+}
+
+func TestSpectronaut(t *testing.T) {
+	r := NewReader(strings.NewReader(testSpectronaut))
+	ident, err := r.Next()
+	if err != nil {
+		t.Fatalf("Next: error return %v", err)
+	}
+	if ident.PepSeq != "PEMTIDE" || ident.Charge != 2 || ident.Decoy ||
+		ident.RetentionTime != 750 || ident.CalculatedMz != 450.2 ||
+		math.Abs(ident.ModMass-(42.010565+15.994915)) > 1e-6 {
+		t.Errorf("Unexpected identification %+v", ident)
+	}
+	if as := r.AnalysisSoftware(); len(as) != 1 || as[0].Name != "Spectronaut" {
+		t.Errorf("AnalysisSoftware: got %+v, expected Spectronaut", as)
+	}
+	ident, err = r.Next()
+	if err != nil {
+		t.Fatalf("Next: error return %v", err)
+	}
+	if !ident.Decoy {
+		t.Errorf("Expected decoy %+v", ident)
+	}
+}
+
+func TestUnknownFormat(t *testing.T) {
+	r := NewReader(strings.NewReader("a\tb\n1\t2\n"))
+	_, err := r.Next()
+	if err != ErrUnknownFormat {
+		t.Errorf("Expected ErrUnknownFormat, got %v", err)
+	}
+}
@@ -0,0 +1,32 @@
+package idxml
+
+// Types for parsing idXML
+
+type proteinHit struct {
+	ID        string      `xml:"id,attr"`
+	Accession string      `xml:"accession,attr"`
+	UserParam []userParam `xml:"UserParam"`
+}
+
+type peptideIdentification struct {
+	ScoreType         string       `xml:"score_type,attr"`
+	HigherScoreBetter string       `xml:"higher_score_better,attr"`
+	MZ                *float64     `xml:"MZ,attr"`
+	RT                *float64     `xml:"RT,attr"`
+	SpectrumReference string       `xml:"spectrum_reference,attr"`
+	PeptideHit        []peptideHit `xml:"PeptideHit"`
+}
+
+type peptideHit struct {
+	Score       string      `xml:"score,attr"`
+	Sequence    string      `xml:"sequence,attr"`
+	Charge      int         `xml:"charge,attr"`
+	ProteinRefs string      `xml:"protein_refs,attr"`
+	UserParam   []userParam `xml:"UserParam"`
+}
+
+type userParam struct {
+	Type  string `xml:"type,attr"`
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
@@ -0,0 +1,211 @@
+// Package idxml reads identifications from OpenMS idXML files
+package idxml
+
+import (
+	"encoding/xml"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/524D/mzrecal/internal/mzidentml"
+	"golang.org/x/net/html/charset"
+)
+
+// CV terms for the score types that OpenMS tools write
+var scoreTypeCv = map[string]string{
+	`q-value`:                     `MS:1002354`,
+	`posterior error probability`: `MS:1001493`,
+	`ms-gf:specevalue`:            `MS:1002052`,
+	`ms-gf:evalue`:                `MS:1002053`,
+	`percolator_qvalue`:           `MS:1001491`,
+}
+
+// Reader reads identifications from an idXML file one at a time
+type Reader struct {
+	d            *xml.Decoder
+	proteins     map[string]*proteinHit
+	higherBetter map[string]bool // Score direction per score type
+	software     []mzidentml.AnalysisSoftware
+	pending      []mzidentml.Identification
+}
+
+// NewReader creates a Reader for streaming idXML content from an io.Reader
+func NewReader(reader io.Reader) *Reader {
+	d := xml.NewDecoder(reader)
+	d.CharsetReader = charset.NewReaderLabel
+	return &Reader{
+		d:            d,
+		proteins:     make(map[string]*proteinHit),
+		higherBetter: make(map[string]bool),
+	}
+}
+
+// Next returns the next identification (peptide hit) in the file.
+// At the end of the file, io.EOF is returned.
+func (r *Reader) Next() (mzidentml.Identification, error) {
+	for len(r.pending) == 0 {
+		err := r.readPeptideIdentification()
+		if err != nil {
+			return mzidentml.Identification{}, err
+		}
+	}
+	ident := r.pending[0]
+	r.pending = r.pending[1:]
+	return ident, nil
+}
+
+// ScoreDirection returns whether higher values are better for a score,
+// as specified by higher_score_better in the file. ok is false if the
+// score was not encountered (yet).
+func (r *Reader) ScoreDirection(score string) (higherBetter bool, ok bool) {
+	higherBetter, ok = r.higherBetter[score]
+	return higherBetter, ok
+}
+
+// addSoftware adds a search engine to the software of the file
+func (r *Reader) addSoftware(name string) {
+	if name == `` {
+		return
+	}
+	for _, as := range r.software {
+		if as.Name == name {
+			return
+		}
+	}
+	r.software = append(r.software, mzidentml.AnalysisSoftware{Name: name})
+}
+
+// AnalysisSoftware returns the search engines of the identification
+// runs that have been read so far. The first is known after the first
+// call of Next.
+func (r *Reader) AnalysisSoftware() []mzidentml.AnalysisSoftware {
+	return r.software
+}
+
+// readPeptideIdentification reads tokens until the next
+// PeptideIdentification has been decoded, storing the protein hits
+// that it encounters
+func (r *Reader) readPeptideIdentification() error {
+	for {
+		t, err := r.d.Token()
+		if err != nil {
+			return err
+		}
+		se, ok := t.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch se.Name.Local {
+		case `IdentificationRun`:
+			for _, attr := range se.Attr {
+				if attr.Name.Local == `search_engine` {
+					r.addSoftware(attr.Value)
+				}
+			}
+		case `ProteinHit`:
+			var ph proteinHit
+			err = r.d.DecodeElement(&ph, &se)
+			if err != nil {
+				return err
+			}
+			r.proteins[ph.ID] = &ph
+		case `PeptideIdentification`:
+			var pi peptideIdentification
+			err = r.d.DecodeElement(&pi, &se)
+			if err != nil {
+				return err
+			}
+			higherBetter := pi.HigherScoreBetter != `false`
+			r.higherBetter[pi.ScoreType] = higherBetter
+			if acc, ok := scoreTypeCv[strings.ToLower(pi.ScoreType)]; ok {
+				r.higherBetter[acc] = higherBetter
+			}
+			for i := range pi.PeptideHit {
+				r.pending = append(r.pending, r.identification(&pi, &pi.PeptideHit[i], i+1))
+			}
+			return nil
+		}
+	}
+}
+
+// identification converts a peptide hit into an Identification
+func (r *Reader) identification(pi *peptideIdentification, hit *peptideHit,
+	rank int) mzidentml.Identification {
+	var ident mzidentml.Identification
+
+	ident.PepID = hit.Sequence
+	ident.PepSeq, ident.ModMass, ident.UnknownMods = mzidentml.ParseModSeq(hit.Sequence, lookupMod)
+	ident.Charge = hit.Charge
+	ident.Rank = rank
+	ident.PassThreshold = true
+	ident.SpecID = pi.SpectrumReference
+	ident.RetentionTime = -1
+	if pi.RT != nil {
+		ident.RetentionTime = *pi.RT
+	}
+	if pi.MZ != nil {
+		ident.ExperimentalMz = *pi.MZ
+	}
+
+	scoreCv := mzidentml.CVParam{Name: pi.ScoreType, Value: hit.Score}
+	scoreCv.Accession = scoreTypeCv[strings.ToLower(pi.ScoreType)]
+	if strings.HasPrefix(pi.ScoreType, `MS:`) {
+		scoreCv.Accession = pi.ScoreType
+	}
+	ident.Cv = append(ident.Cv, scoreCv)
+
+	targetDecoy := ``
+	for _, up := range hit.UserParam {
+		switch {
+		case up.Name == `target_decoy`:
+			targetDecoy = up.Value
+		case up.Name == `calcMZ`:
+			if mz, err := strconv.ParseFloat(up.Value, 64); err == nil {
+				ident.CalculatedMz = mz
+			}
+		case up.Type == `float` || up.Type == `int`:
+			// Other numeric meta values are scores, e.g. from
+			// search engines or post-processing
+			cv := mzidentml.CVParam{Name: up.Name, Value: up.Value}
+			if strings.HasPrefix(up.Name, `MS:`) {
+				cv.Accession = up.Name
+			}
+			ident.Cv = append(ident.Cv, cv)
+		}
+	}
+
+	// The decoy status of the hit is derived from that of its proteins
+	// if PeptideIndexer didn't annotate the hit itself
+	allDecoy := len(hit.ProteinRefs) > 0
+	for _, ref := range strings.Fields(hit.ProteinRefs) {
+		ph, ok := r.proteins[ref]
+		if !ok {
+			allDecoy = false
+			continue
+		}
+		ident.Proteins = append(ident.Proteins, ph.Accession)
+		decoy := false
+		for _, up := range ph.UserParam {
+			if up.Name == `target_decoy` && up.Value == `decoy` {
+				decoy = true
+			}
+		}
+		allDecoy = allDecoy && decoy
+	}
+	if targetDecoy != `` {
+		ident.Decoy = targetDecoy == `decoy`
+	} else {
+		ident.Decoy = allDecoy
+	}
+	return ident
+}
+
+// lookupMod returns the mass shift of an OpenMS modification, e.g.
+// "Oxidation" or "+15.9949". Residue masses (e.g. "147") are unknown.
+func lookupMod(mod string) (float64, bool) {
+	if strings.HasPrefix(mod, `+`) || strings.HasPrefix(mod, `-`) {
+		m, err := strconv.ParseFloat(mod, 64)
+		return m, err == nil
+	}
+	return mzidentml.LookupModMass(mod, mod)
+}
@@ -0,0 +1,74 @@
+package idxml
+
+import (
+	"io"
+	"math"
+	"strings"
+	"testing"
+)
+
+const testDoc = `<?xml version="1.0" encoding="UTF-8"?>
+<IdXML version="1.5">
+<SearchParameters id="SP_0" db="db.fasta" charges="+2-+3" mass_type="monoisotopic"/>
+<IdentificationRun date="2024-01-01T00:00:00" search_engine="MSGFPlus" search_engine_version="" search_parameters_ref="SP_0">
+ <ProteinIdentification score_type="" higher_score_better="true" significance_threshold="0">
+  <ProteinHit id="PH_0" accession="PROT1" score="0" sequence="">
+   <UserParam type="string" name="target_decoy" value="target"/>
+  </ProteinHit>
+  <ProteinHit id="PH_1" accession="DECOY_PROT2" score="0" sequence="">
+   <UserParam type="string" name="target_decoy" value="decoy"/>
+  </ProteinHit>
+ </ProteinIdentification>
+ <PeptideIdentification score_type="q-value" higher_score_better="false" significance_threshold="0" MZ="473.7230" RT="123.4" spectrum_reference="controllerType=0 controllerNumber=1 scan=10">
+  <PeptideHit score="0.001" sequence=".(Acetyl)PEPTM(Oxidation)IDE" charge="2" protein_refs="PH_0 PH_1">
+   <UserParam type="string" name="target_decoy" value="target+decoy"/>
+   <UserParam type="float" name="MS:1002053" value="1.5e-8"/>
+   <UserParam type="float" name="calcMZ" value="494.727"/>
+  </PeptideHit>
+  <PeptideHit score="0.5" sequence="EDITPEPC[+57.021464]M[147]" charge="2" protein_refs="PH_1">
+  </PeptideHit>
+ </PeptideIdentification>
+</IdentificationRun>
+</IdXML>
+`
+
+func TestReader(t *testing.T) {
+	r := NewReader(strings.NewReader(testDoc))
+	ident, err := r.Next()
+	if err != nil {
+		t.Fatalf("Next: error return %v", err)
+	}
+	if ident.PepSeq != "PEPTMIDE" || ident.Charge != 2 || ident.Rank != 1 || ident.Decoy ||
+		ident.RetentionTime != 123.4 || ident.ExperimentalMz != 473.7230 ||
+		ident.CalculatedMz != 494.727 || len(ident.Proteins) != 2 ||
+		ident.SpecID != "controllerType=0 controllerNumber=1 scan=10" {
+		t.Errorf("Unexpected identification %+v", ident)
+	}
+	if math.Abs(ident.ModMass-(42.010565+15.994915)) > 1e-6 || len(ident.UnknownMods) != 0 {
+		t.Errorf("ModMass is %f (unknown %v)", ident.ModMass, ident.UnknownMods)
+	}
+	if len(ident.Cv) != 2 || ident.Cv[0].Accession != "MS:1002354" || ident.Cv[0].Value != "0.001" ||
+		ident.Cv[1].Accession != "MS:1002053" {
+		t.Errorf("Unexpected scores %+v", ident.Cv)
+	}
+	if hb, ok := r.ScoreDirection("q-value"); !ok || hb {
+		t.Errorf("ScoreDirection: got %v %v", hb, ok)
+	}
+	if as := r.AnalysisSoftware(); len(as) != 1 || as[0].Name != "MSGFPlus" {
+		t.Errorf("AnalysisSoftware: got %+v, expected MSGFPlus", as)
+	}
+
+	ident, err = r.Next()
+	if err != nil {
+		t.Fatalf("Next: error return %v", err)
+	}
+	if ident.Rank != 2 || !ident.Decoy || len(ident.UnknownMods) != 1 ||
+		math.Abs(ident.ModMass-57.021464) > 1e-6 {
+		t.Errorf("Unexpected identification %+v", ident)
+	}
+
+	_, err = r.Next()
+	if err != io.EOF {
+		t.Errorf("Expected io.EOF, got %v", err)
+	}
+}
@@ -0,0 +1,305 @@
+// Package maxquant reads identifications from MaxQuant msms.txt and
+// evidence.txt files
+package maxquant
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/524D/mzrecal/internal/chem"
+	"github.com/524D/mzrecal/internal/mzidentml"
+)
+
+var (
+	// ErrNoHeader means the file doesn't start with a header line
+	ErrNoHeader = errors.New("maxquant: missing header line")
+	// ErrMissingColumn means a required column is absent
+	ErrMissingColumn = errors.New("maxquant: missing column")
+	// ErrInvalidLine means a line could not be parsed
+	ErrInvalidLine = errors.New("maxquant: invalid line")
+	// ErrInvalidFixedMod means a fixed modification could not be parsed
+	ErrInvalidFixedMod = errors.New("maxquant: invalid fixed modification")
+	// ErrRawFileNotFound means no row has the requested "Raw file"
+	ErrRawFileNotFound = errors.New("maxquant: no identifications of raw file")
+)
+
+// DefaultFixedMods are MaxQuant's default fixed modifications, in the
+// notation of ParseFixedMods
+const DefaultFixedMods = `Carbamidomethyl:C`
+
+// Columns that must be present in the file
+var requiredColumns = []string{`Modified sequence`, `Mass`, `Charge`,
+	`Retention time`}
+
+// Abbreviations used for modifications by older MaxQuant versions, and
+// names used by newer versions that differ from UNIMOD
+var modAbbrev = map[string]string{
+	`ac`: `Acetyl`,
+	`ox`: `Oxidation`,
+	`ph`: `Phospho`,
+	`de`: `Deamidated`,
+	`gl`: `Gln->pyro-Glu`,
+	`pe`: `Glu->pyro-Glu`,
+	`gg`: `GG`,
+	`me`: `Methyl`,
+	`di`: `Dimethyl`,
+	`tr`: `Trimethyl`,
+	`cm`: `Carbamidomethyl`,
+
+	`Deamidation`: `Deamidated`,
+}
+
+// IsMaxQuantHeader returns true if a tab separated header line has the
+// columns of a MaxQuant table
+func IsMaxQuantHeader(header string) bool {
+	cols := make(map[string]bool)
+	for _, name := range strings.Split(strings.TrimRight(header, "\r\n"), "\t") {
+		cols[strings.TrimSpace(name)] = true
+	}
+	for _, name := range append([]string{`Raw file`}, requiredColumns...) {
+		if !cols[name] {
+			return false
+		}
+	}
+	return true
+}
+
+// Reader reads identifications from a MaxQuant table one at a time
+type Reader struct {
+	s             *bufio.Scanner
+	cols          map[string]int
+	matched       bool            // A row of RawFile was found
+	otherRawFiles map[string]bool // Raw files of the other rows
+	// If not empty, only rows with this value in the "Raw file"
+	// column are returned. If there are no such rows, Next returns
+	// an error that lists the raw files of the table.
+	RawFile string
+	// Mass shift of fixed modifications per residue. MaxQuant doesn't
+	// include fixed modifications in the modified sequence, so these
+	// must be known to compute the peptide mass. The default is
+	// DefaultFixedMods.
+	FixedMods map[rune]float64
+}
+
+// NewReader creates a Reader for MaxQuant content from an io.Reader
+func NewReader(reader io.Reader) *Reader {
+	s := bufio.NewScanner(reader)
+	s.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	fixedMods, _ := ParseFixedMods(DefaultFixedMods)
+	return &Reader{
+		s:             s,
+		FixedMods:     fixedMods,
+		otherRawFiles: make(map[string]bool),
+	}
+}
+
+// ParseFixedMods parses fixed modifications separated by ";", each
+// a UNIMOD name or mass shift followed by the modified residues, e.g.
+// "Carbamidomethyl:C" or "57.021464:C;Dimethyl:K". It returns the
+// mass shift per residue.
+func ParseFixedMods(s string) (map[rune]float64, error) {
+	fixedMods := make(map[rune]float64)
+	for _, fm := range strings.Split(s, `;`) {
+		fm = strings.TrimSpace(fm)
+		if fm == `` {
+			continue
+		}
+		mod, residues, ok := strings.Cut(fm, `:`)
+		if !ok || residues == `` {
+			return nil, errors.New(ErrInvalidFixedMod.Error() + ` ` + fm)
+		}
+		m, err := strconv.ParseFloat(mod, 64)
+		if err != nil {
+			m, ok = mzidentml.LookupModMass(``, mod)
+			if !ok {
+				return nil, errors.New(ErrInvalidFixedMod.Error() + ` ` + fm)
+			}
+		}
+		for _, aa := range residues {
+			fixedMods[aa] += m
+		}
+	}
+	return fixedMods, nil
+}
+
+// Next returns the next identification in the file.
+// Rows without retention time (e.g. matches between runs without
+// MS/MS) are skipped. At the end of the file, io.EOF is returned.
+func (r *Reader) Next() (mzidentml.Identification, error) {
+	if r.cols == nil {
+		err := r.readHeader()
+		if err != nil {
+			return mzidentml.Identification{}, err
+		}
+	}
+	for r.s.Scan() {
+		line := strings.TrimRight(r.s.Text(), "\r")
+		if line == `` {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if r.RawFile != `` {
+			if raw, ok := r.field(fields, `Raw file`); ok && raw != r.RawFile {
+				r.otherRawFiles[raw] = true
+				continue
+			}
+			r.matched = true
+		}
+		ident, ok, err := r.identification(fields)
+		if err != nil {
+			return ident, err
+		}
+		if ok {
+			return ident, nil
+		}
+	}
+	if err := r.s.Err(); err != nil {
+		return mzidentml.Identification{}, err
+	}
+	if r.RawFile != `` && !r.matched && len(r.otherRawFiles) > 0 {
+		rawFiles := make([]string, 0, len(r.otherRawFiles))
+		for raw := range r.otherRawFiles {
+			rawFiles = append(rawFiles, raw)
+		}
+		sort.Strings(rawFiles)
+		return mzidentml.Identification{}, errors.New(ErrRawFileNotFound.Error() + ` ` +
+			r.RawFile + ` (raw files in table: ` + strings.Join(rawFiles, `, `) + `)`)
+	}
+	return mzidentml.Identification{}, io.EOF
+}
+
+// readHeader reads the column names from the first line
+func (r *Reader) readHeader() error {
+	if !r.s.Scan() {
+		if err := r.s.Err(); err != nil {
+			return err
+		}
+		return ErrNoHeader
+	}
+	r.cols = make(map[string]int)
+	for i, name := range strings.Split(strings.TrimRight(r.s.Text(), "\r"), "\t") {
+		r.cols[strings.TrimSpace(name)] = i
+	}
+	for _, name := range requiredColumns {
+		if _, ok := r.cols[name]; !ok {
+			return errors.New(ErrMissingColumn.Error() + ` "` + name + `"`)
+		}
+	}
+	return nil
+}
+
+// field returns the value of a named column, ok is false if the
+// column is absent or empty
+func (r *Reader) field(fields []string, name string) (string, bool) {
+	i, ok := r.cols[name]
+	if !ok || i >= len(fields) {
+		return ``, false
+	}
+	v := strings.TrimSpace(fields[i])
+	return v, v != ``
+}
+
+// floatField returns the value of a numeric column, ok is false if
+// the column is absent, empty or NaN
+func (r *Reader) floatField(fields []string, name string) (float64, bool, error) {
+	v, ok := r.field(fields, name)
+	if !ok {
+		return 0.0, false, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0.0, false, errors.New(ErrInvalidLine.Error() + `: ` + name + ` "` + v + `"`)
+	}
+	return f, !math.IsNaN(f), nil
+}
+
+// identification converts a row into an Identification.
+// ok is false if the row has no retention time.
+func (r *Reader) identification(fields []string) (ident mzidentml.Identification, ok bool, err error) {
+	rt, ok, err := r.floatField(fields, `Retention time`)
+	if err != nil || !ok {
+		return ident, false, err
+	}
+	// MaxQuant reports retention times in minutes
+	ident.RetentionTime = rt * 60
+
+	modSeq, _ := r.field(fields, `Modified sequence`)
+	ident.PepID = strings.Trim(modSeq, `_`)
+	ident.PepSeq, ident.ModMass, ident.UnknownMods = mzidentml.ParseModSeq(ident.PepID, lookupMod)
+	for _, aa := range ident.PepSeq {
+		ident.ModMass += r.FixedMods[aa]
+	}
+
+	charge, ok, err := r.floatField(fields, `Charge`)
+	if err != nil {
+		return ident, false, err
+	}
+	if ok {
+		ident.Charge = int(charge)
+	}
+	mass, ok, err := r.floatField(fields, `Mass`)
+	if err != nil {
+		return ident, false, err
+	}
+	if ok && ident.Charge > 0 {
+		c := float64(ident.Charge)
+		ident.CalculatedMz = (mass + c*chem.MassProton) / c
+	}
+	if mz, ok, err := r.floatField(fields, `m/z`); err == nil && ok {
+		ident.ExperimentalMz = mz
+	}
+	// msms.txt has the scan number of the spectrum, evidence.txt
+	// the scan number of the best MS/MS spectrum
+	for _, col := range []string{`Scan number`, `MS/MS scan number`} {
+		if scan, ok := r.field(fields, col); ok {
+			ident.SpecID = `scan=` + scan
+			break
+		}
+	}
+	ident.Rank = 1
+	ident.PassThreshold = true
+	if rev, ok := r.field(fields, `Reverse`); ok && rev == `+` {
+		ident.Decoy = true
+	}
+	if prot, ok := r.field(fields, `Proteins`); ok {
+		ident.Proteins = strings.Split(prot, `;`)
+	}
+	if pep, ok := r.field(fields, `PEP`); ok {
+		ident.Cv = append(ident.Cv, mzidentml.CVParam{
+			Accession: `MS:1001493`,
+			Name:      `PEP`,
+			Value:     pep,
+		})
+	}
+	if score, ok := r.field(fields, `Score`); ok {
+		ident.Cv = append(ident.Cv, mzidentml.CVParam{
+			Accession: `MS:1002338`,
+			Name:      `Score`,
+			Value:     score,
+		})
+	}
+	return ident, true, nil
+}
+
+// AnalysisSoftware returns the software that produced the table
+func (r *Reader) AnalysisSoftware() []mzidentml.AnalysisSoftware {
+	return []mzidentml.AnalysisSoftware{{Name: `MaxQuant`}}
+}
+
+// lookupMod returns the mass shift of a MaxQuant modification, e.g.
+// "Acetyl (Protein N-term)" or "ox"
+func lookupMod(mod string) (float64, bool) {
+	name := mod
+	if k := strings.Index(name, ` (`); k >= 0 {
+		name = name[:k]
+	}
+	if full, ok := modAbbrev[name]; ok {
+		name = full
+	}
+	return mzidentml.LookupModMass(``, name)
+}
@@ -0,0 +1,95 @@
+package maxquant
+
+import (
+	"io"
+	"math"
+	"strings"
+	"testing"
+)
+
+const testMsms = "Raw file\tScan number\tSequence\tModified sequence\tProteins\tCharge\tm/z\tMass\tRetention time\tPEP\tScore\tReverse\n" +
+	"yeast\t1234\tPEMTCIDE\t_(Acetyl (Protein N-term))PEM(Oxidation (M))TCIDE_\tP1;P2\t2\t500.1\t998.1854\t20.5\t0.0012\t120.3\t\n" +
+	"other\t1235\tPEPTIDE\t_PEPTIDE_\tP3\t2\t400.2\t799.3600\t21.0\t0.0001\t130.1\t\n" +
+	"yeast\t1300\tEDITPEP\t_ED(ox)ITPEP_\tREV__P4\t3\t267.1\t799.3600\t22.0\t0.5\t10.0\t+\n" +
+	"yeast\t\tKPEPTIDE\t_KPEPTIDE_\tP5\t2\t464.2\tNaN\tNaN\tNaN\tNaN\t\n"
+
+func TestReader(t *testing.T) {
+	r := NewReader(strings.NewReader(testMsms))
+	r.RawFile = "yeast"
+	ident, err := r.Next()
+	if err != nil {
+		t.Fatalf("Next: error return %v", err)
+	}
+	if ident.PepSeq != "PEMTCIDE" || ident.Charge != 2 || ident.Decoy ||
+		ident.RetentionTime != 1230 || ident.SpecID != "scan=1234" ||
+		len(ident.Proteins) != 2 || len(ident.UnknownMods) != 0 {
+		t.Errorf("Unexpected identification %+v", ident)
+	}
+	// Acetyl + Oxidation + fixed carbamidomethyl
+	if math.Abs(ident.ModMass-(42.010565+15.994915+57.021464)) > 1e-6 {
+		t.Errorf("ModMass is %f", ident.ModMass)
+	}
+	if math.Abs(ident.CalculatedMz-500.100) > 1e-3 {
+		t.Errorf("CalculatedMz is %f, expected 500.100", ident.CalculatedMz)
+	}
+	if len(ident.Cv) != 2 || ident.Cv[0].Accession != "MS:1001493" || ident.Cv[0].Value != "0.0012" {
+		t.Errorf("Unexpected scores %+v", ident.Cv)
+	}
+	if as := r.AnalysisSoftware(); len(as) != 1 || as[0].Name != "MaxQuant" {
+		t.Errorf("AnalysisSoftware: got %+v, expected MaxQuant", as)
+	}
+
+	// Row of "other" raw file is skipped
+	ident, err = r.Next()
+	if err != nil {
+		t.Fatalf("Next: error return %v", err)
+	}
+	if ident.PepSeq != "EDITPEP" || !ident.Decoy || ident.Charge != 3 ||
+		math.Abs(ident.ModMass-15.994915) > 1e-6 {
+		t.Errorf("Unexpected identification %+v", ident)
+	}
+
+	// Row without retention time is skipped
+	_, err = r.Next()
+	if err != io.EOF {
+		t.Errorf("Expected io.EOF, got %v", err)
+	}
+
+	// A raw file that is not in the table
+	r = NewReader(strings.NewReader(testMsms))
+	r.RawFile = "human"
+	_, err = r.Next()
+	if err == nil || !strings.HasPrefix(err.Error(), ErrRawFileNotFound.Error()) ||
+		!strings.Contains(err.Error(), "other, yeast") {
+		t.Errorf("Expected ErrRawFileNotFound listing other, yeast, got %v", err)
+	}
+}
+
+func TestLookupMod(t *testing.T) {
+	for _, mod := range []string{"Deamidation (NQ)", "Deamidated (NQ)", "de"} {
+		if m, ok := lookupMod(mod); !ok || math.Abs(m-0.984016) > 1e-6 {
+			t.Errorf("lookupMod(%s): got %f (%v), expected 0.984016", mod, m, ok)
+		}
+	}
+}
+
+func TestMissingColumn(t *testing.T) {
+	r := NewReader(strings.NewReader("Raw file\tSequence\n"))
+	_, err := r.Next()
+	if err == nil || err == io.EOF {
+		t.Errorf("Expected missing column error, got %v", err)
+	}
+}
+
+func TestParseFixedMods(t *testing.T) {
+	fixedMods, err := ParseFixedMods("Carbamidomethyl:C; 28.0313:KN")
+	if err != nil || len(fixedMods) != 3 || math.Abs(fixedMods['C']-57.021464) > 1e-6 ||
+		fixedMods['K'] != 28.0313 || fixedMods['N'] != 28.0313 {
+		t.Errorf("ParseFixedMods: got %v (%v)", fixedMods, err)
+	}
+	for _, bad := range []string{"Carbamidomethyl", "Unknownmod:C", "57.02:"} {
+		if _, err = ParseFixedMods(bad); err == nil {
+			t.Errorf("ParseFixedMods(%s): expected error", bad)
+		}
+	}
+}
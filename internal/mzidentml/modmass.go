@@ -0,0 +1,253 @@
+package mzidentml
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Monoisotopic mass shifts of common modifications, used when the
+// mzIdentML file doesn't specify monoisotopicMassDelta.
+// Keys are UNIMOD or PSI-MOD accessions.
+type modEntry struct {
+	name string
+	mass float64
+}
+
+var modMassTable = map[string]modEntry{
+	// UNIMOD
+	`UNIMOD:1`:    {`Acetyl`, 42.010565},
+	`UNIMOD:2`:    {`Amidated`, -0.984016},
+	`UNIMOD:3`:    {`Biotin`, 226.077598},
+	`UNIMOD:4`:    {`Carbamidomethyl`, 57.021464},
+	`UNIMOD:5`:    {`Carbamyl`, 43.005814},
+	`UNIMOD:6`:    {`Carboxymethyl`, 58.005479},
+	`UNIMOD:7`:    {`Deamidated`, 0.984016},
+	`UNIMOD:17`:   {`NIPCAM`, 99.068414},
+	`UNIMOD:21`:   {`Phospho`, 79.966331},
+	`UNIMOD:23`:   {`Dehydrated`, -18.010565},
+	`UNIMOD:24`:   {`Propionamide`, 71.037114},
+	`UNIMOD:26`:   {`Pyro-carbamidomethyl`, 39.994915},
+	`UNIMOD:27`:   {`Glu->pyro-Glu`, -18.010565},
+	`UNIMOD:28`:   {`Gln->pyro-Glu`, -17.026549},
+	`UNIMOD:34`:   {`Methyl`, 14.015650},
+	`UNIMOD:35`:   {`Oxidation`, 15.994915},
+	`UNIMOD:36`:   {`Dimethyl`, 28.031300},
+	`UNIMOD:37`:   {`Trimethyl`, 42.046950},
+	`UNIMOD:39`:   {`Methylthio`, 45.987721},
+	`UNIMOD:40`:   {`Sulfo`, 79.956815},
+	`UNIMOD:41`:   {`Hex`, 162.052824},
+	`UNIMOD:43`:   {`HexNAc`, 203.079373},
+	`UNIMOD:47`:   {`Palmitoyl`, 238.229666},
+	`UNIMOD:58`:   {`Propionyl`, 56.026215},
+	`UNIMOD:64`:   {`Succinyl`, 100.016044},
+	`UNIMOD:108`:  {`Nethylmaleimide`, 125.047679},
+	`UNIMOD:121`:  {`GG`, 114.042927},
+	`UNIMOD:122`:  {`Formyl`, 27.994915},
+	`UNIMOD:188`:  {`Label:13C(6)`, 6.020129},
+	`UNIMOD:199`:  {`Dimethyl:2H(4)`, 32.056407},
+	`UNIMOD:214`:  {`iTRAQ4plex`, 144.102063},
+	`UNIMOD:259`:  {`Label:13C(6)15N(2)`, 8.014199},
+	`UNIMOD:267`:  {`Label:13C(6)15N(4)`, 10.008269},
+	`UNIMOD:275`:  {`Nitrosyl`, 28.990164},
+	`UNIMOD:312`:  {`Cysteinyl`, 119.004099},
+	`UNIMOD:345`:  {`Trioxidation`, 47.984744},
+	`UNIMOD:354`:  {`Nitro`, 44.985078},
+	`UNIMOD:385`:  {`Ammonia-loss`, -17.026549},
+	`UNIMOD:425`:  {`Dioxidation`, 31.989829},
+	`UNIMOD:481`:  {`Label:2H(4)`, 4.025107},
+	`UNIMOD:510`:  {`Dimethyl:2H(4)13C(2)`, 34.063117},
+	`UNIMOD:530`:  {`Cation:Na`, 21.981943},
+	`UNIMOD:730`:  {`iTRAQ8plex`, 304.205360},
+	`UNIMOD:737`:  {`TMT6plex`, 229.162932},
+	`UNIMOD:738`:  {`TMT2plex`, 225.155833},
+	`UNIMOD:739`:  {`TMT`, 224.152478},
+	`UNIMOD:747`:  {`Malonyl`, 86.000394},
+	`UNIMOD:1289`: {`Butyryl`, 70.041865},
+	`UNIMOD:1363`: {`Crotonyl`, 68.026215},
+	`UNIMOD:2016`: {`TMTpro`, 304.207146},
+
+	// PSI-MOD
+	`MOD:00040`: {`2-pyrrolidone-5-carboxylic acid (Gln)`, -17.026549},
+	`MOD:00046`: {`O-phospho-L-serine`, 79.966331},
+	`MOD:00047`: {`O-phospho-L-threonine`, 79.966331},
+	`MOD:00048`: {`O4'-phospho-L-tyrosine`, 79.966331},
+	`MOD:00394`: {`acetylated residue`, 42.010565},
+	`MOD:00397`: {`iodoacetamide derivatized residue`, 57.021464},
+	`MOD:00400`: {`deamidated residue`, 0.984016},
+	`MOD:00420`: {`2-pyrrolidone-5-carboxylic acid (Glu)`, -18.010565},
+	`MOD:00425`: {`monohydroxylated residue`, 15.994915},
+	`MOD:00429`: {`dimethylated residue`, 28.031300},
+	`MOD:00430`: {`trimethylated residue`, 42.046950},
+	`MOD:00599`: {`monomethylated residue`, 14.015650},
+	`MOD:00696`: {`phosphorylated residue`, 79.966331},
+	`MOD:00719`: {`L-methionine sulfoxide`, 15.994915},
+	`MOD:01060`: {`S-carboxamidomethyl-L-cysteine`, 57.021464},
+}
+
+// modName2Accession maps (lower case) modification names to accessions,
+// for files that specify a name but no (known) accession
+var modName2Accession = func() map[string]string {
+	m := make(map[string]string, len(modMassTable))
+	for acc, e := range modMassTable {
+		name := strings.ToLower(e.name)
+		// Prefer UNIMOD if a name occurs in both vocabularies
+		if prev, ok := m[name]; !ok || !strings.HasPrefix(prev, `UNIMOD:`) {
+			m[name] = acc
+		}
+	}
+	return m
+}()
+
+// LookupModMass returns the monoisotopic mass shift of a modification,
+// given its UNIMOD/PSI-MOD accession or its name.
+func LookupModMass(accession string, name string) (float64, bool) {
+	if e, ok := modMassTable[strings.ToUpper(accession)]; ok {
+		return e.mass, true
+	}
+	if acc, ok := modName2Accession[strings.ToLower(name)]; ok {
+		return modMassTable[acc].mass, true
+	}
+	return 0.0, false
+}
+
+// ParseModSeq parses a modified peptide sequence with modifications
+// in parentheses or square brackets after the modified residue, e.g.
+// "(Acetyl)PEM(Oxidation (M))TIDE" or "PEM[UniMod:35]TIDE", into the
+// plain sequence and the total mass shift of the modifications. Dots, as
+// used for the termini by OpenMS, are skipped. lookup returns the mass
+// shift of a modification, given the text between the brackets.
+// Modifications with unknown mass are returned separately.
+func ParseModSeq(modSeq string, lookup func(mod string) (float64, bool)) (seq string, modMass float64, unknown []string) {
+	var sb strings.Builder
+	for i := 0; i < len(modSeq); i++ {
+		openBr := modSeq[i]
+		if openBr == '.' {
+			continue
+		}
+		if openBr != '(' && openBr != '[' {
+			sb.WriteByte(openBr)
+			continue
+		}
+		closeBr := byte(')')
+		if openBr == '[' {
+			closeBr = ']'
+		}
+		// Find the matching closing bracket
+		depth := 0
+		j := i
+		for ; j < len(modSeq); j++ {
+			if modSeq[j] == openBr {
+				depth++
+			} else if modSeq[j] == closeBr {
+				depth--
+				if depth == 0 {
+					break
+				}
+			}
+		}
+		mod := modSeq[i+1 : min(j, len(modSeq))]
+		i = j
+		if m, ok := lookup(mod); ok {
+			modMass += m
+		} else {
+			unknown = append(unknown, mod)
+		}
+	}
+	return sb.String(), modMass, unknown
+}
+
+// massDelta returns the mass shift of the modification, from the
+// monoisotopicMassDelta attribute or else from the cvParam's
+func (mod *modification) massDelta() (float64, bool) {
+	if mod.MonoisotopicMassDelta != nil {
+		return *mod.MonoisotopicMassDelta, true
+	}
+	for _, cv := range mod.CvPar {
+		if m, ok := LookupModMass(cv.Accession, cv.Name); ok {
+			return m, true
+		}
+		// MS:1001460 (unknown modification) may carry the mass as value
+		if cv.Accession == `MS:1001460` && cv.Value != `` {
+			if m, err := strconv.ParseFloat(cv.Value, 64); err == nil {
+				return m, true
+			}
+		}
+	}
+	return 0.0, false
+}
+
+// description returns a human readable description of the modification
+func (mod *modification) description() string {
+	d := ``
+	for _, cv := range mod.CvPar {
+		if cv.Accession != `` || cv.Name != `` {
+			d = cv.Accession + ` (` + cv.Name + `)`
+			break
+		}
+	}
+	if d == `` {
+		d = `modification`
+	}
+	if mod.Residues != `` || mod.Location != `` {
+		d += ` at ` + mod.Residues + mod.Location
+	}
+	return d
+}
+
+// Label returns the isotope composition of a search modification that
+// is an isotope label, e.g. "13C(6)15N(2)" for UNIMOD:259
+// (Label:13C(6)15N(2)), or an empty string for other modifications.
+func (sm *SearchModification) Label() string {
+	for _, cv := range sm.CvPar {
+		name := cv.Name
+		if e, ok := modMassTable[strings.ToUpper(cv.Accession)]; ok && name == `` {
+			name = e.name
+		}
+		if strings.HasPrefix(name, `Label:`) {
+			return strings.TrimPrefix(name, `Label:`)
+		}
+	}
+	return ``
+}
+
+// Terminal returns true if the search modification is restricted to
+// the peptide or protein N- or C-terminus
+func (sm *SearchModification) Terminal() bool {
+	for _, cv := range sm.SpecificityRules {
+		switch cv.Accession {
+		case `MS:1001189`, // modification specificity peptide N-term
+			`MS:1001190`, // modification specificity peptide C-term
+			`MS:1002057`, // modification specificity protein N-term
+			`MS:1002058`: // modification specificity protein C-term
+			return true
+		}
+	}
+	return false
+}
+
+// fixedLabel returns true if the modification of peptide sequence
+// pepSeq is one of the fixed isotope labels of residues in searchMods.
+// Terminal labels are not labels of residues; their mass is included
+// in ModMass like that of other modifications.
+func fixedLabel(searchMods []SearchModification, mod *modification, pepSeq string) bool {
+	residue := mod.Residues
+	if loc, err := strconv.Atoi(mod.Location); err == nil && loc >= 1 && loc <= len(pepSeq) {
+		residue = pepSeq[loc-1 : loc]
+	}
+	for i := range searchMods {
+		sm := &searchMods[i]
+		if !sm.FixedMod || sm.Label() == `` || sm.Terminal() ||
+			(sm.Residues != `.` && (residue == `` || !strings.Contains(sm.Residues, residue))) {
+			continue
+		}
+		for _, cv := range mod.CvPar {
+			for _, smCv := range sm.CvPar {
+				if (cv.Accession != `` && cv.Accession == smCv.Accession) ||
+					(cv.Name != `` && cv.Name == smCv.Name) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
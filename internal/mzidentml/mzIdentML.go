@@ -10,9 +10,12 @@ import (
 // MzIdentML holds only the part of mzIdentML files
 // in which we are interrested
 type MzIdentML struct {
-	seqID2PepIdx map[string]int
-	identList    []identRef
-	content      mzIdentMLContent
+	seqID2PepIdx      map[string]int
+	pepEvID2Idx       map[string]int
+	dbSeqID2Accession map[string]string
+	spectraDataIdx    map[string]int
+	identList         []identRef
+	content           mzIdentMLContent
 }
 
 type identRef struct {
@@ -22,18 +25,46 @@ type identRef struct {
 }
 
 type Identification struct {
-	PepSeq        string
-	PepID         string
-	Charge        int
+	PepSeq string
+	PepID  string
+	Charge int
+	// ModMass is the total mass shift of the modifications. Fixed
+	// isotope labels (see SearchModification.Label) are not included,
+	// these are applied to the residue masses by the caller.
 	ModMass       float64
 	SpecID        string
 	RetentionTime float64
-	Cv            []cvParam
+	// CalculatedMz and ExperimentalMz are the theoretical and measured m/z
+	// as reported by the search engine, or 0 if not present in the file
+	CalculatedMz   float64
+	ExperimentalMz float64
+	// UnknownMods lists the modifications for which no mass could be
+	// determined. If not empty, ModMass should not be used.
+	UnknownMods []string
+	Rank        int
+	// PassThreshold is true if the search engine reports that the
+	// identification passes its threshold (or doesn't report it at all)
+	PassThreshold bool
+	// Decoy is true if all peptide evidence refers to decoy proteins
+	Decoy    bool
+	Proteins []string // Accessions of the proteins containing the peptide
+	// SpectraData is the location of the file with the identified
+	// spectrum, empty if unknown
+	SpectraData string
+	// Adduct is the ion form (e.g. [M+Na]1+) of identified small
+	// molecules, empty for peptides
+	Adduct string
+	Cv     []CVParam
 }
 
 type mzIdentMLContent struct {
 	XMLName                      xml.Name                       `xml:"MzIdentML"`
+	AnalysisSoftware             []AnalysisSoftware             `xml:"AnalysisSoftwareList>AnalysisSoftware"`
+	DBSequence                   []dbSequence                   `xml:"SequenceCollection>DBSequence"`
 	Peptide                      []peptide                      `xml:"SequenceCollection>Peptide"`
+	PeptideEvidence              []peptideEvidence              `xml:"SequenceCollection>PeptideEvidence"`
+	SearchModification           []SearchModification           `xml:"AnalysisProtocolCollection>SpectrumIdentificationProtocol>ModificationParams>SearchModification"`
+	SpectraData                  []SpectraData                  `xml:"DataCollection>Inputs>SpectraData"`
 	SpectrumIdentificationResult []spectrumIdentificationResult `xml:"DataCollection>AnalysisData>SpectrumIdentificationList>SpectrumIdentificationResult"`
 }
 
@@ -43,26 +74,82 @@ type peptide struct {
 	Modification    []modification
 }
 
+type dbSequence struct {
+	ID        string `xml:"id,attr"`
+	Accession string `xml:"accession,attr"`
+}
+
+type peptideEvidence struct {
+	ID            string `xml:"id,attr"`
+	PeptideRef    string `xml:"peptide_ref,attr"`
+	DBSequenceRef string `xml:"dBSequence_ref,attr"`
+	IsDecoy       bool   `xml:"isDecoy,attr"`
+}
+
 type modification struct {
-	// Note: monoisotopicMassDelta is optional according the the schema, but
-	// appears to be no other way to determine mass shift, as other
-	// corresponding cvParam's don't carry this info either
-	MonoisotopicMassDelta float64 `xml:"monoisotopicMassDelta,attr"`
+	// Note: monoisotopicMassDelta is optional according the the schema.
+	// If it is absent, the mass shift is looked up from the
+	// UNIMOD/PSI-MOD accession in the cvParam's
+	MonoisotopicMassDelta *float64  `xml:"monoisotopicMassDelta,attr"`
+	Location              string    `xml:"location,attr"`
+	Residues              string    `xml:"residues,attr"`
+	CvPar                 []CVParam `xml:"cvParam"`
+}
+
+// AnalysisSoftware describes software that produced the file, e.g.
+// the search engine
+type AnalysisSoftware struct {
+	ID      string `xml:"id,attr"`
+	Name    string `xml:"name,attr"`
+	Version string `xml:"version,attr"`
+	// SoftwareName contains the CV term of the software name.
+	// Software without CV term is named by a userParam (UserName).
+	SoftwareName []CVParam `xml:"SoftwareName>cvParam"`
+	UserName     []CVParam `xml:"SoftwareName>userParam"`
+}
+
+// SearchModification is a modification that was searched for
+type SearchModification struct {
+	FixedMod  bool      `xml:"fixedMod,attr"`
+	MassDelta float64   `xml:"massDelta,attr"`
+	Residues  string    `xml:"residues,attr"` // "." for any residue
+	CvPar     []CVParam `xml:"cvParam"`
+	// SpecificityRules restricts the modification to the peptide or
+	// protein terminus
+	SpecificityRules []CVParam `xml:"SpecificityRules>cvParam"`
+}
+
+// SpectraData describes a file with spectra that were searched
+type SpectraData struct {
+	ID       string `xml:"id,attr"`
+	Location string `xml:"location,attr"`
+	Name     string `xml:"name,attr"`
 }
 
 type spectrumIdentificationResult struct {
 	SpectrumID                 string `xml:"spectrumID,attr"`
+	SpectraDataRef             string `xml:"spectraData_ref,attr"`
 	SpectrumIdentificationItem []spectrumIdentificationItem
-	CvPar                      []cvParam `xml:"cvParam"`
+	CvPar                      []CVParam `xml:"cvParam"`
 }
 
 type spectrumIdentificationItem struct {
-	ChargeState int       `xml:"chargeState,attr"`
-	PeptideRef  string    `xml:"peptide_ref,attr"`
-	CvPar       []cvParam `xml:"cvParam"`
+	ChargeState              int                  `xml:"chargeState,attr"`
+	PeptideRef               string               `xml:"peptide_ref,attr"`
+	CalculatedMassToCharge   float64              `xml:"calculatedMassToCharge,attr"`
+	ExperimentalMassToCharge float64              `xml:"experimentalMassToCharge,attr"`
+	Rank                     int                  `xml:"rank,attr"`
+	PassThreshold            *bool                `xml:"passThreshold,attr"`
+	PeptideEvidenceRef       []peptideEvidenceRef `xml:"PeptideEvidenceRef"`
+	CvPar                    []CVParam            `xml:"cvParam"`
+}
+
+type peptideEvidenceRef struct {
+	PeptideEvidenceRef string `xml:"peptideEvidence_ref,attr"`
 }
 
-type cvParam struct {
+// CVParam contains values and attributes of a mzIdentML Controlled Vocabulary term
+type CVParam struct {
 	Accession     string `xml:"accession,attr"`
 	Name          string `xml:"name,attr"`
 	Value         string `xml:"value,attr"`
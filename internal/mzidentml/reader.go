@@ -19,6 +19,8 @@ func Read(reader io.Reader) (MzIdentML, error) {
 		return mzIdentML, err
 	}
 	mzIdentML.buildPepID2Sequence()
+	mzIdentML.buildPepEvidenceIndex()
+	mzIdentML.buildSpectraDataIndex()
 	mzIdentML.buildIdentList()
 	return mzIdentML, err
 }
@@ -30,6 +32,24 @@ func (m *MzIdentML) buildPepID2Sequence() {
 	}
 }
 
+func (m *MzIdentML) buildPepEvidenceIndex() {
+	m.pepEvID2Idx = make(map[string]int, len(m.content.PeptideEvidence))
+	for i, pe := range m.content.PeptideEvidence {
+		m.pepEvID2Idx[pe.ID] = i
+	}
+	m.dbSeqID2Accession = make(map[string]string, len(m.content.DBSequence))
+	for _, dbs := range m.content.DBSequence {
+		m.dbSeqID2Accession[dbs.ID] = dbs.Accession
+	}
+}
+
+func (m *MzIdentML) buildSpectraDataIndex() {
+	m.spectraDataIdx = make(map[string]int, len(m.content.SpectraData))
+	for i, sd := range m.content.SpectraData {
+		m.spectraDataIdx[sd.ID] = i
+	}
+}
+
 func (m *MzIdentML) buildIdentList() {
 	for i := range m.content.SpectrumIdentificationResult {
 		for j := range m.content.SpectrumIdentificationResult[i].SpectrumIdentificationItem {
@@ -62,19 +82,124 @@ func (m *MzIdentML) Ident(i int) (Identification, error) {
 	specIDIdx := m.identList[i].specIDIdx
 	specResultIdx := m.identList[i].specResultIdx
 
-	pepRef := m.content.SpectrumIdentificationResult[specIDIdx].SpectrumIdentificationItem[specResultIdx].PeptideRef
-	pepIdx := m.seqID2PepIdx[pepRef]
-	ident.PepSeq = m.content.Peptide[pepIdx].PeptideSequence
-	ident.PepID = m.content.Peptide[pepIdx].ID
+	res := &m.content.SpectrumIdentificationResult[specIDIdx]
+	return buildIdentification(m, res, &res.SpectrumIdentificationItem[specResultIdx])
+}
+
+// SpectraData returns the spectra files that were searched
+func (m *MzIdentML) SpectraData() []SpectraData {
+	return m.content.SpectraData
+}
+
+// AnalysisSoftware returns the software that produced the file
+func (m *MzIdentML) AnalysisSoftware() []AnalysisSoftware {
+	return m.content.AnalysisSoftware
+}
+
+// SearchModifications returns the modifications that were searched for
+func (m *MzIdentML) SearchModifications() []SearchModification {
+	return m.content.SearchModification
+}
+
+// seqLookup gives access to the SequenceCollection and Inputs parts of
+// the mzIdentML file, which are needed to build an Identification
+type seqLookup interface {
+	peptide(id string) (*peptide, bool)
+	peptideEvidence(id string) (*peptideEvidence, bool)
+	dbSeqAccession(id string) (string, bool)
+	spectraData(id string) (*SpectraData, bool)
+	searchModifications() []SearchModification
+}
+
+func (m *MzIdentML) peptide(id string) (*peptide, bool) {
+	i, ok := m.seqID2PepIdx[id]
+	if !ok {
+		return nil, false
+	}
+	return &m.content.Peptide[i], true
+}
+
+func (m *MzIdentML) peptideEvidence(id string) (*peptideEvidence, bool) {
+	i, ok := m.pepEvID2Idx[id]
+	if !ok {
+		return nil, false
+	}
+	return &m.content.PeptideEvidence[i], true
+}
+
+func (m *MzIdentML) dbSeqAccession(id string) (string, bool) {
+	acc, ok := m.dbSeqID2Accession[id]
+	return acc, ok
+}
+
+func (m *MzIdentML) searchModifications() []SearchModification {
+	return m.content.SearchModification
+}
+
+func (m *MzIdentML) spectraData(id string) (*SpectraData, bool) {
+	i, ok := m.spectraDataIdx[id]
+	if !ok {
+		return nil, false
+	}
+	return &m.content.SpectraData[i], true
+}
+
+// buildIdentification combines the info of a SpectrumIdentificationItem,
+// its SpectrumIdentificationResult and the referenced peptide into
+// an Identification
+func buildIdentification(l seqLookup, res *spectrumIdentificationResult,
+	item *spectrumIdentificationItem) (Identification, error) {
+
+	var ident Identification
+
+	pep, ok := l.peptide(item.PeptideRef)
+	if !ok {
+		pep = &peptide{}
+	}
+	ident.PepSeq = pep.PeptideSequence
+	ident.PepID = pep.ID
 	ident.ModMass = float64(0)
-	ident.Charge = m.content.SpectrumIdentificationResult[specIDIdx].SpectrumIdentificationItem[specResultIdx].ChargeState
-	for _, mod := range m.content.Peptide[pepIdx].Modification {
-		ident.ModMass += mod.MonoisotopicMassDelta
+	ident.Charge = item.ChargeState
+	ident.CalculatedMz = item.CalculatedMassToCharge
+	ident.ExperimentalMz = item.ExperimentalMassToCharge
+	for _, mod := range pep.Modification {
+		// Fixed labels are applied to the residues by the caller
+		if fixedLabel(l.searchModifications(), &mod, pep.PeptideSequence) {
+			continue
+		}
+		modMass, ok := mod.massDelta()
+		if !ok {
+			ident.UnknownMods = append(ident.UnknownMods, mod.description())
+		}
+		ident.ModMass += modMass
+	}
+	ident.SpecID = res.SpectrumID
+	if sd, ok := l.spectraData(res.SpectraDataRef); ok {
+		ident.SpectraData = sd.Location
+		if ident.SpectraData == `` {
+			ident.SpectraData = sd.Name
+		}
+	}
+	ident.Rank = item.Rank
+	ident.PassThreshold = item.PassThreshold == nil || *item.PassThreshold
+	// The identification is a decoy only if all evidence is decoy
+	nrDecoy := 0
+	for _, ref := range item.PeptideEvidenceRef {
+		pe, ok := l.peptideEvidence(ref.PeptideEvidenceRef)
+		if !ok {
+			continue
+		}
+		if acc, ok := l.dbSeqAccession(pe.DBSequenceRef); ok {
+			ident.Proteins = append(ident.Proteins, acc)
+		}
+		if pe.IsDecoy {
+			nrDecoy++
+		}
 	}
-	ident.SpecID = m.content.SpectrumIdentificationResult[specIDIdx].SpectrumID
+	ident.Decoy = nrDecoy > 0 && nrDecoy == len(item.PeptideEvidenceRef)
 	ident.RetentionTime = float64(-1)
 	prio := math.MaxInt32
-	for _, cv := range m.content.SpectrumIdentificationResult[specIDIdx].CvPar {
+	for _, cv := range res.CvPar {
 		// There are multiple CV terms that can be used to report the
 		// retention time. In order of decreasing preference we use:
 		// 1. MS:1000016 - scan start time
@@ -118,7 +243,7 @@ func (m *MzIdentML) Ident(i int) (Identification, error) {
 		}
 	}
 	// Collect CV terms/values for the identification, the scores are in there
-	for _, cv := range m.content.SpectrumIdentificationResult[specIDIdx].SpectrumIdentificationItem[specResultIdx].CvPar {
+	for _, cv := range item.CvPar {
 		ident.Cv = append(ident.Cv, cv)
 	}
 
@@ -1,8 +1,12 @@
 package mzidentml
 
 import (
+	"io"
 	"log"
+	"math"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -59,3 +63,178 @@ func TestAll2(t *testing.T) {
 	log.Printf("ident: %+v", ident)
 
 }
+
+// Minimal mzIdentML document for tests that don't need external files
+const testDoc = `<?xml version="1.0" encoding="UTF-8"?>
+<MzIdentML id="test" version="1.1.0" xmlns="http://psidev.info/psi/pi/mzIdentML/1.1">
+<AnalysisSoftwareList>
+  <AnalysisSoftware id="AS_1" name="Comet" version="2019.01 rev. 5">
+    <SoftwareName><cvParam cvRef="PSI-MS" accession="MS:1002251" name="Comet"/></SoftwareName>
+  </AnalysisSoftware>
+</AnalysisSoftwareList>
+<SequenceCollection>
+  <DBSequence id="DBSeq_1" accession="PROT1" searchDatabase_ref="SDB_1"/>
+  <DBSequence id="DBSeq_2" accession="DECOY_PROT2" searchDatabase_ref="SDB_1"/>
+  <Peptide id="PEP_1">
+    <PeptideSequence>PEPTMIDE</PeptideSequence>
+    <Modification location="5" residues="M">
+      <cvParam cvRef="UNIMOD" accession="UNIMOD:35" name="Oxidation"/>
+    </Modification>
+  </Peptide>
+  <Peptide id="PEP_2">
+    <PeptideSequence>PEPTCIDE</PeptideSequence>
+    <Modification location="5" residues="C" monoisotopicMassDelta="57.021464">
+      <cvParam cvRef="UNIMOD" accession="UNIMOD:4" name="Carbamidomethyl"/>
+    </Modification>
+  </Peptide>
+  <Peptide id="PEP_3">
+    <PeptideSequence>PEPTKIDE</PeptideSequence>
+    <Modification location="5" residues="K">
+      <cvParam cvRef="PSI-MS" accession="MS:1001460" name="unknown modification"/>
+    </Modification>
+    <Modification location="5" residues="K" monoisotopicMassDelta="6.020129">
+      <cvParam cvRef="UNIMOD" accession="UNIMOD:188" name="Label:13C(6)"/>
+    </Modification>
+  </Peptide>
+  <PeptideEvidence id="PE_1" peptide_ref="PEP_1" dBSequence_ref="DBSeq_1" isDecoy="false"/>
+  <PeptideEvidence id="PE_2" peptide_ref="PEP_2" dBSequence_ref="DBSeq_2" isDecoy="true"/>
+  <PeptideEvidence id="PE_3" peptide_ref="PEP_3" dBSequence_ref="DBSeq_1" isDecoy="false"/>
+  <PeptideEvidence id="PE_4" peptide_ref="PEP_3" dBSequence_ref="DBSeq_2" isDecoy="true"/>
+</SequenceCollection>
+<AnalysisProtocolCollection>
+<SpectrumIdentificationProtocol id="SIP_1" analysisSoftware_ref="AS_1">
+  <ModificationParams>
+    <SearchModification fixedMod="true" massDelta="6.020129" residues="K">
+      <cvParam cvRef="UNIMOD" accession="UNIMOD:188" name="Label:13C(6)"/>
+    </SearchModification>
+    <SearchModification fixedMod="false" massDelta="15.994915" residues="M">
+      <cvParam cvRef="UNIMOD" accession="UNIMOD:35" name="Oxidation"/>
+    </SearchModification>
+  </ModificationParams>
+</SpectrumIdentificationProtocol>
+</AnalysisProtocolCollection>
+<DataCollection>
+<Inputs>
+  <SpectraData id="SD_1" location="file:///data/run1.mzML" name="run1"/>
+</Inputs>
+<AnalysisData>
+<SpectrumIdentificationList id="SIL_1">
+  <SpectrumIdentificationResult id="SIR_1" spectrumID="index=5" spectraData_ref="SD_1">
+    <SpectrumIdentificationItem id="SII_1_1" chargeState="2" experimentalMassToCharge="470.7063" calculatedMassToCharge="470.7060" peptide_ref="PEP_1" rank="1" passThreshold="true">
+      <PeptideEvidenceRef peptideEvidence_ref="PE_1"/>
+      <cvParam cvRef="PSI-MS" accession="MS:1002257" name="Comet:expectation value" value="1.0E-5"/>
+    </SpectrumIdentificationItem>
+  </SpectrumIdentificationResult>
+  <SpectrumIdentificationResult id="SIR_2" spectrumID="index=8" spectraData_ref="SD_1">
+    <SpectrumIdentificationItem id="SII_2_1" chargeState="2" experimentalMassToCharge="485.2" calculatedMassToCharge="485.2" peptide_ref="PEP_2" rank="1" passThreshold="true">
+      <PeptideEvidenceRef peptideEvidence_ref="PE_2"/>
+      <cvParam cvRef="PSI-MS" accession="MS:1002257" name="Comet:expectation value" value="0.5"/>
+    </SpectrumIdentificationItem>
+    <SpectrumIdentificationItem id="SII_2_2" chargeState="2" experimentalMassToCharge="485.2" calculatedMassToCharge="485.3" peptide_ref="PEP_3" rank="2" passThreshold="false">
+      <PeptideEvidenceRef peptideEvidence_ref="PE_3"/>
+      <PeptideEvidenceRef peptideEvidence_ref="PE_4"/>
+      <cvParam cvRef="PSI-MS" accession="MS:1002257" name="Comet:expectation value" value="2.0"/>
+    </SpectrumIdentificationItem>
+    <cvParam cvRef="PSI-MS" accession="MS:1000016" name="scan start time" value="2.5" unitAccession="UO:0000031"/>
+  </SpectrumIdentificationResult>
+</SpectrumIdentificationList>
+</AnalysisData>
+</DataCollection>
+</MzIdentML>
+`
+
+// The fixed 13C(6) label of PEP_3 is not included in ModMass
+func TestModifications(t *testing.T) {
+	f, err := Read(strings.NewReader(testDoc))
+	if err != nil {
+		t.Fatalf("Read: error return %v", err)
+	}
+	if f.NumIdents() != 3 {
+		t.Fatalf("NumIdents is %d, expected 3", f.NumIdents())
+	}
+	expected := []struct {
+		modMass float64
+		unknown int
+	}{{15.994915, 0}, {57.021464, 0}, {0, 1}}
+	for i, e := range expected {
+		ident, err := f.Ident(i)
+		if err != nil {
+			t.Fatalf("Ident: error return %v", err)
+		}
+		if math.Abs(ident.ModMass-e.modMass) > 1e-6 {
+			t.Errorf("Ident %d: ModMass is %f, expected %f", i, ident.ModMass, e.modMass)
+		}
+		if len(ident.UnknownMods) != e.unknown {
+			t.Errorf("Ident %d: %d unknown modifications, expected %d",
+				i, len(ident.UnknownMods), e.unknown)
+		}
+	}
+}
+
+func TestRankDecoy(t *testing.T) {
+	f, err := Read(strings.NewReader(testDoc))
+	if err != nil {
+		t.Fatalf("Read: error return %v", err)
+	}
+	expected := []struct {
+		rank          int
+		passThreshold bool
+		decoy         bool
+		nrProteins    int
+	}{{1, true, false, 1}, {1, true, true, 1}, {2, false, false, 2}}
+	for i, e := range expected {
+		ident, err := f.Ident(i)
+		if err != nil {
+			t.Fatalf("Ident: error return %v", err)
+		}
+		if ident.Rank != e.rank || ident.PassThreshold != e.passThreshold ||
+			ident.Decoy != e.decoy || len(ident.Proteins) != e.nrProteins ||
+			ident.SpectraData != "file:///data/run1.mzML" {
+			t.Errorf("Ident %d: got rank %d passThreshold %v decoy %v proteins %v spectra %s, expected %+v",
+				i, ident.Rank, ident.PassThreshold, ident.Decoy, ident.Proteins, ident.SpectraData, e)
+		}
+	}
+}
+
+func TestStreamReader(t *testing.T) {
+	f, err := Read(strings.NewReader(testDoc))
+	if err != nil {
+		t.Fatalf("Read: error return %v", err)
+	}
+	r := NewReader(strings.NewReader(testDoc))
+	n := 0
+	for {
+		ident, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next: error return %v", err)
+		}
+		expected, err := f.Ident(n)
+		if err != nil {
+			t.Fatalf("Ident: error return %v", err)
+		}
+		if !reflect.DeepEqual(ident, expected) {
+			t.Errorf("Ident %d: got %+v, expected %+v", n, ident, expected)
+		}
+		n++
+	}
+	if n != f.NumIdents() {
+		t.Errorf("Streamed %d identifications, expected %d", n, f.NumIdents())
+	}
+	if !reflect.DeepEqual(r.SpectraData(), f.SpectraData()) || len(f.SpectraData()) != 1 {
+		t.Errorf("SpectraData: got %+v, expected %+v", r.SpectraData(), f.SpectraData())
+	}
+	as := r.AnalysisSoftware()
+	if len(as) != 1 || as[0].Name != "Comet" || len(as[0].SoftwareName) != 1 ||
+		as[0].SoftwareName[0].Accession != "MS:1002251" ||
+		!reflect.DeepEqual(as, f.AnalysisSoftware()) {
+		t.Errorf("AnalysisSoftware: got %+v, expected %+v", as, f.AnalysisSoftware())
+	}
+	sm := r.SearchModifications()
+	if len(sm) != 2 || sm[0].Label() != "13C(6)" || sm[1].Label() != "" || !sm[0].FixedMod ||
+		!reflect.DeepEqual(sm, f.SearchModifications()) {
+		t.Errorf("SearchModifications: got %+v, expected %+v", sm, f.SearchModifications())
+	}
+}
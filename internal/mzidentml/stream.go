@@ -0,0 +1,170 @@
+package mzidentml
+
+import (
+	"encoding/xml"
+	"io"
+
+	"golang.org/x/net/html/charset"
+)
+
+// Reader reads identifications from an mzIdentML file one at a time.
+// Only the peptides, peptide evidence and protein accessions are kept in
+// memory, so memory use is proportional to the number of peptides
+// rather than to the size of the file.
+// The SequenceCollection and Inputs must precede the AnalysisData in
+// the file, as required by the mzIdentML schema.
+type Reader struct {
+	d                 *xml.Decoder
+	peptides          map[string]*peptide
+	pepEvidence       map[string]*peptideEvidence
+	dbSeqID2Accession map[string]string
+	spectraDataList   []SpectraData
+	software          []AnalysisSoftware
+	searchMods        []SearchModification
+	pending           []Identification // Identifications of the current result
+}
+
+// NewReader creates a Reader for streaming mzIdentML content from an io.Reader
+func NewReader(reader io.Reader) *Reader {
+	d := xml.NewDecoder(reader)
+	d.CharsetReader = charset.NewReaderLabel
+	return &Reader{
+		d:                 d,
+		peptides:          make(map[string]*peptide),
+		pepEvidence:       make(map[string]*peptideEvidence),
+		dbSeqID2Accession: make(map[string]string),
+	}
+}
+
+// Next returns the next identification in the file.
+// At the end of the file, io.EOF is returned.
+func (r *Reader) Next() (Identification, error) {
+	for len(r.pending) == 0 {
+		err := r.readResult()
+		if err != nil {
+			return Identification{}, err
+		}
+	}
+	ident := r.pending[0]
+	r.pending = r.pending[1:]
+	return ident, nil
+}
+
+// readResult reads tokens until the next SpectrumIdentificationResult
+// has been decoded, storing the sequence info that it encounters.
+func (r *Reader) readResult() error {
+	for {
+		t, err := r.d.Token()
+		if err != nil {
+			return err
+		}
+		se, ok := t.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch se.Name.Local {
+		case `DBSequence`:
+			var dbs dbSequence
+			err = r.d.DecodeElement(&dbs, &se)
+			if err != nil {
+				return err
+			}
+			r.dbSeqID2Accession[dbs.ID] = dbs.Accession
+		case `Peptide`:
+			var pep peptide
+			err = r.d.DecodeElement(&pep, &se)
+			if err != nil {
+				return err
+			}
+			r.peptides[pep.ID] = &pep
+		case `PeptideEvidence`:
+			var pe peptideEvidence
+			err = r.d.DecodeElement(&pe, &se)
+			if err != nil {
+				return err
+			}
+			r.pepEvidence[pe.ID] = &pe
+		case `AnalysisSoftware`:
+			var as AnalysisSoftware
+			err = r.d.DecodeElement(&as, &se)
+			if err != nil {
+				return err
+			}
+			r.software = append(r.software, as)
+		case `SearchModification`:
+			var sm SearchModification
+			err = r.d.DecodeElement(&sm, &se)
+			if err != nil {
+				return err
+			}
+			r.searchMods = append(r.searchMods, sm)
+		case `SpectraData`:
+			var sd SpectraData
+			err = r.d.DecodeElement(&sd, &se)
+			if err != nil {
+				return err
+			}
+			r.spectraDataList = append(r.spectraDataList, sd)
+		case `SpectrumIdentificationResult`:
+			var res spectrumIdentificationResult
+			err = r.d.DecodeElement(&res, &se)
+			if err != nil {
+				return err
+			}
+			for i := range res.SpectrumIdentificationItem {
+				ident, err := buildIdentification(r, &res, &res.SpectrumIdentificationItem[i])
+				if err != nil {
+					return err
+				}
+				r.pending = append(r.pending, ident)
+			}
+			return nil
+		}
+	}
+}
+
+// SpectraData returns the spectra files that were searched. These are
+// known after the first call of Next.
+func (r *Reader) SpectraData() []SpectraData {
+	return r.spectraDataList
+}
+
+// AnalysisSoftware returns the software that produced the file. It is
+// known after the first call of Next.
+func (r *Reader) AnalysisSoftware() []AnalysisSoftware {
+	return r.software
+}
+
+// SearchModifications returns the modifications that were searched
+// for. These are known after the first call of Next.
+func (r *Reader) SearchModifications() []SearchModification {
+	return r.searchMods
+}
+
+func (r *Reader) peptide(id string) (*peptide, bool) {
+	p, ok := r.peptides[id]
+	return p, ok
+}
+
+func (r *Reader) peptideEvidence(id string) (*peptideEvidence, bool) {
+	pe, ok := r.pepEvidence[id]
+	return pe, ok
+}
+
+func (r *Reader) dbSeqAccession(id string) (string, bool) {
+	acc, ok := r.dbSeqID2Accession[id]
+	return acc, ok
+}
+
+func (r *Reader) searchModifications() []SearchModification {
+	return r.searchMods
+}
+
+func (r *Reader) spectraData(id string) (*SpectraData, bool) {
+	for i := range r.spectraDataList {
+		if r.spectraDataList[i].ID == id {
+			return &r.spectraDataList[i], true
+		}
+	}
+	return nil, false
+}
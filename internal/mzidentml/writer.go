@@ -0,0 +1,238 @@
+package mzidentml
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"io"
+	"regexp"
+	"strconv"
+)
+
+// UpdateExpMz is called by Rewrite for each SpectrumIdentificationItem.
+// It receives the SpectraData (location, or name if there is no location,
+// as in Identification.SpectraData) and spectrumID of the
+// SpectrumIdentificationResult, and the experimentalMassToCharge of the
+// item, and returns the new experimentalMassToCharge. If ok is false, the
+// item is left unchanged.
+type UpdateExpMz func(spectraData string, spectrumID string, expMz float64) (newMz float64, ok bool)
+
+// CV term added to updated identifications with the (new) m/z error in ppm
+const cvDeltaMz = `MS:1001975`
+
+var reExpMz = regexp.MustCompile(`(\sexperimentalMassToCharge\s*=\s*)("[^"]*"|'[^']*')`)
+
+// byteRecorder passes bytes to the XML decoder, and keeps a copy of
+// them so that the original text can be written unmodified.
+// Because it implements io.ByteReader, the decoder doesn't read ahead
+// and the decoder's InputOffset corresponds to the recorded bytes.
+type byteRecorder struct {
+	r    *bufio.Reader
+	buf  []byte
+	base int64 // input offset of buf[0]
+}
+
+func (b *byteRecorder) ReadByte() (byte, error) {
+	c, err := b.r.ReadByte()
+	if err == nil {
+		b.buf = append(b.buf, c)
+	}
+	return c, err
+}
+
+func (b *byteRecorder) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	b.buf = append(b.buf, p[:n]...)
+	return n, err
+}
+
+// take returns the recorded bytes up to input offset off
+func (b *byteRecorder) take(off int64) []byte {
+	n := int(off - b.base)
+	raw := make([]byte, n)
+	copy(raw, b.buf[:n])
+	b.buf = append(b.buf[:0], b.buf[n:]...)
+	b.base = off
+	return raw
+}
+
+// Rewrite copies mzIdentML content from reader to writer, replacing the
+// experimentalMassToCharge of each SpectrumIdentificationItem by the value
+// returned by update. A cvParam with the m/z error (in ppm) relative to
+// calculatedMassToCharge is added to updated items, replacing any
+// existing one. It is inserted before the first cvParam or userParam
+// of the item itself, i.e. after Fragmentation, as required by the schema.
+// All other content is copied unmodified.
+func Rewrite(reader io.Reader, writer io.Writer, update UpdateExpMz) error {
+	rec := &byteRecorder{r: bufio.NewReader(reader)}
+	d := xml.NewDecoder(rec)
+	// Bytes are copied as-is, so no character set conversion is done
+	d.CharsetReader = func(label string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	w := bufio.NewWriter(writer)
+
+	spectraData := make(map[string]string) // SpectraData id to location
+	var spectrumID, resultSpectraData string
+	var pendingCv []byte // cvParam to insert in the current item
+	var itemPrefix string
+	inUpdatedItem := false
+	depth := 0        // depth of elements inside the updated item
+	skipping := false // skipping an existing delta m/z cvParam
+	skipped := false  // an existing delta m/z cvParam was just skipped
+	var indent []byte // whitespace preceding the current token
+
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		raw := rec.take(d.InputOffset())
+		// The whitespace after a skipped cvParam is skipped too
+		skipSpace := skipped
+		skipped = false
+
+		switch t := t.(type) {
+		case xml.StartElement:
+			nested := inUpdatedItem
+			switch t.Name.Local {
+			case `SpectraData`:
+				location := attrValue(t.Attr, `location`)
+				if location == `` {
+					location = attrValue(t.Attr, `name`)
+				}
+				spectraData[attrValue(t.Attr, `id`)] = location
+			case `SpectrumIdentificationResult`:
+				spectrumID = attrValue(t.Attr, `spectrumID`)
+				resultSpectraData = spectraData[attrValue(t.Attr, `spectraData_ref`)]
+			case `SpectrumIdentificationItem`:
+				raw, pendingCv, itemPrefix = updateItem(raw, t, resultSpectraData,
+					spectrumID, update)
+				inUpdatedItem = pendingCv != nil
+				depth = 0
+				if inUpdatedItem && bytes.HasSuffix(bytes.TrimSpace(raw), []byte(`/>`)) {
+					// Self-closing tag: convert to start tag, cvParam and end tag
+					raw = bytes.TrimSpace(raw)
+					raw = append(raw[:len(raw)-2], '>')
+					raw = append(raw, pendingCv...)
+					raw = append(raw, []byte(`</`+itemPrefix+`SpectrumIdentificationItem>`)...)
+					pendingCv = nil
+					inUpdatedItem = false
+				}
+			case `cvParam`, `userParam`:
+				// Only parameters of the item itself, not those of
+				// e.g. Fragmentation/IonType
+				if inUpdatedItem && depth == 0 {
+					if pendingCv != nil {
+						w.Write(pendingCv)
+						w.Write(indent)
+						pendingCv = nil
+					}
+					if t.Name.Local == `cvParam` && attrValue(t.Attr, `accession`) == cvDeltaMz {
+						skipping = true
+						raw = nil
+					}
+				}
+			}
+			if nested {
+				depth++
+			}
+		case xml.EndElement:
+			if depth > 0 {
+				depth--
+			}
+			switch t.Name.Local {
+			case `SpectrumIdentificationItem`:
+				if pendingCv != nil {
+					w.Write([]byte(`  `))
+					w.Write(pendingCv)
+					w.Write(indent)
+					pendingCv = nil
+				}
+				inUpdatedItem = false
+			case `cvParam`:
+				if skipping {
+					skipping = false
+					skipped = true
+					raw = nil
+				}
+			}
+		case xml.CharData:
+			if skipping || (skipSpace && len(bytes.TrimSpace(t)) == 0) {
+				raw = nil
+			}
+		default:
+			if skipping {
+				raw = nil
+			}
+		}
+		indent = indent[:0]
+		if cd, ok := t.(xml.CharData); ok && len(bytes.TrimSpace(cd)) == 0 {
+			// Remember the last line's indentation
+			if i := bytes.LastIndexByte(raw, '\n'); i >= 0 {
+				indent = append(indent, raw[i:]...)
+			}
+		}
+		_, err = w.Write(raw)
+		if err != nil {
+			return err
+		}
+	}
+	// Write anything after the last token
+	w.Write(rec.take(rec.base + int64(len(rec.buf))))
+	return w.Flush()
+}
+
+// updateItem replaces experimentalMassToCharge in the raw text of a
+// SpectrumIdentificationItem start tag. It returns the new text, the
+// cvParam to add (nil if the item was not updated) and the namespace
+// prefix (including colon) used for the element.
+func updateItem(raw []byte, t xml.StartElement, spectraData string, spectrumID string,
+	update UpdateExpMz) ([]byte, []byte, string) {
+	expMz, err := strconv.ParseFloat(attrValue(t.Attr, `experimentalMassToCharge`), 64)
+	if err != nil {
+		return raw, nil, ``
+	}
+	newMz, ok := update(spectraData, spectrumID, expMz)
+	if !ok {
+		return raw, nil, ``
+	}
+	newMzStr := strconv.FormatFloat(newMz, 'f', 8, 64)
+	loc := reExpMz.FindSubmatchIndex(raw)
+	if loc == nil {
+		return raw, nil, ``
+	}
+	var b bytes.Buffer
+	b.Write(raw[:loc[4]])
+	b.WriteString(`"` + newMzStr + `"`)
+	b.Write(raw[loc[5]:])
+
+	prefix := ``
+	if i := bytes.IndexByte(raw, '<'); i >= 0 {
+		if j := bytes.Index(raw[i:], []byte(`SpectrumIdentificationItem`)); j > 1 {
+			prefix = string(raw[i+1 : i+j])
+		}
+	}
+	var cv []byte // Only if m/z error can be computed
+	calcMz, err := strconv.ParseFloat(attrValue(t.Attr, `calculatedMassToCharge`), 64)
+	if err == nil && calcMz > 0 {
+		ppm := (newMz - calcMz) / calcMz * 1e6
+		cv = []byte(`<` + prefix + `cvParam cvRef="PSI-MS" accession="` + cvDeltaMz +
+			`" name="delta m/z" value="` + strconv.FormatFloat(ppm, 'f', 4, 64) +
+			`" unitCvRef="UO" unitAccession="UO:0000169" unitName="parts per million"/>`)
+	}
+	return b.Bytes(), cv, prefix
+}
+
+// attrValue returns the value of the attribute with the given (local) name
+func attrValue(attrs []xml.Attr, name string) string {
+	for _, a := range attrs {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ``
+}
@@ -0,0 +1,95 @@
+package mzidentml
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestRewrite(t *testing.T) {
+	var out bytes.Buffer
+	err := Rewrite(strings.NewReader(testDoc), &out,
+		func(spectraData string, spectrumID string, expMz float64) (float64, bool) {
+			if spectraData != "file:///data/run1.mzML" {
+				t.Errorf("SpectraData is %s, expected file:///data/run1.mzML", spectraData)
+			}
+			if spectrumID != "index=5" {
+				return 0, false
+			}
+			return expMz - 0.001, true
+		})
+	if err != nil {
+		t.Fatalf("Rewrite: error return %v", err)
+	}
+	f, err := Read(&out)
+	if err != nil {
+		t.Fatalf("Read: error return %v", err)
+	}
+	if f.NumIdents() != 3 {
+		t.Fatalf("NumIdents is %d, expected 3", f.NumIdents())
+	}
+	expected := []float64{470.7053, 485.2, 485.2}
+	for i, e := range expected {
+		ident, err := f.Ident(i)
+		if err != nil {
+			t.Fatalf("Ident: error return %v", err)
+		}
+		if math.Abs(ident.ExperimentalMz-e) > 1e-6 {
+			t.Errorf("Ident %d: ExperimentalMz is %f, expected %f", i, ident.ExperimentalMz, e)
+		}
+	}
+	ident, _ := f.Ident(0)
+	found := false
+	for _, cv := range ident.Cv {
+		if cv.Accession == cvDeltaMz {
+			found = true
+			if cv.Value != "-1.4871" {
+				t.Errorf("Delta m/z is %s ppm, expected -1.4871", cv.Value)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("Delta m/z cvParam not added")
+	}
+}
+
+// The delta m/z cvParam is added after Fragmentation, and cvParams of
+// IonType are not changed
+func TestRewriteFragmentation(t *testing.T) {
+	const doc = `<MzIdentML>
+<SpectrumIdentificationResult id="SIR_1" spectrumID="index=5">
+  <SpectrumIdentificationItem id="SII_1" experimentalMassToCharge="500.0" calculatedMassToCharge="500.0">
+    <PeptideEvidenceRef peptideEvidence_ref="PE_1"/>
+    <Fragmentation>
+      <IonType index="1 2" charge="1">
+        <FragmentArray measure_ref="m_mz" values="100.1 200.2"/>
+        <cvParam cvRef="PSI-MS" accession="MS:1001229" name="frag: a ion"/>
+        <cvParam cvRef="PSI-MS" accession="MS:1001975" name="delta m/z" value="3.0"/>
+      </IonType>
+    </Fragmentation>
+    <cvParam cvRef="PSI-MS" accession="MS:1001975" name="delta m/z" value="9.0"/>
+    <cvParam cvRef="PSI-MS" accession="MS:1002257" name="Comet:expectation value" value="1.0E-5"/>
+  </SpectrumIdentificationItem>
+</SpectrumIdentificationResult>
+</MzIdentML>`
+	var out bytes.Buffer
+	err := Rewrite(strings.NewReader(doc), &out,
+		func(spectraData string, spectrumID string, expMz float64) (float64, bool) {
+			return expMz + 0.001, true
+		})
+	if err != nil {
+		t.Fatalf("Rewrite: error return %v", err)
+	}
+	s := out.String()
+	frag := strings.Index(s, `</Fragmentation>`)
+	ionCv := strings.Index(s, `value="3.0"`)
+	newCv := strings.Index(s, `value="2.0000"`)
+	scoreCv := strings.Index(s, `MS:1002257`)
+	if frag < 0 || ionCv < 0 || ionCv > frag || newCv < frag || newCv > scoreCv {
+		t.Errorf("Delta m/z cvParam not after Fragmentation, or IonType changed:\n%s", s)
+	}
+	if strings.Contains(s, `value="9.0"`) {
+		t.Errorf("Existing delta m/z cvParam of the item not replaced:\n%s", s)
+	}
+}
@@ -7,9 +7,10 @@ import (
 
 // MzML wraps the contents of the mzML file
 type MzML struct {
-	content  mzMLContent
-	index2id []string
-	id2Index map[string]int
+	content    mzMLContent
+	index2id   []string
+	id2Index   map[string]int
+	scan2Index map[int]int // Scan number (scan=<nr> in the id) to index
 }
 
 // Peak contains the actual ms peak info
@@ -222,4 +223,6 @@ var (
 	ErrNoInstrumentConfiguration = errors.New("MzML: no instrument configuration in file")
 	// ErrNoMzML means the file does not contain mzML content
 	ErrNoMzML = errors.New("MzML: no mzML content in file")
+	// ErrNoPrecursorScan means no MS1 scan precedes an MSn scan
+	ErrNoPrecursorScan = errors.New("MzML: no precursor scan")
 )
@@ -10,6 +10,7 @@ import (
 	"log"
 	"math"
 	"strconv"
+	"strings"
 
 	"golang.org/x/net/html/charset"
 )
@@ -285,6 +286,24 @@ func (f *MzML) MSLevel(scanIndex int) (int, error) {
 	return 1, nil // If nothing else, guess it's MS1
 }
 
+// Polarity returns the scan polarity of a spectrum: 1 for positive,
+// -1 for negative or 0 if unknown
+func (f *MzML) Polarity(scanIndex int) (int, error) {
+	if scanIndex < 0 || scanIndex >= f.NumSpecs() {
+		return 0, ErrInvalidScanIndex
+	}
+
+	for _, cvParam := range f.content.Run.SpectrumList.Spectrum[scanIndex].CvPar {
+		switch cvParam.Accession {
+		case "MS:1000130": // positive scan
+			return 1, nil
+		case "MS:1000129": // negative scan
+			return -1, nil
+		}
+	}
+	return 0, nil
+}
+
 // MSInstruments returns the CV terms of the MS instrument
 func (f *MzML) MSInstruments() ([]string, error) {
 
@@ -324,6 +343,7 @@ func (f *MzML) traverseScan() error {
 
 	f.index2id = make([]string, f.NumSpecs())
 	f.id2Index = make(map[string]int, f.NumSpecs())
+	f.scan2Index = make(map[int]int, f.NumSpecs())
 	err := error(nil)
 
 	for i := range f.content.Run.SpectrumList.Spectrum {
@@ -342,15 +362,47 @@ func (f *MzML) addSpecToIndex(i int) error {
 	}
 	f.index2id[i] = f.content.Run.SpectrumList.Spectrum[i].ID
 	f.id2Index[f.content.Run.SpectrumList.Spectrum[i].ID] = i
+	if scanNr, ok := idValue(f.content.Run.SpectrumList.Spectrum[i].ID, `scan`); ok {
+		// If scan numbers are not unique, the first spectrum is used
+		if _, exists := f.scan2Index[scanNr]; !exists {
+			f.scan2Index[scanNr] = i
+		}
+	}
 	return nil
 }
 
-// ScanIndex converts a scan identifier (the string used in the mzML file)
-// into an index that is used to access the scans
+// idValue returns the integer value of a key in a spectrum identifier,
+// e.g. 63 for key "scan" in "controllerType=0 controllerNumber=1 scan=63"
+func idValue(scanID string, key string) (int, bool) {
+	for _, field := range strings.Fields(scanID) {
+		k, v, found := strings.Cut(field, `=`)
+		if found && k == key {
+			n, err := strconv.Atoi(v)
+			return n, err == nil
+		}
+	}
+	return 0, false
+}
+
+// ScanIndex converts a scan identifier into an index that is used to
+// access the scans. The identifier is either the native id used in the
+// mzML file, "index=<index>" or an id that contains "scan=<scan number>",
+// as used by identification files to reference spectra.
 func (f *MzML) ScanIndex(scanID string) (int, error) {
 	if index, ok := f.id2Index[scanID]; ok {
 		return index, nil
 	}
+	if index, ok := idValue(scanID, `index`); ok {
+		if index >= 0 && index < f.NumSpecs() {
+			return index, nil
+		}
+		return 0, ErrInvalidScanID
+	}
+	if scanNr, ok := idValue(scanID, `scan`); ok {
+		if index, ok := f.scan2Index[scanNr]; ok {
+			return index, nil
+		}
+	}
 	return 0, ErrInvalidScanID
 }
 
@@ -374,3 +426,35 @@ func (f *MzML) GetPrecursors(scanIndex int) ([]XMLprecursor, error) {
 	}
 	return nil, ErrInvalidScanIndex
 }
+
+// PrecursorScanIndex returns the index of the MS1 scan in which the
+// precursor of a scan was measured. This is the scan that the precursor
+// references (spectrumRef), or else the last MS1 scan before it.
+// For an MS1 scan, its own index is returned.
+func (f *MzML) PrecursorScanIndex(scanIndex int) (int, error) {
+	// Each step moves to a lower MS level or an earlier scan, the
+	// limit only protects against references that form a loop
+	for n := 0; n < f.NumSpecs(); n++ {
+		msLevel, err := f.MSLevel(scanIndex)
+		if err != nil {
+			return 0, err
+		}
+		if msLevel <= 1 {
+			return scanIndex, nil
+		}
+		precursors, _ := f.GetPrecursors(scanIndex)
+		if len(precursors) > 0 && precursors[0].SpectrumRef != `` {
+			if refIndex, err := f.ScanIndex(precursors[0].SpectrumRef); err == nil {
+				scanIndex = refIndex
+				continue
+			}
+		}
+		for scanIndex--; scanIndex >= 0; scanIndex-- {
+			if msLevel, err := f.MSLevel(scanIndex); err == nil && msLevel == 1 {
+				return scanIndex, nil
+			}
+		}
+		return 0, ErrNoPrecursorScan
+	}
+	return 0, ErrNoPrecursorScan
+}
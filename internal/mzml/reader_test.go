@@ -4,6 +4,7 @@ import (
 	"log"
 	"math"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -169,3 +170,103 @@ func TestAll2(t *testing.T) {
 	}
 
 }
+
+func TestScanIndex(t *testing.T) {
+	const doc = `<?xml version="1.0" encoding="utf-8"?>
+<mzML xmlns="http://psi.hupo.org/ms/mzml" version="1.1.0">
+ <run id="run1">
+  <spectrumList count="3">
+   <spectrum index="0" id="controllerType=0 controllerNumber=1 scan=10" defaultArrayLength="0">
+    <cvParam cvRef="MS" accession="MS:1000130" name="positive scan" value=""/>
+   </spectrum>
+   <spectrum index="1" id="controllerType=0 controllerNumber=1 scan=11" defaultArrayLength="0">
+    <cvParam cvRef="MS" accession="MS:1000129" name="negative scan" value=""/>
+   </spectrum>
+   <spectrum index="2" id="controllerType=0 controllerNumber=1 scan=12" defaultArrayLength="0"/>
+  </spectrumList>
+ </run>
+</mzML>`
+	f, err := Read(strings.NewReader(doc))
+	if err != nil {
+		t.Fatalf("Read: error return %v", err)
+	}
+	expected := map[string]int{
+		`controllerType=0 controllerNumber=1 scan=11`: 1,
+		`index=2`:  2,
+		`scan=10`:  0,
+		`SCAN=10`:  -1,
+		`index=3`:  -1,
+		`scan=13`:  -1,
+		`scan=abc`: -1,
+	}
+	for id, e := range expected {
+		idx, err := f.ScanIndex(id)
+		if e < 0 {
+			if err != ErrInvalidScanID {
+				t.Errorf("ScanIndex(%s): error return %v, should be ErrInvalidScanID", id, err)
+			}
+			continue
+		}
+		if err != nil || idx != e {
+			t.Errorf("ScanIndex(%s): got %d %v, should be %d", id, idx, err, e)
+		}
+	}
+	for i, e := range []int{1, -1, 0} {
+		polarity, err := f.Polarity(i)
+		if err != nil || polarity != e {
+			t.Errorf("Polarity(%d): got %d %v, should be %d", i, polarity, err, e)
+		}
+	}
+}
+
+func TestPrecursorScanIndex(t *testing.T) {
+	const doc = `<?xml version="1.0" encoding="utf-8"?>
+<mzML xmlns="http://psi.hupo.org/ms/mzml" version="1.1.0">
+ <run id="run1">
+  <spectrumList count="6">
+   <spectrum index="0" id="scan=1" defaultArrayLength="0">
+    <cvParam cvRef="MS" accession="MS:1000511" name="ms level" value="2"/>
+   </spectrum>
+   <spectrum index="1" id="scan=2" defaultArrayLength="0">
+    <cvParam cvRef="MS" accession="MS:1000511" name="ms level" value="1"/>
+   </spectrum>
+   <spectrum index="2" id="scan=3" defaultArrayLength="0">
+    <cvParam cvRef="MS" accession="MS:1000511" name="ms level" value="1"/>
+   </spectrum>
+   <spectrum index="3" id="scan=4" defaultArrayLength="0">
+    <cvParam cvRef="MS" accession="MS:1000511" name="ms level" value="2"/>
+   </spectrum>
+   <spectrum index="4" id="scan=5" defaultArrayLength="0">
+    <cvParam cvRef="MS" accession="MS:1000511" name="ms level" value="2"/>
+    <precursorList count="1"><precursor spectrumRef="scan=2"/></precursorList>
+   </spectrum>
+   <spectrum index="5" id="scan=6" defaultArrayLength="0">
+    <cvParam cvRef="MS" accession="MS:1000511" name="ms level" value="3"/>
+    <precursorList count="1"><precursor spectrumRef="scan=5"/></precursorList>
+   </spectrum>
+  </spectrumList>
+ </run>
+</mzML>`
+	f, err := Read(strings.NewReader(doc))
+	if err != nil {
+		t.Fatalf("Read: error return %v", err)
+	}
+	// Expected precursor scan index for each scan, -1 if none
+	expected := []int{-1, 1, 2, 2, 1, 1}
+	for i, e := range expected {
+		idx, err := f.PrecursorScanIndex(i)
+		if e < 0 {
+			if err != ErrNoPrecursorScan {
+				t.Errorf("PrecursorScanIndex(%d): error return %v, should be ErrNoPrecursorScan", i, err)
+			}
+			continue
+		}
+		if err != nil || idx != e {
+			t.Errorf("PrecursorScanIndex(%d): got %d %v, should be %d", i, idx, err, e)
+		}
+	}
+	_, err = f.PrecursorScanIndex(6)
+	if err != ErrInvalidScanIndex {
+		t.Errorf("PrecursorScanIndex: error return %v, should be ErrInvalidScanIndex", err)
+	}
+}
@@ -0,0 +1,488 @@
+// Package mztab reads identifications from mzTab 1.0 (proteomics and
+// metabolomics) and mzTab-M 2.0 (metabolomics) files
+package mztab
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/524D/mzrecal/internal/mzidentml"
+)
+
+// Column that contains the decoy status of PSMs
+const colDecoy = `opt_global_cv_MS:1002217_decoy_peptide`
+
+var (
+	// ErrInvalidLine means a line could not be parsed
+	ErrInvalidLine = errors.New("mzTab: invalid line")
+	// ErrNoHeader means a data line was found before its header
+	ErrNoHeader = errors.New("mzTab: data line without header")
+)
+
+// Modification accessions, e.g. "3-UNIMOD:35" or "CHEMMOD:+15.9949"
+var reMod = regexp.MustCompile(`(UNIMOD:\d+|MOD:\d+|CHEMMOD:[^,|\]]+)`)
+
+// Parameter in mzTab format: [cvLabel, accession, name, value]
+var reParam = regexp.MustCompile(`^\[\s*([^,]*),\s*([^,]*),\s*(.*),\s*([^,]*)\]$`)
+
+// Key of the software metadata, e.g. "software[1]"
+var reSoftwareKey = regexp.MustCompile(`^software\[\d+\]$`)
+
+// Reader reads identifications from an mzTab file one at a time.
+// PSM rows (mzTab 1.0), small molecule rows (mzTab 1.0) and small
+// molecule evidence rows (mzTab-M) are returned as identifications.
+// mzTab 1.0 repeats a PSM row for each protein that contains the
+// peptide, these rows are returned as one identification with all
+// proteins.
+type Reader struct {
+	s      *bufio.Scanner
+	unread []string // Fields of a line to process before the next one
+	// CV terms of the scores, e.g. "search_engine_score[1]"
+	scoreCv map[string]mzidentml.CVParam
+	psmCols map[string]int
+	smlCols map[string]int
+	smfCols map[string]int
+	smeCols map[string]int
+	// Retention time of small molecule evidence, from the features
+	// that refer to them
+	smeRT map[string]float64
+	// Location of the spectra files, e.g. "ms_run[1]"
+	msRunLocation map[string]string
+	software      []mzidentml.AnalysisSoftware
+	// PSM that is held until its next row is known, because the
+	// following rows may be repeats for other proteins
+	pending    *mzidentml.Identification
+	pendingKey string
+	psmSeen    map[string]bool // Keys of the PSMs that were returned
+}
+
+// NewReader creates a Reader for mzTab content from an io.Reader
+func NewReader(reader io.Reader) *Reader {
+	s := bufio.NewScanner(reader)
+	s.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	return &Reader{
+		s:             s,
+		scoreCv:       make(map[string]mzidentml.CVParam),
+		smeRT:         make(map[string]float64),
+		msRunLocation: make(map[string]string),
+		psmSeen:       make(map[string]bool),
+	}
+}
+
+// Next returns the next identification in the file.
+// At the end of the file, io.EOF is returned.
+func (r *Reader) Next() (mzidentml.Identification, error) {
+	for {
+		fields, ok := r.nextFields()
+		if !ok {
+			break
+		}
+		if fields[0] != `PSM` && r.pending != nil {
+			r.unread = fields
+			return r.takePending(), nil
+		}
+		var err error
+		switch fields[0] {
+		case `MTD`:
+			r.metadata(fields)
+		case `PSH`:
+			r.psmCols = columns(fields)
+		case `SMH`:
+			r.smlCols = columns(fields)
+		case `SFH`:
+			r.smfCols = columns(fields)
+		case `SEH`:
+			r.smeCols = columns(fields)
+		case `PSM`:
+			if r.psmCols == nil {
+				return mzidentml.Identification{}, ErrNoHeader
+			}
+			ident, err := r.psm(fields)
+			if err != nil {
+				return ident, err
+			}
+			key := r.psmKey(fields, &ident)
+			if r.pending != nil && key == r.pendingKey {
+				mergePSM(r.pending, &ident)
+				continue
+			}
+			if r.psmSeen[key] {
+				// Repeated row that doesn't follow the first one
+				continue
+			}
+			r.psmSeen[key] = true
+			prev := r.pending
+			r.pending, r.pendingKey = &ident, key
+			if prev != nil {
+				return *prev, nil
+			}
+		case `SML`:
+			if r.smlCols == nil {
+				return mzidentml.Identification{}, ErrNoHeader
+			}
+			// Only mzTab 1.0 small molecule rows contain the m/z of
+			// the identification, in mzTab-M these are in SME rows
+			if _, ok := r.smlCols[`calc_mass_to_charge`]; ok {
+				return r.sml(fields)
+			}
+		case `SMF`:
+			if r.smfCols == nil {
+				return mzidentml.Identification{}, ErrNoHeader
+			}
+			err = r.smf(fields)
+		case `SME`:
+			if r.smeCols == nil {
+				return mzidentml.Identification{}, ErrNoHeader
+			}
+			return r.sme(fields)
+		}
+		if err != nil {
+			return mzidentml.Identification{}, err
+		}
+	}
+	if err := r.s.Err(); err != nil {
+		return mzidentml.Identification{}, err
+	}
+	if r.pending != nil {
+		return r.takePending(), nil
+	}
+	return mzidentml.Identification{}, io.EOF
+}
+
+// nextFields returns the fields of the next line, ok is false at the
+// end of the file
+func (r *Reader) nextFields() (fields []string, ok bool) {
+	if r.unread != nil {
+		fields, r.unread = r.unread, nil
+		return fields, true
+	}
+	if !r.s.Scan() {
+		return nil, false
+	}
+	return strings.Split(strings.TrimRight(r.s.Text(), "\r"), "\t"), true
+}
+
+// takePending returns the held PSM
+func (r *Reader) takePending() mzidentml.Identification {
+	ident := *r.pending
+	r.pending = nil
+	return ident
+}
+
+// psmKey returns the key that identifies the rows of a PSM: PSM_ID,
+// or else the spectrum and peptide
+func (r *Reader) psmKey(fields []string, ident *mzidentml.Identification) string {
+	if id := field(fields, r.psmCols, `PSM_ID`); id != `` {
+		return id
+	}
+	return field(fields, r.psmCols, `spectra_ref`) + "\t" + ident.PepID
+}
+
+// mergePSM adds the proteins of a repeated PSM row to the PSM. The PSM
+// is a decoy only if all its proteins are decoys.
+func mergePSM(ident *mzidentml.Identification, repeat *mzidentml.Identification) {
+	for _, acc := range repeat.Proteins {
+		found := false
+		for _, p := range ident.Proteins {
+			if p == acc {
+				found = true
+				break
+			}
+		}
+		if !found {
+			ident.Proteins = append(ident.Proteins, acc)
+		}
+	}
+	ident.Decoy = ident.Decoy && repeat.Decoy
+}
+
+// SpectraData returns the spectra files (ms_run) of the metadata
+// section. These are known after the first call of Next.
+func (r *Reader) SpectraData() []mzidentml.SpectraData {
+	runs := make([]string, 0, len(r.msRunLocation))
+	for run := range r.msRunLocation {
+		runs = append(runs, run)
+	}
+	sort.Strings(runs)
+	sds := make([]mzidentml.SpectraData, len(runs))
+	for i, run := range runs {
+		sds[i] = mzidentml.SpectraData{ID: run, Location: r.msRunLocation[run]}
+	}
+	return sds
+}
+
+// AnalysisSoftware returns the software of the metadata section. It
+// is known after the first call of Next.
+func (r *Reader) AnalysisSoftware() []mzidentml.AnalysisSoftware {
+	return r.software
+}
+
+// metadata stores the CV terms of the scores, the locations of the
+// spectra files and the software
+func (r *Reader) metadata(fields []string) {
+	if len(fields) < 3 {
+		return
+	}
+	key := fields[1]
+	if reSoftwareKey.MatchString(key) {
+		if m := reParam.FindStringSubmatch(strings.TrimSpace(fields[2])); m != nil {
+			cv := mzidentml.CVParam{Accession: strings.TrimSpace(m[2]), Name: strings.TrimSpace(m[3])}
+			r.software = append(r.software, mzidentml.AnalysisSoftware{
+				Name:         cv.Name,
+				Version:      strings.TrimSpace(m[4]),
+				SoftwareName: []mzidentml.CVParam{cv},
+			})
+		}
+		return
+	}
+	if run, ok := strings.CutSuffix(key, `-location`); ok && strings.HasPrefix(run, `ms_run[`) {
+		r.msRunLocation[run] = strings.TrimSpace(fields[2])
+		return
+	}
+	var col string
+	switch {
+	case strings.HasPrefix(key, `psm_search_engine_score[`):
+		col = `search_engine_score[` + strings.TrimPrefix(key, `psm_search_engine_score[`)
+	case strings.HasPrefix(key, `smallmolecule_search_engine_score[`):
+		col = `best_search_engine_score[` + strings.TrimPrefix(key, `smallmolecule_search_engine_score[`)
+	case strings.HasPrefix(key, `id_confidence_measure[`):
+		col = key
+	default:
+		return
+	}
+	m := reParam.FindStringSubmatch(strings.TrimSpace(fields[2]))
+	if m != nil {
+		r.scoreCv[col] = mzidentml.CVParam{
+			Accession: strings.TrimSpace(m[2]),
+			Name:      strings.TrimSpace(m[3]),
+		}
+	}
+}
+
+// columns maps column names to their index
+func columns(fields []string) map[string]int {
+	cols := make(map[string]int, len(fields))
+	for i, f := range fields {
+		cols[f] = i
+	}
+	return cols
+}
+
+// field returns the value of a named column, or an empty string
+// if the column is absent or null
+func field(fields []string, cols map[string]int, name string) string {
+	i, ok := cols[name]
+	if !ok || i >= len(fields) {
+		return ``
+	}
+	v := strings.TrimSpace(fields[i])
+	if v == `null` || v == `NA` {
+		return ``
+	}
+	return v
+}
+
+// floatField returns the value of a numeric column. For columns with
+// multiple values ("|" separated), the first value is returned.
+// If the value is absent, def is returned.
+func floatField(fields []string, cols map[string]int, name string, def float64) (float64, error) {
+	v := field(fields, cols, name)
+	if v == `` {
+		return def, nil
+	}
+	v, _, _ = strings.Cut(v, `|`)
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return def, ErrInvalidLine
+	}
+	return f, nil
+}
+
+// spectrumRef splits a spectra_ref into the location of the spectra
+// file and the spectrum id, e.g. "ms_run[1]:index=5" becomes the
+// location of ms_run[1] and "index=5"
+func (r *Reader) spectrumRef(spectraRef string) (location string, specID string) {
+	ref, _, _ := strings.Cut(spectraRef, `|`)
+	if run, id, ok := strings.Cut(ref, `:`); ok {
+		return r.msRunLocation[run], id
+	}
+	return ``, ref
+}
+
+// scores adds the scores of a row as CV parameters
+func (r *Reader) scores(ident *mzidentml.Identification, fields []string,
+	cols map[string]int, prefix string) {
+	for col := range cols {
+		if !strings.HasPrefix(col, prefix) {
+			continue
+		}
+		v := field(fields, cols, col)
+		if v == `` {
+			continue
+		}
+		cv := r.scoreCv[col]
+		if cv.Name == `` {
+			cv.Name = col
+		}
+		cv.Value = v
+		ident.Cv = append(ident.Cv, cv)
+	}
+}
+
+// psm converts a PSM row into an Identification
+func (r *Reader) psm(fields []string) (mzidentml.Identification, error) {
+	var ident mzidentml.Identification
+	var err error
+	cols := r.psmCols
+
+	ident.PepSeq = field(fields, cols, `sequence`)
+	ident.PepID = ident.PepSeq
+	mods := field(fields, cols, `modifications`)
+	if mods != `` && mods != `0` {
+		ident.PepID += `/` + mods
+		r.modifications(&ident, mods)
+	}
+	charge, err := floatField(fields, cols, `charge`, 0)
+	if err != nil {
+		return ident, err
+	}
+	ident.Charge = int(charge)
+	ident.RetentionTime, err = floatField(fields, cols, `retention_time`, -1)
+	if err != nil {
+		return ident, err
+	}
+	ident.CalculatedMz, err = floatField(fields, cols, `calc_mass_to_charge`, 0)
+	if err != nil {
+		return ident, err
+	}
+	ident.ExperimentalMz, err = floatField(fields, cols, `exp_mass_to_charge`, 0)
+	if err != nil {
+		return ident, err
+	}
+	ident.SpectraData, ident.SpecID = r.spectrumRef(field(fields, cols, `spectra_ref`))
+	ident.PassThreshold = true
+	ident.Decoy = field(fields, cols, colDecoy) == `1`
+	if acc := field(fields, cols, `accession`); acc != `` {
+		ident.Proteins = strings.Split(acc, `,`)
+	}
+	r.scores(&ident, fields, cols, `search_engine_score[`)
+	return ident, nil
+}
+
+// modifications computes the mass shift of the modifications of a PSM
+func (r *Reader) modifications(ident *mzidentml.Identification, mods string) {
+	for _, acc := range reMod.FindAllString(mods, -1) {
+		if strings.HasPrefix(acc, `CHEMMOD:`) {
+			m, err := strconv.ParseFloat(strings.TrimPrefix(acc, `CHEMMOD:`), 64)
+			if err == nil {
+				ident.ModMass += m
+				continue
+			}
+		} else if m, ok := mzidentml.LookupModMass(acc, ``); ok {
+			ident.ModMass += m
+			continue
+		}
+		ident.UnknownMods = append(ident.UnknownMods, acc)
+	}
+}
+
+// sml converts an mzTab 1.0 small molecule row into an Identification
+func (r *Reader) sml(fields []string) (mzidentml.Identification, error) {
+	var ident mzidentml.Identification
+	var err error
+	cols := r.smlCols
+
+	ident.PepID = field(fields, cols, `identifier`)
+	if d := field(fields, cols, `description`); d != `` {
+		ident.PepID = d
+	}
+	charge, err := floatField(fields, cols, `charge`, 0)
+	if err != nil {
+		return ident, err
+	}
+	ident.Charge = int(charge)
+	ident.RetentionTime, err = floatField(fields, cols, `retention_time`, -1)
+	if err != nil {
+		return ident, err
+	}
+	ident.CalculatedMz, err = floatField(fields, cols, `calc_mass_to_charge`, 0)
+	if err != nil {
+		return ident, err
+	}
+	ident.ExperimentalMz, err = floatField(fields, cols, `exp_mass_to_charge`, 0)
+	if err != nil {
+		return ident, err
+	}
+	ident.SpectraData, ident.SpecID = r.spectrumRef(field(fields, cols, `spectra_ref`))
+	ident.PassThreshold = true
+	// The adduct is not reported, but the m/z is specific for the charge
+	ident.Adduct = `[M]` + strconv.Itoa(ident.Charge)
+	r.scores(&ident, fields, cols, `best_search_engine_score[`)
+	return ident, nil
+}
+
+// smf stores the retention time of an mzTab-M small molecule feature
+// for the evidence that it refers to
+func (r *Reader) smf(fields []string) error {
+	cols := r.smfCols
+	rt, err := floatField(fields, cols, `retention_time_in_seconds`, -1)
+	if err != nil || rt < 0 {
+		return err
+	}
+	for _, smeID := range strings.Split(field(fields, cols, `SME_ID_REFS`), `|`) {
+		if smeID != `` {
+			r.smeRT[smeID] = rt
+		}
+	}
+	return nil
+}
+
+// sme converts an mzTab-M small molecule evidence row into an Identification
+func (r *Reader) sme(fields []string) (mzidentml.Identification, error) {
+	var ident mzidentml.Identification
+	var err error
+	cols := r.smeCols
+
+	smeID := field(fields, cols, `SME_ID`)
+	ident.PepID = smeID
+	if name := field(fields, cols, `chemical_name`); name != `` {
+		ident.PepID = name
+	} else if dbID := field(fields, cols, `database_identifier`); dbID != `` {
+		ident.PepID = dbID
+	}
+	charge, err := floatField(fields, cols, `charge`, 0)
+	if err != nil {
+		return ident, err
+	}
+	ident.Charge = int(charge)
+	ident.RetentionTime = -1
+	if rt, ok := r.smeRT[smeID]; ok {
+		ident.RetentionTime = rt
+	}
+	ident.CalculatedMz, err = floatField(fields, cols, `theoretical_mass_to_charge`, 0)
+	if err != nil {
+		return ident, err
+	}
+	ident.ExperimentalMz, err = floatField(fields, cols, `exp_mass_to_charge`, 0)
+	if err != nil {
+		return ident, err
+	}
+	rank, err := floatField(fields, cols, `rank`, 0)
+	if err != nil {
+		return ident, err
+	}
+	ident.Rank = int(rank)
+	ident.SpectraData, ident.SpecID = r.spectrumRef(field(fields, cols, `spectra_ref`))
+	ident.PassThreshold = true
+	ident.Adduct = field(fields, cols, `adduct_ion`)
+	if ident.Adduct == `` {
+		ident.Adduct = `[M]` + strconv.Itoa(ident.Charge)
+	}
+	r.scores(&ident, fields, cols, `id_confidence_measure[`)
+	return ident, nil
+}
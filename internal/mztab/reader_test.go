@@ -0,0 +1,123 @@
+package mztab
+
+import (
+	"io"
+	"math"
+	"strings"
+	"testing"
+)
+
+const testPSM = "MTD\tmzTab-version\t1.0.0\n" +
+	"MTD\tms_run[1]-location\tfile:///data/run1.mzML\n" +
+	"MTD\tsoftware[1]\t[MS, MS:1002251, Comet, 2019.01]\n" +
+	"MTD\tsoftware[1]-setting[1]\tfragment_bin_tol = 0.02\n" +
+	"MTD\tpsm_search_engine_score[1]\t[MS, MS:1002257, Comet:expectation value, ]\n" +
+	"\n" +
+	"PSH\tsequence\tPSM_ID\taccession\tunique\tdatabase\tdatabase_version\tsearch_engine\tsearch_engine_score[1]\tmodifications\tretention_time\tcharge\texp_mass_to_charge\tcalc_mass_to_charge\tspectra_ref\tpre\tpost\tstart\tend\topt_global_cv_MS:1002217_decoy_peptide\n" +
+	"PSM\tPEPTMIDE\t1\tPROT1\t1\tdb\tnull\t[MS, MS:1002251, Comet, ]\t1.2e-5\t5-UNIMOD:35\t123.4|124.0\t2\t473.7230\t473.722276\tms_run[1]:index=5\tK\tR\t10\t17\t0\n" +
+	"PSM\tPEPTMIDE\t1\tPROT2\t0\tdb\tnull\t[MS, MS:1002251, Comet, ]\t1.2e-5\t5-UNIMOD:35\t123.4|124.0\t2\t473.7230\t473.722276\tms_run[1]:index=5\tR\tR\t40\t47\t0\n" +
+	"PSM\tPEPTCIDE\t2\tDECOY_PROT3\t1\tdb\tnull\t[MS, MS:1002251, Comet, ]\t3.0\t5-CHEMMOD:+57.021464,6-UNIMOD:99999\t130.0\t2\t480.0\t480.0\tms_run[1]:index=8\tK\tR\t10\t17\t1\n"
+
+const testSmallMolecule = "MTD\tmzTab-version\t2.0.0-M\n" +
+	"MTD\tid_confidence_measure[1]\t[MS, MS:1002890, fragmentation score, ]\n" +
+	"SMH\tSML_ID\tSMF_ID_REFS\tdatabase_identifier\tchemical_name\ttheoretical_neutral_mass\tadduct_ions\n" +
+	"SML\t1\t1\tHMDB0000122\tglucose\t180.0634\t[M+Na]1+\n" +
+	"SFH\tSMF_ID\tSME_ID_REFS\tadduct_ion\texp_mass_to_charge\tcharge\tretention_time_in_seconds\n" +
+	"SMF\t1\t1\t[M+Na]1+\t203.0527\t1\t61.5\n" +
+	"SEH\tSME_ID\tevidence_input_id\tdatabase_identifier\tchemical_formula\tchemical_name\tadduct_ion\texp_mass_to_charge\tcharge\ttheoretical_mass_to_charge\tspectra_ref\tid_confidence_measure[1]\trank\n" +
+	"SME\t1\t1\tHMDB0000122\tC6H12O6\tglucose\t[M+Na]1+\t203.0527\t1\t203.052583\tms_run[1]:scan=17\t0.9\t1\n"
+
+func TestPSM(t *testing.T) {
+	r := NewReader(strings.NewReader(testPSM))
+	ident, err := r.Next()
+	if err != nil {
+		t.Fatalf("Next: error return %v", err)
+	}
+	if ident.PepSeq != "PEPTMIDE" || ident.Charge != 2 || ident.Decoy ||
+		ident.RetentionTime != 123.4 || ident.SpecID != "index=5" ||
+		ident.SpectraData != "file:///data/run1.mzML" ||
+		!ident.PassThreshold || ident.Adduct != "" {
+		t.Errorf("Unexpected identification %+v", ident)
+	}
+	// The repeated row for PROT2 is merged
+	if len(ident.Proteins) != 2 || ident.Proteins[0] != "PROT1" || ident.Proteins[1] != "PROT2" {
+		t.Errorf("Proteins: got %v, expected [PROT1 PROT2]", ident.Proteins)
+	}
+	if math.Abs(ident.ModMass-15.994915) > 1e-6 || len(ident.UnknownMods) != 0 {
+		t.Errorf("ModMass is %f (unknown %v), expected 15.994915", ident.ModMass, ident.UnknownMods)
+	}
+	if len(ident.Cv) != 1 || ident.Cv[0].Accession != "MS:1002257" || ident.Cv[0].Value != "1.2e-5" {
+		t.Errorf("Unexpected scores %+v", ident.Cv)
+	}
+	if as := r.AnalysisSoftware(); len(as) != 1 || as[0].Name != "Comet" || as[0].Version != "2019.01" ||
+		as[0].SoftwareName[0].Accession != "MS:1002251" {
+		t.Errorf("AnalysisSoftware: got %+v, expected Comet", as)
+	}
+	if sd := r.SpectraData(); len(sd) != 1 || sd[0].Location != "file:///data/run1.mzML" {
+		t.Errorf("SpectraData: got %+v, expected file:///data/run1.mzML", sd)
+	}
+
+	ident, err = r.Next()
+	if err != nil {
+		t.Fatalf("Next: error return %v", err)
+	}
+	if !ident.Decoy || math.Abs(ident.ModMass-57.021464) > 1e-6 ||
+		len(ident.UnknownMods) != 1 || ident.UnknownMods[0] != "UNIMOD:99999" {
+		t.Errorf("Unexpected identification %+v", ident)
+	}
+
+	_, err = r.Next()
+	if err != io.EOF {
+		t.Errorf("Expected io.EOF, got %v", err)
+	}
+}
+
+// Without PSM_ID, repeated rows are recognized by spectrum and peptide
+func TestRepeatedPSM(t *testing.T) {
+	const doc = "PSH\tsequence\taccession\tmodifications\tretention_time\tcharge\tspectra_ref\topt_global_cv_MS:1002217_decoy_peptide\n" +
+		"PSM\tPEPTIDE\tDECOY_P1\tnull\t100\t2\tms_run[1]:index=5\t1\n" +
+		"PSM\tPEPTIDE\tP2\tnull\t100\t2\tms_run[1]:index=5\t0\n" +
+		"PSM\tPEPTIDEK\tP3\tnull\t100\t2\tms_run[1]:index=5\t0\n" +
+		"PSM\tPEPTIDE\tP4\tnull\t100\t2\tms_run[1]:index=5\t0\n"
+	r := NewReader(strings.NewReader(doc))
+	expected := []struct {
+		seq      string
+		proteins int
+	}{{"PEPTIDE", 2}, {"PEPTIDEK", 1}}
+	for _, e := range expected {
+		ident, err := r.Next()
+		if err != nil {
+			t.Fatalf("Next: error return %v", err)
+		}
+		if ident.PepSeq != e.seq || len(ident.Proteins) != e.proteins || ident.Decoy {
+			t.Errorf("Got %s proteins %v decoy %v, expected %s with %d target proteins",
+				ident.PepSeq, ident.Proteins, ident.Decoy, e.seq, e.proteins)
+		}
+	}
+	// The repeat that doesn't follow the first row is skipped
+	_, err := r.Next()
+	if err != io.EOF {
+		t.Errorf("Expected io.EOF, got %v", err)
+	}
+}
+
+func TestSmallMolecule(t *testing.T) {
+	r := NewReader(strings.NewReader(testSmallMolecule))
+	ident, err := r.Next()
+	if err != nil {
+		t.Fatalf("Next: error return %v", err)
+	}
+	if ident.PepSeq != "" || ident.PepID != "glucose" || ident.Charge != 1 ||
+		ident.Adduct != "[M+Na]1+" || ident.RetentionTime != 61.5 ||
+		ident.CalculatedMz != 203.052583 || ident.SpecID != "scan=17" || ident.Rank != 1 {
+		t.Errorf("Unexpected identification %+v", ident)
+	}
+	if len(ident.Cv) != 1 || ident.Cv[0].Accession != "MS:1002890" || ident.Cv[0].Value != "0.9" {
+		t.Errorf("Unexpected scores %+v", ident.Cv)
+	}
+
+	_, err = r.Next()
+	if err != io.EOF {
+		t.Errorf("Expected io.EOF, got %v", err)
+	}
+}
@@ -0,0 +1,68 @@
+package pepxml
+
+// Types for parsing pepXML
+
+type searchSummary struct {
+	SearchEngine string `xml:"search_engine,attr"`
+}
+
+type spectrumQuery struct {
+	Spectrum             string         `xml:"spectrum,attr"`
+	SpectrumNativeID     string         `xml:"spectrumNativeID,attr"`
+	StartScan            int            `xml:"start_scan,attr"`
+	AssumedCharge        int            `xml:"assumed_charge,attr"`
+	PrecursorNeutralMass float64        `xml:"precursor_neutral_mass,attr"`
+	RetentionTimeSec     *float64       `xml:"retention_time_sec,attr"`
+	SearchResult         []searchResult `xml:"search_result"`
+}
+
+type searchResult struct {
+	SearchHit []searchHit `xml:"search_hit"`
+}
+
+type searchHit struct {
+	HitRank            int                  `xml:"hit_rank,attr"`
+	Peptide            string               `xml:"peptide,attr"`
+	Protein            string               `xml:"protein,attr"`
+	CalcNeutralPepMass float64              `xml:"calc_neutral_pep_mass,attr"`
+	IsRejected         string               `xml:"is_rejected,attr"`
+	AlternativeProtein []alternativeProtein `xml:"alternative_protein"`
+	ModificationInfo   *modificationInfo    `xml:"modification_info"`
+	SearchScore        []searchScore        `xml:"search_score"`
+	AnalysisResult     []analysisResult     `xml:"analysis_result"`
+}
+
+type alternativeProtein struct {
+	Protein string `xml:"protein,attr"`
+}
+
+type modificationInfo struct {
+	ModifiedPeptide  string             `xml:"modified_peptide,attr"`
+	ModNtermMass     *float64           `xml:"mod_nterm_mass,attr"`
+	ModCtermMass     *float64           `xml:"mod_cterm_mass,attr"`
+	ModAminoacidMass []modAminoacidMass `xml:"mod_aminoacid_mass"`
+}
+
+// modAminoacidMass contains the mass of a modified residue. Newer pepXML
+// versions also contain the mass shift in attribute "variable" or "static".
+type modAminoacidMass struct {
+	Position int      `xml:"position,attr"`
+	Mass     float64  `xml:"mass,attr"`
+	Variable *float64 `xml:"variable,attr"`
+	Static   *float64 `xml:"static,attr"`
+}
+
+type searchScore struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type analysisResult struct {
+	Analysis             string      `xml:"analysis,attr"`
+	PeptideprophetResult *probResult `xml:"peptideprophet_result"`
+	InterprophetResult   *probResult `xml:"interprophet_result"`
+}
+
+type probResult struct {
+	Probability string `xml:"probability,attr"`
+}
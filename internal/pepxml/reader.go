@@ -0,0 +1,261 @@
+package pepxml
+
+import (
+	"encoding/xml"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/524D/mzrecal/internal/chem"
+	"github.com/524D/mzrecal/internal/mzidentml"
+	"golang.org/x/net/html/charset"
+)
+
+// Masses of the unmodified peptide termini, as used in
+// mod_nterm_mass (H) and mod_cterm_mass (OH)
+var massNterm = chem.MustParseFormula(`H`).Mass()
+var massCterm = chem.MustParseFormula(`OH`).Mass()
+
+// CV terms for the search scores of known search engines
+var engineScoreCv = map[string]map[string]string{
+	`comet`: {
+		`expect`:  `MS:1002257`,
+		`xcorr`:   `MS:1002252`,
+		`deltacn`: `MS:1002253`,
+		`spscore`: `MS:1002255`,
+	},
+	`x! tandem`: {
+		`expect`:     `MS:1001330`,
+		`hyperscore`: `MS:1001331`,
+	},
+	`sequest`: {
+		`xcorr`:  `MS:1001155`,
+		`expect`: `MS:1001159`,
+	},
+	`mascot`: {
+		`ionscore`: `MS:1001171`,
+		`expect`:   `MS:1001172`,
+	},
+}
+
+// Reader reads identifications from a pepXML file one at a time
+type Reader struct {
+	d *xml.Decoder
+	// Proteins starting with one of these prefixes are decoys
+	DecoyPrefixes []string
+	// Residue masses for the mass shift of modifications that only
+	// specify the modified residue mass. If nil, these are unknown.
+	ResidueMass map[rune]float64
+	scoreCv     map[string]string            // CV terms of the current search engine
+	software    []mzidentml.AnalysisSoftware // Search engines of the runs
+	spectraData string                       // Spectra file of the current run
+	pending     []mzidentml.Identification
+}
+
+// DefaultDecoyPrefixes are the prefixes of decoy proteins of NewReader
+var DefaultDecoyPrefixes = []string{`DECOY_`, `decoy_`, `rev_`, `REV_`, `XXX_`}
+
+// NewReader creates a Reader for streaming pepXML content from an io.Reader
+func NewReader(reader io.Reader) *Reader {
+	d := xml.NewDecoder(reader)
+	d.CharsetReader = charset.NewReaderLabel
+	return &Reader{
+		d:             d,
+		DecoyPrefixes: DefaultDecoyPrefixes,
+	}
+}
+
+// Next returns the next identification (search hit) in the file.
+// At the end of the file, io.EOF is returned.
+func (r *Reader) Next() (mzidentml.Identification, error) {
+	for len(r.pending) == 0 {
+		err := r.readQuery()
+		if err != nil {
+			return mzidentml.Identification{}, err
+		}
+	}
+	ident := r.pending[0]
+	r.pending = r.pending[1:]
+	return ident, nil
+}
+
+// readQuery reads tokens until the next spectrum_query has been decoded
+func (r *Reader) readQuery() error {
+	for {
+		t, err := r.d.Token()
+		if err != nil {
+			return err
+		}
+		se, ok := t.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch se.Name.Local {
+		case `msms_run_summary`:
+			var baseName, rawData string
+			for _, attr := range se.Attr {
+				switch attr.Name.Local {
+				case `base_name`:
+					baseName = attr.Value
+				case `raw_data`:
+					rawData = attr.Value
+				}
+			}
+			if rawData != `` && !strings.HasPrefix(rawData, `.`) {
+				rawData = `.` + rawData
+			}
+			r.spectraData = baseName + rawData
+		case `search_summary`:
+			var ss searchSummary
+			err = r.d.DecodeElement(&ss, &se)
+			if err != nil {
+				return err
+			}
+			r.scoreCv = engineScoreCv[strings.ToLower(ss.SearchEngine)]
+			r.addSoftware(ss.SearchEngine)
+		case `spectrum_query`:
+			var sq spectrumQuery
+			err = r.d.DecodeElement(&sq, &se)
+			if err != nil {
+				return err
+			}
+			for _, sr := range sq.SearchResult {
+				for i := range sr.SearchHit {
+					r.pending = append(r.pending, r.identification(&sq, &sr.SearchHit[i]))
+				}
+			}
+			return nil
+		}
+	}
+}
+
+// addSoftware adds a search engine to the software of the file
+func (r *Reader) addSoftware(name string) {
+	if name == `` {
+		return
+	}
+	for _, as := range r.software {
+		if as.Name == name {
+			return
+		}
+	}
+	r.software = append(r.software, mzidentml.AnalysisSoftware{Name: name})
+}
+
+// AnalysisSoftware returns the search engines of the runs that have
+// been read so far. The first is known after the first call of Next.
+func (r *Reader) AnalysisSoftware() []mzidentml.AnalysisSoftware {
+	return r.software
+}
+
+// identification converts a search hit into an Identification
+func (r *Reader) identification(sq *spectrumQuery, hit *searchHit) mzidentml.Identification {
+	var ident mzidentml.Identification
+
+	ident.PepSeq = hit.Peptide
+	ident.PepID = hit.Peptide
+	ident.Charge = sq.AssumedCharge
+	ident.Rank = hit.HitRank
+	ident.PassThreshold = hit.IsRejected != `1`
+	if sq.SpectrumNativeID != `` {
+		ident.SpecID = sq.SpectrumNativeID
+	} else {
+		ident.SpecID = `scan=` + strconv.Itoa(sq.StartScan)
+	}
+	ident.SpectraData = r.spectraData
+	ident.RetentionTime = -1
+	if sq.RetentionTimeSec != nil {
+		ident.RetentionTime = *sq.RetentionTimeSec
+	}
+	if sq.AssumedCharge > 0 {
+		charge := float64(sq.AssumedCharge)
+		ident.CalculatedMz = (hit.CalcNeutralPepMass + charge*chem.MassProton) / charge
+		ident.ExperimentalMz = (sq.PrecursorNeutralMass + charge*chem.MassProton) / charge
+	}
+
+	if mi := hit.ModificationInfo; mi != nil {
+		if mi.ModifiedPeptide != `` {
+			ident.PepID = mi.ModifiedPeptide
+		}
+		if mi.ModNtermMass != nil {
+			ident.ModMass += *mi.ModNtermMass - massNterm
+		}
+		if mi.ModCtermMass != nil {
+			ident.ModMass += *mi.ModCtermMass - massCterm
+		}
+		// Older pepXML versions only specify the mass of the modified
+		// residue, the mass shift is relative to the unmodified residue.
+		// If that is unknown, the search engine's peptide mass must be used.
+		for _, mod := range mi.ModAminoacidMass {
+			switch {
+			case mod.Variable != nil:
+				ident.ModMass += *mod.Variable
+			case mod.Static != nil:
+				ident.ModMass += *mod.Static
+			default:
+				if m, ok := r.residueMass(hit.Peptide, mod.Position); ok {
+					ident.ModMass += mod.Mass - m
+				} else {
+					ident.UnknownMods = append(ident.UnknownMods,
+						`residue mass `+strconv.FormatFloat(mod.Mass, 'f', -1, 64)+
+							` at `+strconv.Itoa(mod.Position))
+				}
+			}
+		}
+	}
+
+	proteins := []string{hit.Protein}
+	for _, ap := range hit.AlternativeProtein {
+		proteins = append(proteins, ap.Protein)
+	}
+	ident.Proteins = proteins
+	ident.Decoy = true
+	for _, p := range proteins {
+		if !r.isDecoy(p) {
+			ident.Decoy = false
+			break
+		}
+	}
+
+	for _, sc := range hit.SearchScore {
+		ident.Cv = append(ident.Cv, mzidentml.CVParam{
+			Accession: r.scoreCv[strings.ToLower(sc.Name)],
+			Name:      sc.Name,
+			Value:     sc.Value,
+		})
+	}
+	for _, ar := range hit.AnalysisResult {
+		if ar.PeptideprophetResult != nil {
+			ident.Cv = append(ident.Cv, mzidentml.CVParam{
+				Name:  `peptideprophet probability`,
+				Value: ar.PeptideprophetResult.Probability,
+			})
+		}
+		if ar.InterprophetResult != nil {
+			ident.Cv = append(ident.Cv, mzidentml.CVParam{
+				Name:  `interprophet probability`,
+				Value: ar.InterprophetResult.Probability,
+			})
+		}
+	}
+	return ident
+}
+
+// residueMass returns the mass of the residue at (1-based) position pos
+// of the peptide
+func (r *Reader) residueMass(pepSeq string, pos int) (float64, bool) {
+	if pos < 1 || pos > len(pepSeq) {
+		return 0, false
+	}
+	m, ok := r.ResidueMass[rune(pepSeq[pos-1])]
+	return m, ok
+}
+
+func (r *Reader) isDecoy(protein string) bool {
+	for _, prefix := range r.DecoyPrefixes {
+		if strings.HasPrefix(protein, prefix) {
+			return true
+		}
+	}
+	return false
+}
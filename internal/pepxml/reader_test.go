@@ -0,0 +1,105 @@
+package pepxml
+
+import (
+	"io"
+	"math"
+	"strings"
+	"testing"
+)
+
+const testDoc = `<?xml version="1.0" encoding="UTF-8"?>
+<msms_pipeline_analysis xmlns="http://regis-web.systemsbiology.net/pepXML">
+<msms_run_summary base_name="test" raw_data=".mzML">
+<search_summary base_name="test" search_engine="Comet" precursor_mass_type="monoisotopic"/>
+<spectrum_query spectrum="test.00010.00010.2" start_scan="10" end_scan="10" precursor_neutral_mass="945.4321" assumed_charge="2" index="1" retention_time_sec="123.4">
+ <search_result>
+  <search_hit hit_rank="1" peptide="PEPTMIDE" protein="PROT1" num_tot_proteins="2" calc_neutral_pep_mass="945.4300" massdiff="0.0021">
+   <alternative_protein protein="DECOY_PROT2"/>
+   <modification_info modified_peptide="PEPTM[147]IDE">
+    <mod_aminoacid_mass position="5" mass="147.035400" variable="15.994900"/>
+   </modification_info>
+   <search_score name="xcorr" value="3.5"/>
+   <search_score name="expect" value="1.2e-5"/>
+   <analysis_result analysis="peptideprophet">
+    <peptideprophet_result probability="0.9876"/>
+   </analysis_result>
+  </search_hit>
+  <search_hit hit_rank="2" peptide="PEPTCIDE" protein="DECOY_PROT3" calc_neutral_pep_mass="945.4400" massdiff="-0.0079">
+   <modification_info>
+    <mod_aminoacid_mass position="5" mass="160.030649"/>
+   </modification_info>
+   <search_score name="expect" value="3.0"/>
+  </search_hit>
+ </search_result>
+</spectrum_query>
+</msms_run_summary>
+</msms_pipeline_analysis>
+`
+
+func TestReader(t *testing.T) {
+	r := NewReader(strings.NewReader(testDoc))
+	ident, err := r.Next()
+	if err != nil {
+		t.Fatalf("Next: error return %v", err)
+	}
+	if ident.PepSeq != "PEPTMIDE" || ident.PepID != "PEPTM[147]IDE" ||
+		ident.Charge != 2 || ident.Rank != 1 || ident.Decoy ||
+		ident.RetentionTime != 123.4 || ident.SpecID != "scan=10" ||
+		ident.SpectraData != "test.mzML" {
+		t.Errorf("Unexpected identification %+v", ident)
+	}
+	if math.Abs(ident.ModMass-15.9949) > 1e-6 || len(ident.UnknownMods) != 0 {
+		t.Errorf("ModMass is %f (unknown %v), expected 15.9949", ident.ModMass, ident.UnknownMods)
+	}
+	if math.Abs(ident.CalculatedMz-473.722276) > 1e-6 {
+		t.Errorf("CalculatedMz is %f, expected 473.722276", ident.CalculatedMz)
+	}
+	if as := r.AnalysisSoftware(); len(as) != 1 || as[0].Name != "Comet" {
+		t.Errorf("AnalysisSoftware: got %+v, expected Comet", as)
+	}
+	expectedCv := map[string]string{
+		"MS:1002252":                 "3.5",
+		"MS:1002257":                 "1.2e-5",
+		"peptideprophet probability": "0.9876",
+	}
+	for _, cv := range ident.Cv {
+		key := cv.Accession
+		if key == "" {
+			key = cv.Name
+		}
+		if v, ok := expectedCv[key]; !ok || v != cv.Value {
+			t.Errorf("Unexpected score %+v", cv)
+		}
+		delete(expectedCv, key)
+	}
+	if len(expectedCv) != 0 {
+		t.Errorf("Missing scores %v", expectedCv)
+	}
+
+	ident, err = r.Next()
+	if err != nil {
+		t.Fatalf("Next: error return %v", err)
+	}
+	if ident.Rank != 2 || !ident.Decoy || len(ident.UnknownMods) != 1 {
+		t.Errorf("Unexpected identification %+v", ident)
+	}
+
+	_, err = r.Next()
+	if err != io.EOF {
+		t.Errorf("Expected io.EOF, got %v", err)
+	}
+
+	// With residue masses, the mass shift follows from the residue mass
+	r = NewReader(strings.NewReader(testDoc))
+	r.ResidueMass = map[rune]float64{'C': 103.009185}
+	r.DecoyPrefixes = []string{"XXX_"}
+	r.Next()
+	ident, err = r.Next()
+	if err != nil {
+		t.Fatalf("Next: error return %v", err)
+	}
+	if math.Abs(ident.ModMass-57.021464) > 1e-6 || len(ident.UnknownMods) != 0 || ident.Decoy {
+		t.Errorf("ModMass is %f (unknown %v, decoy %v), expected 57.021464 and no decoy",
+			ident.ModMass, ident.UnknownMods, ident.Decoy)
+	}
+}
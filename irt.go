@@ -0,0 +1,386 @@
+// This file contains the code for using iRT peptides as calibrants
+// (parameter -irt)
+
+package main
+
+import (
+	"bufio"
+	_ "embed"
+	"errors"
+	"io"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/524D/mzrecal/internal/chem"
+	"github.com/524D/mzrecal/internal/mzml"
+)
+
+// Name of the built-in iRT peptides for parameter -irt
+const irtBiognosys = `biognosys`
+
+// The Biognosys iRT kit peptides
+//
+//go:embed library/irt.tsv
+var biognosysIRT string
+
+// Minimum cosine similarity of the measured and theoretical isotope
+// pattern for detecting an iRT peptide without identification
+const irtMinPatternSimilarity = 0.95
+
+// Number of isotope peaks that are compared for detecting iRT peptides
+const irtNrIsotopes = 3
+
+// Half width of the retention time window of predicted iRT peptides,
+// in robust standard deviations of the iRT fit (see irtCalibrants)
+const irtWindowSDs = 3.0
+
+// Maximum difference (Da) between the modification masses of an
+// identified peptide and an iRT peptide with the same sequence, which
+// allows for rounding of the modification masses in identification files
+const irtModMassTol = 0.01
+
+// irtPeptide is a reference peptide with its iRT value
+type irtPeptide struct {
+	cals []identifiedCalibrant // Calibrant for each charge state
+	seq  string
+	mods string
+	irt  float64
+}
+
+// readIRTPeptides reads a tab or comma separated table of iRT peptides.
+// Lines starting with "#" are comments.
+// The first line contains the column names (case insensitive):
+//
+//	name      name of the peptide (required)
+//	sequence  peptide sequence (required)
+//	mods      modifications, as in the calibrant list (see readCalibrantList)
+//	charge    charge state(s), e.g. "2" or "2;3". If empty, the charge
+//	          states of parameter -charge are used.
+//	irt       iRT value (required)
+func readIRTPeptides(reader io.Reader) ([]irtPeptide, error) {
+	s := bufio.NewScanner(reader)
+	header := ``
+	lineNr := 1
+	for ; s.Scan(); lineNr++ {
+		if !strings.HasPrefix(s.Text(), `#`) {
+			header = strings.TrimRight(s.Text(), "\r")
+			break
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	sep := `,`
+	if strings.Contains(header, "\t") {
+		sep = "\t"
+	}
+	cols := make(map[string]int)
+	for i, name := range strings.Split(header, sep) {
+		cols[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range []string{`name`, `sequence`, `irt`} {
+		if _, ok := cols[name]; !ok {
+			return nil, errors.New(`iRT peptide list has no column "` + name + `"`)
+		}
+	}
+
+	var peps []irtPeptide
+	for lineNr++; s.Scan(); lineNr++ {
+		line := strings.TrimRight(s.Text(), "\r")
+		if strings.TrimSpace(line) == `` || strings.HasPrefix(line, `#`) {
+			continue
+		}
+		fields := strings.Split(line, sep)
+		field := func(name string) string {
+			i, ok := cols[name]
+			if !ok || i >= len(fields) {
+				return ``
+			}
+			return strings.TrimSpace(fields[i])
+		}
+		lineErr := func(msg string) error {
+			return errors.New(`iRT peptide list line ` + strconv.Itoa(lineNr) + `: ` + msg)
+		}
+
+		var pep irtPeptide
+		var err error
+		pep.seq = field(`sequence`)
+		pep.mods = field(`mods`)
+		pep.irt, err = strconv.ParseFloat(field(`irt`), 64)
+		if err != nil {
+			return nil, lineErr(`invalid iRT value`)
+		}
+		var cal identifiedCalibrant
+		cal.name = field(`name`)
+		cal.mass, err = calListMass(pep.seq, pep.mods, ``, ``)
+		if err != nil {
+			return nil, lineErr(err.Error())
+		}
+		charges, err := parseCharges(field(`charge`))
+		if err != nil {
+			return nil, lineErr(err.Error())
+		}
+		if len(charges) == 0 {
+			pep.cals = append(pep.cals, cal)
+		}
+		for _, charge := range charges {
+			cal.idCharge = charge
+			cal.identChargeOnly = true
+			pep.cals = append(pep.cals, cal)
+		}
+		peps = append(peps, pep)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return peps, nil
+}
+
+// readIRTSet reads the iRT peptides of parameter -irt
+func readIRTSet(irtSet string) ([]irtPeptide, error) {
+	if irtSet == irtBiognosys {
+		return readIRTPeptides(strings.NewReader(biognosysIRT))
+	}
+	f, err := os.Open(irtSet)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	peps, err := readIRTPeptides(f)
+	if err != nil {
+		return nil, errors.New(irtSet + `: ` + err.Error())
+	}
+	return peps, nil
+}
+
+// pepFormula returns the elemental formula of an unmodified peptide
+func pepFormula(pepSeq string) (chem.Formula, error) {
+	f := chem.MustParseFormula(`H2O`)
+	for _, aa := range strings.ToUpper(pepSeq) {
+		if aa == 'J' {
+			aa = 'L'
+		}
+		aaf, ok := aaFormula[aa]
+		if !ok {
+			return f, ErrInvalidResidue
+		}
+		f = f.Add(aaf, 1)
+	}
+	return f, nil
+}
+
+// identifiedIRT returns the retention time of an iRT peptide that is
+// also an identified calibrant, with the same sequence and modification
+// mass, or false if it wasn't identified
+func identifiedIRT(pep *irtPeptide, idCals []identifiedCalibrant) (float64, bool) {
+	var rts []float64
+	for _, cal := range idCals {
+		// For the same sequence, the difference of the masses is the
+		// difference of the modification masses
+		if strings.EqualFold(cal.pepSeq, pep.seq) &&
+			math.Abs(cal.mass-pep.cals[0].mass) <= irtModMassTol {
+			rt := cal.retentionTime
+			if cal.rtEnd > rt {
+				rt = (rt + cal.rtEnd) / 2
+			}
+			rts = append(rts, rt)
+		}
+	}
+	if len(rts) == 0 {
+		return 0.0, false
+	}
+	return median(rts), true
+}
+
+// irtIon is an m/z with isotope pattern to detect an iRT peptide
+type irtIon struct {
+	pepIdx    int                    // Index of the peptide
+	mz        [irtNrIsotopes]float64 // m/z of the isotope peaks
+	abundance [irtNrIsotopes]float64 // Theoretical abundance of the isotope peaks
+}
+
+// detectIRTPeptides finds the retention times of iRT peptides from
+// the MS1 spectra, by accurate mass and isotope pattern. The retention
+// time is that of the spectrum with the most intense monoisotopic peak
+// with the correct isotope pattern. Peptides that are not detected are
+// not in the returned map.
+func detectIRTPeptides(mzML *mzml.MzML, specs []ms1Spectrum, peps []irtPeptide,
+	pepIdxs []int, par params) (map[int]float64, error) {
+	var ions []irtIon
+	for _, i := range pepIdxs {
+		// Modified peptides can't be detected, their formula is unknown
+		if peps[i].mods != `` {
+			continue
+		}
+		f, err := pepFormula(peps[i].seq)
+		if err != nil {
+			continue
+		}
+		dist, err := f.IsotopeDistribution(irtNrIsotopes)
+		if err != nil {
+			return nil, err
+		}
+		for _, cal := range peps[i].cals {
+			charges := []int{cal.idCharge}
+			if !cal.identChargeOnly {
+				charges = nil
+				for charge := par.minCharge; charge <= par.maxCharge; charge++ {
+					charges = append(charges, charge)
+				}
+			}
+			for _, charge := range charges {
+				ion := irtIon{pepIdx: i}
+				z := float64(charge)
+				for k := range dist {
+					// Isotope peaks relative to the monoisotopic mass
+					ion.mz[k] = (cal.mass + dist[k].Mass - dist[0].Mass + z*chem.MassProton) / z
+					ion.abundance[k] = dist[k].Abundance
+				}
+				ions = append(ions, ion)
+			}
+		}
+	}
+
+	apexRT := make(map[int]float64)
+	apexIntens := make(map[int]float64)
+	for _, spec := range specs {
+		if spec.polarity < 0 {
+			continue
+		}
+		peaks, err := mzML.ReadScan(spec.idx)
+		if err != nil {
+			return nil, err
+		}
+		sort.Slice(peaks,
+			func(i, j int) bool { return peaks[i].Mz < peaks[j].Mz })
+		for _, ion := range ions {
+			var intens [irtNrIsotopes]float64
+			for k, mz := range ion.mz {
+				mzErr := *par.mzErrPPM * mz / 1000000.0
+				intens[k] = maxPeakInMzWindow(mz-mzErr, mz+mzErr, peaks).Intens
+			}
+			if intens[0] <= apexIntens[ion.pepIdx] ||
+				cosineSimilarity(intens[:], ion.abundance[:]) < irtMinPatternSimilarity {
+				continue
+			}
+			apexIntens[ion.pepIdx] = intens[0]
+			apexRT[ion.pepIdx] = spec.rt
+		}
+	}
+	return apexRT, nil
+}
+
+// cosineSimilarity returns the cosine of the angle between vectors a and b
+func cosineSimilarity(a, b []float64) float64 {
+	var ab, aa, bb float64
+	for i := range a {
+		ab += a[i] * b[i]
+		aa += a[i] * a[i]
+		bb += b[i] * b[i]
+	}
+	if aa == 0 || bb == 0 {
+		return 0
+	}
+	return ab / math.Sqrt(aa*bb)
+}
+
+// median returns the median of values. The slice is sorted in place.
+func median(values []float64) float64 {
+	sort.Float64s(values)
+	n := len(values)
+	if n%2 == 1 {
+		return values[n/2]
+	}
+	return (values[n/2-1] + values[n/2]) / 2
+}
+
+// theilSen fits y = intercept + slope*x by the Theil-Sen estimator:
+// the median of the slopes between all pairs of points. This is robust
+// against a few wrongly detected points.
+func theilSen(x, y []float64) (intercept float64, slope float64) {
+	var slopes []float64
+	for i := range x {
+		for j := i + 1; j < len(x); j++ {
+			if x[i] != x[j] {
+				slopes = append(slopes, (y[j]-y[i])/(x[j]-x[i]))
+			}
+		}
+	}
+	if len(slopes) == 0 {
+		return 0, 0
+	}
+	slope = median(slopes)
+	intercepts := make([]float64, len(x))
+	for i := range x {
+		intercepts[i] = y[i] - slope*x[i]
+	}
+	return median(intercepts), slope
+}
+
+// irtCalibrants returns calibrants for the iRT peptides of parameter -irt.
+// The retention times of the iRT peptides that were identified or
+// detected are used to fit iRT to retention time. The iRT peptides that
+// were not identified are used as calibrants in a window around their
+// predicted retention time. The half width of the window is parameter
+// -irtwindow, or irtWindowSDs robust standard deviations (1.4826 times
+// the median absolute deviation) of the residuals of the fit if that is
+// larger, so that a single wrongly detected peptide doesn't widen it.
+func irtCalibrants(mzML *mzml.MzML, specs []ms1Spectrum, idCals []identifiedCalibrant,
+	par params) ([]identifiedCalibrant, error) {
+	peps, err := readIRTSet(*par.irtSet)
+	if err != nil {
+		return nil, err
+	}
+	var irts, rts []float64
+	var notIdentified []int
+	for i := range peps {
+		if rt, ok := identifiedIRT(&peps[i], idCals); ok {
+			irts = append(irts, peps[i].irt)
+			rts = append(rts, rt)
+		} else {
+			notIdentified = append(notIdentified, i)
+		}
+	}
+	nrIdentified := len(irts)
+	detectedRT, err := detectIRTPeptides(mzML, specs, peps, notIdentified, par)
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range notIdentified {
+		if rt, ok := detectedRT[i]; ok {
+			irts = append(irts, peps[i].irt)
+			rts = append(rts, rt)
+		}
+	}
+	intercept, slope := theilSen(irts, rts)
+	if len(irts) < 2 || slope <= 0 {
+		if par.verbosity != infoSilent {
+			log.Printf("WARNING: %d iRT peptides found, which is too few to predict their retention times", len(irts))
+		}
+		return nil, nil
+	}
+	absResiduals := make([]float64, len(irts))
+	for i := range irts {
+		absResiduals[i] = math.Abs(rts[i] - intercept - slope*irts[i])
+	}
+	window := math.Max(*par.irtWindow, irtWindowSDs*1.4826*median(absResiduals))
+	if par.verbosity != infoSilent {
+		log.Printf("iRT fit from %d identified and %d detected peptides: RT = %.2f + %.3f * iRT (window %.1f s)",
+			nrIdentified, len(irts)-nrIdentified, intercept, slope, window)
+	}
+
+	var cals []identifiedCalibrant
+	for _, i := range notIdentified {
+		rt := intercept + slope*peps[i].irt
+		for _, cal := range peps[i].cals {
+			cal.retentionTime = rt - window
+			cal.rtEnd = rt + window
+			cals = append(cals, cal)
+		}
+	}
+	return cals, nil
+}
@@ -4,10 +4,13 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"math"
 	"os"
@@ -18,8 +21,14 @@ import (
 	"strings"
 	"time"
 
+	"github.com/524D/mzrecal/internal/chem"
+	"github.com/524D/mzrecal/internal/diareport"
+	"github.com/524D/mzrecal/internal/idxml"
+	"github.com/524D/mzrecal/internal/maxquant"
 	"github.com/524D/mzrecal/internal/mzidentml"
 	"github.com/524D/mzrecal/internal/mzml"
+	"github.com/524D/mzrecal/internal/mztab"
+	"github.com/524D/mzrecal/internal/pepxml"
 
 	"gonum.org/v1/gonum/optimize"
 	//	flag "github.com/spf13/pflag"
@@ -36,8 +45,9 @@ const outputFormatVersion = "1.0"
 
 // Peptides m/z values within mergeMzTol are merged
 const mergeMzTol = float64(1e-7)
-const massProton = float64(1.007276466879)
-const massH2O = float64(18.0105647)
+
+// Mass of water, added to the residue masses of a peptide
+var massH2O = chem.MustParseFormula(`H2O`).Mass()
 
 // CV parameters names
 const cvParamSelectedIonMz = `MS:1000744`
@@ -68,12 +78,22 @@ const (
 	infoVerbose
 )
 
+// Source of the theoretical mass of identified peptides
+type massSourceType int
+
+const (
+	massComputed massSourceType = iota // compute from sequence, fall back to reported
+	massReported                       // use search engine value, fall back to computed
+	massCheck                          // compute and compare with search engine value
+)
+
 // Command line parameters
 type params struct {
 	stage              *int // Compute recal parameters (1), recalibrate (2) or both (0)
 	mzMLFilename       *string
 	mzMLRecalFilename  *string
 	mzIdentMlFilename  *string
+	mzIdRecalFilename  *string  // Recalibrated mzIdentML output, empty for none
 	calFilename        *string  // Filename where JSON calibration parameters will be written
 	emptyNonCalibrated *bool    // Empty MS2 spectra for which the precursor was not recalibrated
 	minCal             *int     // minimum number of calibrants a spectrum should have to be recalibrated
@@ -97,15 +117,55 @@ type params struct {
 	args               []string // Additional values passed on the command line
 	debug              bool     // Enable debug info (environment variable MZRECAL_DEBUG=1)
 	acceptProfile      *bool    // Accept non-peak picked profile spectra
+	massSourceStr      *string  // Source of theoretical peptide mass as specified by user
+	massSource         massSourceType
+	massTolPPM         *float64 // max difference (ppm) between computed and reported mass
+	maxRank            *int     // max rank of PSMs to use as calibrant (0: all)
+	passThreshold      *bool    // Use only PSMs that pass the search engine threshold
+	targetOnly         *bool    // Don't use PSMs that only match decoy proteins
+	decoyPrefixStr     *string  // Prefixes of decoy proteins as specified by user
+	decoyPrefixes      []string
+	mqFixedModStr      *string // Fixed modifications of MaxQuant as specified by user
+	mqFixedMods        map[rune]float64
+	fdr                *float64 // Max q-value of PSMs to use as calibrant (0: use scoreFilter)
+	fdrScore           *string  // Score used to compute q-values
+	calListFilename    *string  // Tabular list of calibrants, empty for none
+	calRTRange         float64  // Largest retention time range of a calibrant
+	spectraDataStr     *string  // SpectraData of the mzML in the identification file
+	identFilenames     []string // Identification files, from mzIdentMlFilename
+	consensusStr       *string  // Consensus mode as specified by user
+	consensus          consensusMode
+	calLibrary         *string  // Calibrant libraries, "default" for the built-in library
+	discoverFrac       *float64 // Min fraction of MS1 spectra with a library ion (0: use all)
+	residueFilename    *string  // Table of residues that are added or replaced
+	labelStr           *string  // Isotope labels of residues as specified by user
+	residueLabels      []residueLabel
+	irtSet             *string  // iRT peptides, "biognosys" for the built-in set
+	irtWindow          *float64 // Min retention time window (s) of iRT calibrants
+	xicFrac            *float64 // Fraction of apex intensity at elution range boundaries (0: use rtWindow)
+	refMzMLFilename    *string  // mzML of the run of the identifications, empty for the recalibrated run
 }
 
-// Calibrant as read from mzid file (or build in), with uncharged mass
+// Calibrant as read from mzid file or calibrant library, with uncharged mass
 type identifiedCalibrant struct {
 	name          string
+	pepSeq        string  // Peptide sequence, empty if not a peptide
 	mass          float64 // Uncharged mass
 	retentionTime float64
 	idCharge      int  // Charge state at identification
 	singleCharged bool // true if only charge state 1 should be considered
+	// End of the retention time range in which the calibrant elutes,
+	// for calibrants that elute over a range starting at retentionTime
+	rtEnd float64
+	// true if only the charge state at identification should be
+	// considered, e.g. because the mass is specific for an adduct
+	identChargeOnly bool
+	// Polarity of the spectra in which the calibrant is used:
+	// 1 for positive, -1 for negative, 0 for any
+	polarity int
+	// true if retentionTime..rtEnd is the elution range traced in the
+	// XIC, which is used without the retention time window
+	xicRange bool
 }
 
 // m/z value for calibrant
@@ -151,100 +211,56 @@ type specRecalParams struct {
 	DebugInfo []specDebugInfo `json:",omitempty"`
 }
 
-type scoreRange struct {
-	minScore float64 // Minimum score to accept
-	maxScore float64 // Maximum score to accept
-	priority int     // Priority of the score, lowest is best
-}
-
-type scoreFilter map[string]scoreRange
-
 type mzRange struct {
 	min float64
 	max float64
 }
 
-var fixedCalibrants = []identifiedCalibrant{
-
-	// cyclosiloxanes, H6nC2nOnSin
-	{
-		name:          `cyclosiloxane6`,
-		mass:          444.1127481,
-		retentionTime: -math.MaxFloat64, // Indicates any retention time
-		idCharge:      1,
-		singleCharged: true,
-	},
-	{
-		name:          `cyclosiloxane7`,
-		mass:          518.1315394,
-		retentionTime: -math.MaxFloat64,
-		idCharge:      1,
-		singleCharged: true,
-	},
-	{
-		name:          `cyclosiloxane8`,
-		mass:          592.1503308,
-		retentionTime: -math.MaxFloat64,
-		idCharge:      1,
-		singleCharged: true,
-	},
-	{
-		name:          `cyclosiloxane9`,
-		mass:          666.1691221,
-		retentionTime: -math.MaxFloat64,
-		idCharge:      1,
-		singleCharged: true,
-	},
-	{
-		name:          `cyclosiloxane10`,
-		mass:          740.1879134,
-		retentionTime: -math.MaxFloat64,
-		idCharge:      1,
-		singleCharged: true,
-	},
-	{
-		name:          `cyclosiloxane11`,
-		mass:          814.2067048,
-		retentionTime: -math.MaxFloat64,
-		idCharge:      1,
-		singleCharged: true,
-	},
-	{
-		name:          `cyclosiloxane12`,
-		mass:          888.2254961,
-		retentionTime: -math.MaxFloat64,
-		idCharge:      1,
-		singleCharged: true,
-	},
+// Elemental formulas of amino acid residues (amino acids minus H2O)
+var residueFormulas = map[rune]string{
+	'A': `C3H5NO`,
+	'C': `C3H5NOS`,
+	'D': `C4H5NO3`,
+	'E': `C5H7NO3`,
+	'F': `C9H9NO`,
+	'G': `C2H3NO`,
+	'H': `C6H7N3O`,
+	'I': `C6H11NO`,
+	'K': `C6H12N2O`,
+	'L': `C6H11NO`,
+	'M': `C5H9NOS`,
+	'N': `C4H6N2O2`,
+	'P': `C5H7NO`,
+	'O': `C12H19N3O2`, // Pyrrolysine
+	'Q': `C5H8N2O2`,
+	'R': `C6H12N4O`,
+	'S': `C3H5NO2`,
+	'T': `C4H7NO2`,
+	'U': `C3H5NOSe`, // Selenocysteine
+	'V': `C5H9NO`,
+	'W': `C11H10N2O`,
+	'Y': `C9H9NO2`,
 }
 
-// Masses of amino acids (minus H2O)
-var aaMass = map[rune]float64{
-	'A': 71.0371138,
-	'C': 103.0091848,
-	'D': 115.0269430,
-	'E': 129.0425931,
-	'F': 147.0684139,
-	'G': 57.0214637,
-	'H': 137.0589119,
-	'I': 113.0840640,
-	'K': 128.0949630,
-	'L': 113.0840640,
-	'M': 131.0404849,
-	'N': 114.0429274,
-	'P': 97.0527638,
-	'O': 237.1477269, // Pyrrolysine
-	'Q': 128.0585775,
-	'R': 156.1011110,
-	'S': 87.0320284,
-	'T': 101.0476785,
-	'U': 144.9595902, // Selenocysteine
-	'V': 99.0684139,
-	'W': 186.0793129,
-	'Y': 163.0633285,
+// Formulas and masses of amino acid residues, from residueFormulas.
+// These can be changed by parameters -residues and -label.
+var aaFormula, aaMass = residueTable(residueFormulas)
+
+// residueTable computes the formulas and monoisotopic masses of amino
+// acid residues
+func residueTable(formulas map[rune]string) (map[rune]chem.Formula, map[rune]float64) {
+	fs := make(map[rune]chem.Formula, len(formulas))
+	masses := make(map[rune]float64, len(formulas))
+	for aa, formula := range formulas {
+		fs[aa] = chem.MustParseFormula(formula)
+		masses[aa] = fs[aa].Mass()
+	}
+	return fs, masses
 }
 
 var ErrRangeSpec = errors.New("invalid range specified")
+var ErrAmbiguousResidue = errors.New("ambiguous amino acid")
+var ErrInvalidResidue = errors.New("invalid amino acid")
 
 // Data processing steps to be added to mzML file
 var mzRecalProcessing mzml.DataProcessing = mzml.DataProcessing{
@@ -331,89 +347,501 @@ func parseFloat64Range(r string, min float64, max float64) (
 }
 
 // Compute the lowest isotope mass of the peptide
+// Lower case residues are accepted, and J (I or L) is resolved because
+// both have the same mass. B, Z and X have no unique mass, for those
+// ErrAmbiguousResidue is returned.
 func pepMass(pepSeq string) (float64, error) {
 	m := massH2O
-	for _, aa := range pepSeq {
+	for _, aa := range strings.ToUpper(pepSeq) {
+		if aa == 'J' {
+			aa = 'L'
+		}
 		aam, ok := aaMass[aa]
 		if !ok {
-			return 0.0, errors.New("invalid amino acid")
+			switch aa {
+			case 'B', 'Z', 'X':
+				return 0.0, ErrAmbiguousResidue
+			}
+			return 0.0, ErrInvalidResidue
 		}
 		m += aam
 	}
 	return m, nil
 }
 
-// This function creates a slice with potential calibrants
-// Calibrants are obtained from 2 sources:
-// - Identified peptides (from mzid file)
-// - Build-in list of fixed calibrants (cyclosiloxanes)
+// reportedMass returns the uncharged mass that corresponds to the
+// calculated m/z reported by the search engine. A negative charge means
+// a deprotonated ion.
+func reportedMass(ident *mzidentml.Identification) (float64, bool) {
+	if ident.CalculatedMz <= 0 || ident.Charge == 0 {
+		return 0.0, false
+	}
+	if ident.Charge < 0 {
+		return (ident.CalculatedMz + chem.MassProton) * float64(-ident.Charge), true
+	}
+	return (ident.CalculatedMz - chem.MassProton) * float64(ident.Charge), true
+}
+
+// massMismatch keeps track of identifications for which the computed
+// and reported mass disagree
+type massMismatch struct {
+	count    int
+	example  string
+	computed float64
+	reported float64
+}
+
+// identMass determines the uncharged mass of an identified peptide,
+// computed from the sequence and modifications and/or as reported by
+// the search engine, depending on par.massSource.
+// If the mass cannot be determined, ok is false.
+func identMass(ident *mzidentml.Identification, par params,
+	mismatch *massMismatch) (mass float64, ok bool) {
+	// For small molecules, only the reported m/z is known
+	if ident.PepSeq == `` {
+		return reportedMass(ident)
+	}
+	computed, err := pepMass(ident.PepSeq)
+	// If the mass of a modification is unknown, the computed mass is invalid
+	computedOK := err == nil && len(ident.UnknownMods) == 0
+	computed += ident.ModMass
+	reported, reportedOK := reportedMass(ident)
+
+	switch par.massSource {
+	case massReported:
+		if reportedOK {
+			return reported, true
+		}
+		return computed, computedOK
+	case massCheck:
+		if computedOK && reportedOK {
+			if math.Abs(computed-reported)/reported*1e6 > *par.massTolPPM {
+				if mismatch.count == 0 {
+					mismatch.example = ident.PepID
+					mismatch.computed = computed
+					mismatch.reported = reported
+				}
+				mismatch.count++
+				return 0.0, false
+			}
+			return computed, true
+		}
+	}
+	if computedOK {
+		return computed, true
+	}
+	return reported, reportedOK
+}
+
+// identSelected returns false if an identification must not be used
+// as calibrant because of its rank, threshold or decoy status
+func identSelected(ident *mzidentml.Identification, par params) bool {
+	if *par.maxRank > 0 && ident.Rank > *par.maxRank {
+		return false
+	}
+	if *par.passThreshold && !ident.PassThreshold {
+		return false
+	}
+	// With FDR filtering, decoys are needed to compute q-values,
+	// they are never used as calibrant in that case
+	if *par.targetOnly && ident.Decoy && *par.fdr <= 0 {
+		return false
+	}
+	return true
+}
+
+// identReader yields identifications one at a time, and returns io.EOF
+// when no more identifications are available
+type identReader interface {
+	Next() (mzidentml.Identification, error)
+}
+
+// The file formats for identifications that we can read
+type identFormatType int
+
+const (
+	identMzIdentML identFormatType = iota
+	identPepXML
+	identMzTab
+	identMaxQuant
+	identDIAReport
+	identIdXML
+	identTable // MaxQuant or DIA report, determined from the header
+)
+
+// identFormat determines the format of an identification file
+// from its file name. Tab separated tables (.txt or .tsv) can be of
+// several formats, see tableFormat.
+func identFormat(filename string) identFormatType {
+	name := strings.ToLower(filename)
+	switch {
+	case strings.HasSuffix(name, `.pep.xml`), strings.HasSuffix(name, `.pepxml`):
+		return identPepXML
+	case strings.HasSuffix(name, `.mztab`):
+		return identMzTab
+	case strings.HasSuffix(name, `.txt`), strings.HasSuffix(name, `.tsv`):
+		return identTable
+	case strings.HasSuffix(name, `.idxml`):
+		return identIdXML
+	}
+	return identMzIdentML
+}
+
+// Maximum length of the header line of a table for determining its format
+const maxTableHeaderLen = 1024 * 1024
+
+// tableFormat determines the format of a tab separated table of
+// identifications from its header line: MaxQuant if it has the
+// MaxQuant columns, otherwise a DIA report. The header is not
+// consumed from br.
+func tableFormat(br *bufio.Reader) identFormatType {
+	header, _ := br.Peek(maxTableHeaderLen)
+	if i := bytes.IndexByte(header, '\n'); i >= 0 {
+		header = header[:i]
+	}
+	if maxquant.IsMaxQuantHeader(string(header)) {
+		return identMaxQuant
+	}
+	return identDIAReport
+}
+
+// runName returns the name of the run of the mzML file, as used by
+// MaxQuant, DIA-NN and Spectronaut: the file name without directory and
+// extension of -spectradata, or else of the mzML file
+func runName(mzMLFilename string, par params) string {
+	if *par.spectraDataStr != `` {
+		return spectraStem(*par.spectraDataStr)
+	}
+	return spectraStem(mzMLFilename)
+}
+
+// newIdentReader returns a reader for the identifications in the file,
+// depending on the file format. For formats that contain identifications
+// of multiple runs, only those of mzMLFilename are read.
+func newIdentReader(r io.Reader, filename string, mzMLFilename string,
+	par params) identReader {
+	format := identFormat(filename)
+	if format == identTable {
+		br := bufio.NewReaderSize(r, maxTableHeaderLen)
+		format = tableFormat(br)
+		r = br
+	}
+	switch format {
+	case identPepXML:
+		pxr := pepxml.NewReader(r)
+		pxr.DecoyPrefixes = par.decoyPrefixes
+		pxr.ResidueMass = aaMass
+		return pxr
+	case identMzTab:
+		return mztab.NewReader(r)
+	case identMaxQuant:
+		mqr := maxquant.NewReader(r)
+		mqr.FixedMods = par.mqFixedMods
+		mqr.RawFile = runName(mzMLFilename, par)
+		return mqr
+	case identDIAReport:
+		drr := diareport.NewReader(r)
+		drr.Run = runName(mzMLFilename, par)
+		return drr
+	case identIdXML:
+		return idxml.NewReader(r)
+	}
+	return mzidentml.NewReader(r)
+}
+
+// This function creates a slice with potential calibrants from
+// identified peptides (from one or more mzid files)
 // Identified peptides are only used if they pass the score filter
+// and the consensus mode (for multiple files)
 // For each calibrant, it:
 // - computes the mass of the lightest isotope
 // - get the retention name, retentionTime, spectrum
-func makeCalibrantList(mzIdentML *mzidentml.MzIdentML, scoreFilt scoreFilter,
-	par params) ([]identifiedCalibrant, error) {
-	// Create slice for the number of calibrants that we expect to have
-	cals := make([]identifiedCalibrant, 0, mzIdentML.NumIdents()+len(fixedCalibrants))
-	for i := 0; i < mzIdentML.NumIdents(); i++ {
-		ident, err := mzIdentML.Ident(i)
+// Missing retention times are looked up in mzML (if not nil).
+func makeCalibrantList(identsList []identReader, mzML *mzml.MzML,
+	scoreFilt scoreFilter, par params) ([]identifiedCalibrant, error) {
+	var cals []identifiedCalibrant
+	var stats calibrantStats
+
+	// The identifications of multiple files are combined as soon as
+	// they are read
+	var passIdents []mzidentml.Identification
+	combiner := newPSMCombiner(mzML)
+	for _, idents := range identsList {
+		list, err := passingIdents(idents, mzML, scoreFilt, par)
 		if err != nil {
 			return nil, err
 		}
-		if ident.RetentionTime < 0 {
-			return nil, errors.New("no valid retention time for identification " + ident.PepID)
-		}
-		//		log.Printf("indent %+v\n", ident)
-		scoreOK := false
-		curPrio := math.MaxInt32
-		for _, cv := range ident.Cv {
-			// Check if the CV accession number or CV name matches scorefilter
-			filt, ok := scoreFilt[cv.Accession]
-			if !ok {
-				filt, ok = scoreFilt[cv.Name]
-			}
-			if ok {
-				if filt.priority < curPrio {
-					var score float64
-					score, err = strconv.ParseFloat(cv.Value, 64)
-					if err != nil {
-						return nil, errors.New("Invalid score value " + cv.Value)
-					}
-					scoreOK = score >= filt.minScore && score <= filt.maxScore
-				}
-			}
+		err = applyDeclaredLabels(idents, list, par)
+		if err != nil {
+			return nil, err
 		}
-		if scoreOK {
-			var cal identifiedCalibrant
-			m, err := pepMass(ident.PepSeq)
-			if err == nil { // Skip if mass cannot be computed
-				cal.name = ident.PepID
-				cal.retentionTime = ident.RetentionTime
-				cal.idCharge = ident.Charge
-				cal.singleCharged = false
-				cal.mass = m + ident.ModMass
-				cals = append(cals, cal)
-			}
-			//		} else {
-			//			log.Print(ident.PepID + " does not match score filter.")
+		if len(identsList) == 1 {
+			passIdents = list
+		} else {
+			combiner.add(list)
 		}
 	}
-	//	log.Print(len(cals), " of ", mzIdentML.NumIdents(), " identifications usable for calibration.")
+	if len(identsList) > 1 {
+		passIdents = combiner.combined(par.consensus)
+	}
+	for i := range passIdents {
+		cals = appendIdentCalibrant(cals, &passIdents[i], par, &stats)
+	}
+	cals = collapseCalibrants(cals, par.upRT-par.lowRT)
+	stats.logWarnings(par)
 	if len(cals) == 0 {
 		log.Print("No identified spectra will be used as calibrant. Is the specified scorefilter applicable for this file?")
 	}
-	cals = append(cals, fixedCalibrants...)
 	sort.Slice(cals,
 		func(i, j int) bool { return cals[i].retentionTime < cals[j].retentionTime })
 
 	return cals, nil
 }
 
-func calibsInRtWindows(rtMin, rtMax float64, allCals []identifiedCalibrant) ([]identifiedCalibrant, error) {
+// passingIdents returns the selected identifications that pass the
+// score filter, or the FDR threshold if specified
+func passingIdents(idents identReader, mzML *mzml.MzML,
+	scoreFilt scoreFilter, par params) ([]mzidentml.Identification, error) {
+	// The score filter is selected by the scores of all identifications,
+	// because not every identification needs to have all scores, and
+	// computing q-values needs all identifications. So these are read
+	// first.
+	var selIdents []mzidentml.Identification
+	for {
+		ident, err := nextSelectedIdent(idents, mzML, par)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		selIdents = append(selIdents, ident)
+	}
+	if len(selIdents) == 0 {
+		return nil, nil
+	}
+
+	var passIdents []mzidentml.Identification
+	if *par.fdr > 0 {
+		// With FDR filtering, q-values replace the score filter.
+		// Some formats specify the direction of their scores
+		sd, _ := idents.(scoreDirector)
+		qValues, err := identQValues(selIdents, sd, par)
+		if err != nil {
+			return nil, err
+		}
+		for i := range selIdents {
+			// Decoys are never used as calibrant
+			q, ok := qValues[i]
+			if ok && q <= *par.fdr && !selIdents[i].Decoy {
+				passIdents = append(passIdents, selIdents[i])
+			}
+		}
+		return passIdents, nil
+	}
+	// Each file can have its own default score filter
+	scoreFilt, err := checkScoreFilter(idents, identScores(selIdents), scoreFilt, par)
+	if err != nil {
+		return nil, err
+	}
+	for i := range selIdents {
+		scoreOK, err := scoreFilterPasses(&selIdents[i], scoreFilt)
+		if err != nil {
+			return nil, err
+		}
+		if scoreOK {
+			passIdents = append(passIdents, selIdents[i])
+		}
+	}
+	return passIdents, nil
+}
+
+// nextSelectedIdent returns the next identification that is selected
+// by rank, threshold and decoy status. At the end, io.EOF is returned.
+// If the identification has no retention time, it is taken from the
+// precursor MS1 spectrum of the identified spectrum in mzML.
+func nextSelectedIdent(idents identReader, mzML *mzml.MzML,
+	par params) (mzidentml.Identification, error) {
+	for {
+		ident, err := idents.Next()
+		if err != nil {
+			return ident, err
+		}
+		if !identSelected(&ident, par) {
+			continue
+		}
+		if ident.RetentionTime < 0 {
+			ident.RetentionTime = specRetentionTime(mzML, ident.SpecID)
+			if ident.RetentionTime < 0 {
+				return ident, errors.New("no valid retention time for identification " +
+					ident.PepID + " (spectrum " + ident.SpecID + ")")
+			}
+		}
+		return ident, nil
+	}
+}
+
+// specRetentionTime returns the retention time of the MS1 spectrum
+// in which the precursor of the spectrum with the given id (see
+// mzml.ScanIndex) was measured, or -1 if it can't be found
+func specRetentionTime(mzML *mzml.MzML, specID string) float64 {
+	if mzML == nil || specID == `` {
+		return -1
+	}
+	specIdx, err := mzML.ScanIndex(specID)
+	if err != nil {
+		return -1
+	}
+	ms1Idx, err := mzML.PrecursorScanIndex(specIdx)
+	if err != nil {
+		return -1
+	}
+	rt, err := mzML.RetentionTime(ms1Idx)
+	if err != nil {
+		return -1
+	}
+	return rt
+}
+
+// calibrantStats keeps track of identifications that could not be
+// used as calibrant, so that a summary can be reported
+type calibrantStats struct {
+	mismatch        massMismatch
+	unknownModCount int
+	unknownMods     map[string]bool // Names of the unknown modifications
+}
+
+// appendIdentCalibrant appends the identification to the list of
+// calibrants, if its mass can be determined
+func appendIdentCalibrant(cals []identifiedCalibrant,
+	ident *mzidentml.Identification, par params,
+	stats *calibrantStats) []identifiedCalibrant {
+	if len(ident.UnknownMods) > 0 {
+		if stats.unknownMods == nil {
+			stats.unknownMods = make(map[string]bool)
+		}
+		for _, mod := range ident.UnknownMods {
+			stats.unknownMods[mod] = true
+		}
+		stats.unknownModCount++
+	}
+	m, ok := identMass(ident, par, &stats.mismatch)
+	if !ok { // Skip if mass cannot be determined
+		return cals
+	}
+	var cal identifiedCalibrant
+	cal.name = ident.PepID
+	cal.pepSeq = ident.PepSeq
+	cal.retentionTime = ident.RetentionTime
+	cal.idCharge = ident.Charge
+	cal.singleCharged = false
+	cal.identChargeOnly = ident.Adduct != ``
+	cal.mass = m
+	if ident.Charge < 0 {
+		// Negative ions are used in negative mode spectra only, with
+		// a mass such that the usual m/z computation (see
+		// newChargedCalibrant) yields the m/z of the deprotonated ion
+		cal.idCharge = -ident.Charge
+		cal.identChargeOnly = true
+		cal.polarity = -1
+		cal.mass = m - 2*float64(cal.idCharge)*chem.MassProton
+	}
+	return append(cals, cal)
+}
+
+func (stats *calibrantStats) logWarnings(par params) {
+	if par.verbosity == infoSilent {
+		return
+	}
+	if stats.unknownModCount > 0 {
+		mods := make([]string, 0, len(stats.unknownMods))
+		for mod := range stats.unknownMods {
+			mods = append(mods, mod)
+		}
+		sort.Strings(mods)
+		log.Printf("WARNING: modification mass unknown for %d identifications, these are only used as calibrant if the search engine reports the mass (unknown modifications: %s)",
+			stats.unknownModCount, strings.Join(mods, `, `))
+	}
+	m := stats.mismatch
+	if m.count > 0 {
+		log.Printf("WARNING: computed and reported mass differ more than %g ppm for %d identifications, these are not used as calibrant (e.g. %s: computed %f, reported %f)",
+			*par.massTolPPM, m.count, m.example, m.computed, m.reported)
+	}
+}
+
+// collapseCalibrants combines calibrants with the same sequence, mass
+// (including modifications) and charge, e.g. repeated PSMs of an
+// abundant peptide, into calibrants that elute
+// over the range from the first to the last PSM. The retention time
+// window (parameter -rt) is applied around this range.
+// PSMs that are more than rtWindow apart are kept in separate ranges,
+// so that a calibrant is used for the same spectra as without
+// combining them.
+func collapseCalibrants(cals []identifiedCalibrant, rtWindow float64) []identifiedCalibrant {
+	type calKey struct {
+		pepSeq          string
+		mass            int64 // Mass in units of 1e-6 Da
+		idCharge        int
+		identChargeOnly bool
+		polarity        int
+	}
+	groups := make(map[calKey][]identifiedCalibrant)
+	var keys []calKey
+	for _, cal := range cals {
+		key := calKey{cal.pepSeq, int64(math.Round(cal.mass * 1e6)), cal.idCharge,
+			cal.identChargeOnly, cal.polarity}
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], cal)
+	}
+
+	collapsed := make([]identifiedCalibrant, 0, len(keys))
+	for _, key := range keys {
+		group := groups[key]
+		sort.Slice(group,
+			func(i, j int) bool { return group[i].retentionTime < group[j].retentionTime })
+		cal := group[0]
+		cal.rtEnd = cal.retentionTime
+		for _, next := range group[1:] {
+			if next.retentionTime-cal.rtEnd > rtWindow {
+				collapsed = append(collapsed, cal)
+				cal = next
+			}
+			cal.rtEnd = next.retentionTime
+		}
+		collapsed = append(collapsed, cal)
+	}
+	return collapsed
+}
+
+// calRTRange returns the largest retention time range of the calibrants
+func calRTRange(cals []identifiedCalibrant) float64 {
+	rtRange := 0.0
+	for _, cal := range cals {
+		if cal.retentionTime != -math.MaxFloat64 && cal.rtEnd-cal.retentionTime > rtRange {
+			rtRange = cal.rtEnd - cal.retentionTime
+		}
+	}
+	return rtRange
+}
+
+// calibsInRtWindows returns the calibrants that elute within the retention
+// time window lowRT..upRT around retention time rt of a spectrum, or, for
+// calibrants with an elution range traced in the XIC, within that range.
+// rtRange is the largest retention time range of a calibrant
+// (see calRTRange), needed to find calibrants that elute over a range.
+func calibsInRtWindows(rt, lowRT, upRT float64, rtRange float64,
+	allCals []identifiedCalibrant) ([]identifiedCalibrant, error) {
+	rtMin := rt + lowRT
+	rtMax := rt + upRT
 
 	// Find the indices of the calibrants within the retention time window
+	// Calibrants that start eluting before the window must be checked for
+	// the end of their elution range
+	i0 := sort.Search(len(allCals), func(i int) bool { return allCals[i].retentionTime >= math.Min(rtMin, rt)-rtRange })
 	i1 := sort.Search(len(allCals), func(i int) bool { return allCals[i].retentionTime >= rtMin })
-	i2 := sort.Search(len(allCals), func(i int) bool { return allCals[i].retentionTime > rtMax })
+	i2 := sort.Search(len(allCals), func(i int) bool { return allCals[i].retentionTime > math.Max(rtMax, rt) })
 
 	// Find calibrants that elute at all retention times
 	// These have elution time -math.MaxFloat64 and are located at the
@@ -423,13 +851,36 @@ func calibsInRtWindows(rtMin, rtMax float64, allCals []identifiedCalibrant) ([]i
 	for i3 = 0; i3 < len(allCals) && allCals[i3].retentionTime == -math.MaxFloat64; i3++ {
 	}
 
-	var cals = make([]identifiedCalibrant, 0, (i2-i1)+i3)
-	cals = append(cals, allCals[i1:i2]...)
+	var cals = make([]identifiedCalibrant, 0, max(i2-i1, 0)+i3)
+	for i := max(i0, i3); i < i2; i++ {
+		cal := &allCals[i]
+		switch {
+		case cal.xicRange:
+			if cal.retentionTime <= rt && cal.rtEnd >= rt {
+				cals = append(cals, *cal)
+			}
+		case cal.retentionTime <= rtMax && (i >= i1 || cal.rtEnd >= rtMin):
+			cals = append(cals, *cal)
+		}
+	}
 	cals = append(cals, allCals[0:i3]...)
 
 	return cals, nil
 }
 
+// calibsWithPolarity removes the calibrants of the other polarity.
+// The slice is modified in place.
+func calibsWithPolarity(cals []identifiedCalibrant, polarity int) []identifiedCalibrant {
+	n := 0
+	for _, cal := range cals {
+		if cal.polarity == 0 || cal.polarity == polarity {
+			cals[n] = cal
+			n++
+		}
+	}
+	return cals[:n]
+}
+
 // makeChargedCalibrants computes the m/z value for the calibrants
 // defines in parameter specCals for all selected charges states.
 // Equal m/z values (within numerical precision) are merged
@@ -443,7 +894,7 @@ func makeChargedCalibrants(specCals []identifiedCalibrant, par params) ([]calibr
 		if cal.singleCharged {
 			chargedCalibrants = append(chargedCalibrants, newChargedCalibrant(1, &specCals[j]))
 		} else {
-			if par.useIdentCharge {
+			if (par.useIdentCharge && cal.idCharge > 0) || cal.identChargeOnly {
 				chargedCalibrants = append(chargedCalibrants, newChargedCalibrant(cal.idCharge, &specCals[j]))
 			} else {
 				for charge := par.minCharge; charge <= par.maxCharge; charge++ {
@@ -486,7 +937,7 @@ func newChargedCalibrant(charge int, idCal *identifiedCalibrant) chargedCalibran
 	var chargedCal chargedCalibrant
 
 	fCharge := float64(charge)
-	chargedCal.mz = (idCal.mass + fCharge*massProton) / fCharge
+	chargedCal.mz = (idCal.mass + fCharge*chem.MassProton) / fCharge
 	chargedCal.idCal = idCal
 	chargedCal.charge = charge
 	return chargedCal
@@ -875,12 +1326,23 @@ func computeRecalSpec(mzML *mzml.MzML, idCals []identifiedCalibrant,
 
 	// Get the uncharged masses of potential calibrants in the retention
 	// time window
-	specCals, err := calibsInRtWindows(retentionTime+par.lowRT,
-		retentionTime+par.upRT, idCals)
+	specCals, err := calibsInRtWindows(retentionTime, par.lowRT, par.upRT,
+		par.calRTRange, idCals)
 	if err != nil {
 		return specRecalPar, err
 	}
 
+	// Only use calibrants of the polarity of the spectrum. If the
+	// polarity is unknown, positive mode is assumed.
+	polarity, err := mzML.Polarity(specIdx)
+	if err != nil {
+		return specRecalPar, err
+	}
+	if polarity == 0 {
+		polarity = 1
+	}
+	specCals = calibsWithPolarity(specCals, polarity)
+
 	// Get the m/z values of potential calibrants, merging equal values
 	calibrants, err := makeChargedCalibrants(specCals, par)
 	if err != nil {
@@ -1106,32 +1568,6 @@ func writeRecalMzML(mzML mzml.MzML, recal recalParams, par params) error {
 	return err
 }
 
-func parseScoreFilter(scoreFilterStr string) (scoreFilter, error) {
-	scoreFilt := make(scoreFilter)
-
-	re := regexp.MustCompile(`([^\(]+)\(([^\)]*)\)`)
-	matchedStringsList := re.FindAllStringSubmatch(scoreFilterStr, -1)
-	for n, matchedStrings := range matchedStringsList {
-
-		scoreName := matchedStrings[1]
-		scoreRangeStr := matchedStrings[2]
-		_, ok := scoreFilt[scoreName]
-		if ok {
-			return nil, errors.New(scoreName + ` defined more than once.`)
-		}
-		minScore, maxScore, err := parseFloat64Range(scoreRangeStr,
-			-math.MaxFloat64, math.MaxFloat64)
-
-		if err != nil {
-			return nil, errors.New(`Invalid range for score ` + scoreName)
-		}
-		scRange := scoreRange{minScore: minScore, maxScore: maxScore, priority: n}
-		scoreFilt[scoreName] = scRange
-	}
-
-	return scoreFilt, nil
-}
-
 type rtSpec struct {
 	rt   float64
 	spec int
@@ -1182,24 +1618,69 @@ func initRtMs1(mzML mzml.MzML) (rtSpecs, error) {
 	return rtOfMs1Specs, nil
 }
 
-func updatePrecursorMz(mzML mzml.MzML, recal recalParams, par params) (int, int, error) {
+// precursorRecal finds the recalibration parameters that apply to
+// the precursor of an MS2 spectrum
+type precursorRecal struct {
+	recal                recalParams
+	recalMethod          calibType
+	specIndex2recalIndex map[int]int
+	rtOfMs1Specs         rtSpecs
+}
 
-	var precursorsUpdated, precursorsTotal int
-	recalMethod, err := recalMethodStr2Int(recal.RecalMethod)
+func newPrecursorRecal(mzML mzml.MzML, recal recalParams) (*precursorRecal, error) {
+	var pr precursorRecal
+	var err error
+	pr.recal = recal
+	pr.recalMethod, err = recalMethodStr2Int(recal.RecalMethod)
 	if err != nil {
-		return 0, 0, err
+		return nil, err
 	}
 
 	// Make map to lookup recal parameters for a given spectrum index
-	specIndex2recalIndex := make(map[int]int)
+	pr.specIndex2recalIndex = make(map[int]int)
 	for i, specRecalPar := range recal.SpecRecalPar {
-		specIndex2recalIndex[specRecalPar.SpecIndex] = i
+		pr.specIndex2recalIndex[specRecalPar.SpecIndex] = i
+	}
+
+	pr.rtOfMs1Specs, err = initRtMs1(mzML)
+	if err != nil {
+		return nil, err
+	}
+	return &pr, nil
+}
+
+// ms1Params returns the recalibration parameters of the MS1 spectrum
+// that precedes MS2 spectrum specIdx, and the index of that MS1 spectrum.
+// If no parameters are available, p is nil.
+func (pr *precursorRecal) ms1Params(mzML mzml.MzML, specIdx int) (p []float64, ms1ScanIndex int, err error) {
+	// The precursor MS1 spectrum is the one for which we have recalibration
+	// Find the MS1 spectrum that belongs to this MS2, so that
+	// we can recalibrate the precursor mass of the MS2.
+	// We cannot use SpectrumRef to obtain the parent spectrum
+	// because it is not always present (i.e. SCIEX)
+	// therefore, we assume that previous (retention time wise) MS1 spectrum
+	// is the correct one.
+	rt, err := mzML.RetentionTime(specIdx)
+	if err != nil {
+		return nil, 0, err
 	}
+	ms1ScanIndex = findRtMs1(rt, pr.rtOfMs1Specs)
+	recalIndex, ok := pr.specIndex2recalIndex[ms1ScanIndex]
+	if !ok {
+		return nil, ms1ScanIndex, nil
+	}
+	return pr.recal.SpecRecalPar[recalIndex].P, ms1ScanIndex, nil
+}
 
-	rtOfMs1Specs, err := initRtMs1(mzML)
+func updatePrecursorMz(mzML mzml.MzML, recal recalParams, par params) (int, int, error) {
+
+	var precursorsUpdated, precursorsTotal int
+	pr, err := newPrecursorRecal(mzML, recal)
 	if err != nil {
 		return 0, 0, err
 	}
+	recalMethod := pr.recalMethod
+
 	numSpecs := mzML.NumSpecs()
 	for i := 0; i < numSpecs; i++ {
 		// Only update precursors for MS2
@@ -1210,32 +1691,22 @@ func updatePrecursorMz(mzML mzml.MzML, recal recalParams, par params) (int, int,
 		// Only update MS2 spectra spectra in requested range
 		if MSLevel == 2 && i >= par.minSpecIdx && i <= par.maxSpecIdx {
 			precursorsTotal++
-			// The precursor MS1 spectrum is the one for which we have recalibration
-			// Find the MS1 spectrum that belongs to this MS2, so that
-			// we can recalibrate the precursor mass of the MS2.
-			// We cannot use SpectrumRef to obtain the parent spectrum
-			// because it is not always present (i.e. SCIEX)
-			// therefore, we assume that previous (retention time wise) MS1 spectrum
-			// is the correct one.
-			rt, err := mzML.RetentionTime(i)
+			p, ms1ScanIndex, err := pr.ms1Params(mzML, i)
 			if err != nil {
 				return 0, 0, err
 			}
-			ms1ScanIndex := findRtMs1(rt, rtOfMs1Specs)
-
 			precursors, err := mzML.GetPrecursors(i)
 			if err != nil {
 				return 0, 0, err
 			}
 			for _, precursor := range precursors {
-				recalIndex, ok := specIndex2recalIndex[ms1ScanIndex]
-				if !ok {
+				if _, ok := pr.specIndex2recalIndex[ms1ScanIndex]; !ok {
 					log.Printf("Recalibration parameters missing for scanIndex %d)",
 						ms1ScanIndex)
 				}
-				if ok && recal.SpecRecalPar[recalIndex].P != nil {
-					recalIsolationWindow(&precursor, recalMethod, recal.SpecRecalPar[recalIndex].P, par, i)
-					if recalSelectedIons(&precursor, recalMethod, recal.SpecRecalPar[recalIndex].P, par, i, numSpecs) {
+				if p != nil {
+					recalIsolationWindow(&precursor, recalMethod, p, par, i)
+					if recalSelectedIons(&precursor, recalMethod, p, par, i, numSpecs) {
 						precursorsUpdated++
 					}
 				} else {
@@ -1251,6 +1722,79 @@ func updatePrecursorMz(mzML mzml.MzML, recal recalParams, par params) (int, int,
 	return precursorsTotal, precursorsUpdated, nil
 }
 
+// writeRecalMzIdentML writes a copy of the mzIdentML file in which
+// the experimental m/z of each PSM is recalibrated with the parameters
+// of its precursor MS1 spectrum. Only the PSMs of the recalibrated run
+// are changed, this run is selected as when reading the identifications
+// (see runFilter).
+func writeRecalMzIdentML(mzML mzml.MzML, recal recalParams, par params) (int, error) {
+	if identFormat(*par.mzIdentMlFilename) != identMzIdentML {
+		return 0, errors.New("writing recalibrated identifications requires mzIdentML input")
+	}
+	pr, err := newPrecursorRecal(mzML, recal)
+	if err != nil {
+		return 0, err
+	}
+	spectraData, err := readSpectraData(*par.mzIdentMlFilename)
+	if err != nil {
+		return 0, err
+	}
+	rf := newRunFilter(nil, *par.mzMLFilename, par)
+	// Warnings were given when the identifications were read
+	rf.verbosity = infoSilent
+	if err = rf.selectRun(spectraData); err != nil {
+		return 0, err
+	}
+	fIn, err := os.Open(*par.mzIdentMlFilename)
+	if err != nil {
+		return 0, err
+	}
+	defer fIn.Close()
+	fOut, err := os.Create(*par.mzIdRecalFilename)
+	if err != nil {
+		return 0, err
+	}
+	defer fOut.Close()
+
+	nrUpdated := 0
+	err = mzidentml.Rewrite(fIn, fOut,
+		func(spectraData string, spectrumID string, expMz float64) (float64, bool) {
+			if !rf.selected(spectraData) {
+				return 0, false
+			}
+			specIdx, err := mzML.ScanIndex(spectrumID)
+			if err != nil {
+				return 0, false
+			}
+			if specIdx < par.minSpecIdx || specIdx > par.maxSpecIdx {
+				return 0, false
+			}
+			p, _, err := pr.ms1Params(mzML, specIdx)
+			if err != nil || p == nil {
+				return 0, false
+			}
+			nrUpdated++
+			return mzRecal(expMz, pr.recalMethod, p), true
+		})
+	return nrUpdated, err
+}
+
+// readSpectraData returns the SpectraData listed in an mzIdentML file
+func readSpectraData(filename string) ([]mzidentml.SpectraData, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := mzidentml.NewReader(f)
+	// The SpectraData precede the first identification
+	_, err = r.Next()
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return r.SpectraData(), nil
+}
+
 func recalIsolationWindow(precursor *mzml.XMLprecursor, recalMethod calibType,
 	p []float64, par params, specNr int) {
 	isolationWindow := precursor.IsolationWindow
@@ -1385,55 +1929,188 @@ func calibMzML(par params, mzML mzml.MzML, recal recalParams) {
 	if par.verbosity == infoVerbose {
 		fmt.Fprintf(os.Stderr, "%s\n", time.Since(t))
 	}
+
+	if *par.mzIdRecalFilename != `` {
+		if par.verbosity == infoVerbose {
+			t = time.Now()
+			fmt.Fprintf(os.Stderr, "Writing recalibrated identifications: ")
+		}
+		nrUpdated, err := writeRecalMzIdentML(mzML, recal, par)
+		if err != nil {
+			log.Fatalf("writeRecalMzIdentML: error return %v", err)
+		}
+		if par.verbosity == infoVerbose {
+			fmt.Fprintf(os.Stderr, "%s\n", time.Since(t))
+		}
+		if par.verbosity != infoSilent {
+			fmt.Fprintf(os.Stderr, "Recalibrated PSMs: %d\n", nrUpdated)
+		}
+	}
 }
 
 func makeRecalCoefficients(par params) (mzML mzml.MzML, recal recalParams) {
-	scoreFilt, err := parseScoreFilter(*par.scoreFilter)
+	// Without -scorefilter, the filter is selected when the
+	// identifications are read
+	var scoreFilt scoreFilter
+	var err error
+	if *par.scoreFilter != "" {
+		scoreFilt, err = parseScoreFilter(*par.scoreFilter)
+		if err != nil {
+			log.Fatalf("Invalid parameter 'scoreFilter': %v", err)
+		}
+	}
+	err = setResidues(*par.residueFilename, par.residueLabels)
 	if err != nil {
-		log.Fatalf("Invalid parameter 'scoreFilter': %v", err)
+		log.Fatal("setResidues failed:", err)
 	}
 	t := time.Now()
 
+	// The MS data is read first, because it is used to find
+	// retention times that are missing in the identifications
 	if par.verbosity == infoVerbose {
-		fmt.Fprintf(os.Stderr, "Reading identifications from %s: ", *par.mzIdentMlFilename)
+		fmt.Fprintf(os.Stderr, "Reading MS data from %s: ", *par.mzMLFilename)
 	}
 
-	f1, err := os.Open(*par.mzIdentMlFilename)
+	f2, err := os.Open(*par.mzMLFilename)
 	if err != nil {
-		log.Fatalln(err.Error())
+		log.Fatalf("Open: mzMLfile %v", err)
 	}
-	defer f1.Close()
-	mzIdentML, err := mzidentml.Read(f1)
+	defer f2.Close()
+	mzML, err = mzml.Read(f2)
 	if err != nil {
-		log.Fatalf("mzidentml.Read: error return %v", err)
+		log.Fatalf("mzml.Read: error return %v", err)
 	}
-
-	if par.verbosity == infoVerbose {
-		fmt.Fprintf(os.Stderr, "%s\n", time.Since(t))
-		t = time.Now()
-		fmt.Fprintf(os.Stderr, "Creating initial calibrant list: ")
+	// The MS1 spectra are listed once for all steps that search
+	// calibrants in them
+	var ms1Specs []ms1Spectrum
+	if *par.refMzMLFilename != "" || *par.xicFrac > 0 || *par.irtSet != "" ||
+		*par.discoverFrac > 0 {
+		ms1Specs, err = ms1Spectra(&mzML)
+		if err != nil {
+			log.Fatal("ms1Spectra failed:", err)
+		}
 	}
 
-	idCals, err := makeCalibrantList(&mzIdentML, scoreFilt, par)
-	if err != nil {
-		log.Fatal("makeCalibrantList failed:", err)
+	// Identifications of a reference run refer to the spectra of that run
+	identMzMLFilename := *par.mzMLFilename
+	identMzML := &mzML
+	if *par.refMzMLFilename != "" {
+		if par.verbosity == infoVerbose {
+			fmt.Fprintf(os.Stderr, "%s\n", time.Since(t))
+			t = time.Now()
+			fmt.Fprintf(os.Stderr, "Reading reference MS data from %s: ", *par.refMzMLFilename)
+		}
+		f4, err := os.Open(*par.refMzMLFilename)
+		if err != nil {
+			log.Fatalf("Open: mzMLfile %v", err)
+		}
+		defer f4.Close()
+		refMzML, err := mzml.Read(f4)
+		if err != nil {
+			log.Fatalf("mzml.Read: error return %v", err)
+		}
+		identMzMLFilename = *par.refMzMLFilename
+		identMzML = &refMzML
 	}
 
-	if par.verbosity == infoVerbose {
-		fmt.Fprintf(os.Stderr, "%s\n", time.Since(t))
-		t = time.Now()
-		fmt.Fprintf(os.Stderr, "Reading MS data from %s: ", *par.mzMLFilename)
-	}
+	var idCals []identifiedCalibrant
+	if len(par.identFilenames) > 0 {
+		if par.verbosity == infoVerbose {
+			fmt.Fprintf(os.Stderr, "%s\n", time.Since(t))
+			t = time.Now()
+			fmt.Fprintf(os.Stderr, "Creating initial calibrant list from %s: ",
+				strings.Join(par.identFilenames, ", "))
+		}
 
-	f2, err := os.Open(*par.mzMLFilename)
-	if err != nil {
-		log.Fatalf("Open: mzMLfile %v", err)
+		var identsList []identReader
+		for _, identFilename := range par.identFilenames {
+			f1, err := os.Open(identFilename)
+			if err != nil {
+				log.Fatalln(err.Error())
+			}
+			defer f1.Close()
+			// Identifications are streamed from the file while creating
+			// the calibrant list
+			// Files with multiple runs only contribute the identifications
+			// of the mzML file
+			identsList = append(identsList, newRunFilter(newIdentReader(f1,
+				identFilename, identMzMLFilename, par), identMzMLFilename, par))
+		}
+		idCals, err = makeCalibrantList(identsList, identMzML, scoreFilt, par)
+		if err != nil {
+			log.Fatal("makeCalibrantList failed:", err)
+		}
+		if *par.refMzMLFilename != "" {
+			if par.verbosity == infoVerbose {
+				fmt.Fprintf(os.Stderr, "%s\n", time.Since(t))
+				t = time.Now()
+				fmt.Fprintf(os.Stderr, "Aligning retention times to reference run: ")
+			}
+			err = alignCalibrants(identMzML, &mzML, ms1Specs, idCals, par)
+			if err != nil {
+				log.Fatal("alignCalibrants failed:", err)
+			}
+		}
 	}
-	defer f2.Close()
-	mzML, err = mzml.Read(f2)
+	if *par.xicFrac > 0 && len(idCals) > 0 {
+		if par.verbosity == infoVerbose {
+			fmt.Fprintf(os.Stderr, "%s\n", time.Since(t))
+			t = time.Now()
+			fmt.Fprintf(os.Stderr, "Tracing calibrant elution ranges: ")
+		}
+		err = traceElution(&mzML, ms1Specs, idCals, par)
+		if err != nil {
+			log.Fatal("traceElution failed:", err)
+		}
+	}
+	if *par.irtSet != "" {
+		if par.verbosity == infoVerbose {
+			fmt.Fprintf(os.Stderr, "%s\n", time.Since(t))
+			t = time.Now()
+			fmt.Fprintf(os.Stderr, "Finding iRT peptides: ")
+		}
+		irtCals, err := irtCalibrants(&mzML, ms1Specs, idCals, par)
+		if err != nil {
+			log.Fatal("irtCalibrants failed:", err)
+		}
+		idCals = append(idCals, irtCals...)
+	}
+	libCals, err := readCalibrantLibraries(*par.calLibrary)
 	if err != nil {
-		log.Fatalf("mzml.Read: error return %v", err)
+		log.Fatal("readCalibrantLibraries failed:", err)
 	}
+	if *par.discoverFrac > 0 && len(libCals) > 0 {
+		if par.verbosity == infoVerbose {
+			fmt.Fprintf(os.Stderr, "%s\n", time.Since(t))
+			t = time.Now()
+			fmt.Fprintf(os.Stderr, "Discovering background ions: ")
+		}
+		libCals, err = discoverBackgroundIons(&mzML, ms1Specs, libCals, par)
+		if err != nil {
+			log.Fatal("discoverBackgroundIons failed:", err)
+		}
+	}
+	idCals = append(idCals, libCals...)
+	if *par.calListFilename != "" {
+		if par.verbosity == infoVerbose {
+			fmt.Fprintf(os.Stderr, "%s\n", time.Since(t))
+			t = time.Now()
+			fmt.Fprintf(os.Stderr, "Reading calibrant list from %s: ", *par.calListFilename)
+		}
+		f3, err := os.Open(*par.calListFilename)
+		if err != nil {
+			log.Fatalln(err.Error())
+		}
+		defer f3.Close()
+		listCals, err := readCalibrantList(f3, scoreFilt)
+		if err != nil {
+			log.Fatal("readCalibrantList failed:", err)
+		}
+		idCals = append(idCals, listCals...)
+	}
+	sort.Slice(idCals,
+		func(i, j int) bool { return idCals[i].retentionTime < idCals[j].retentionTime })
+	par.calRTRange = calRTRange(idCals)
 
 	if par.verbosity == infoVerbose {
 		fmt.Fprintf(os.Stderr, "%s\n", time.Since(t))
@@ -1480,8 +2157,82 @@ Type %s --help for usage
 	var extension = filepath.Ext(mzml)
 	var startName = mzml[0 : len(mzml)-len(extension)]
 
-	if *par.mzIdentMlFilename == "" {
-		*par.mzIdentMlFilename = startName + ".mzid"
+	// Identifications are optional if a calibrant list is specified.
+	// By default, they are from the reference run if specified.
+	identStartName := startName
+	if *par.refMzMLFilename != "" {
+		refName := *par.refMzMLFilename
+		identStartName = refName[0 : len(refName)-len(filepath.Ext(refName))]
+	}
+	if *par.mzIdentMlFilename == "" && *par.calListFilename == "" {
+		*par.mzIdentMlFilename = identStartName + ".mzid"
+	}
+	if *par.mzIdentMlFilename != "" {
+		par.identFilenames = splitFilenames(*par.mzIdentMlFilename)
+	}
+	if len(par.identFilenames) > maxIdentFiles {
+		fmt.Fprintf(os.Stderr, `Parameter 'mzid' has more than %d files.
+Type %s --help for usage
+`, maxIdentFiles, exeName)
+		os.Exit(2)
+	}
+	if *par.mzIdRecalFilename != "" && len(par.identFilenames) != 1 {
+		fmt.Fprintf(os.Stderr, `Parameter 'mzidout' requires parameter 'mzid' with a single file.
+Type %s --help for usage
+`, exeName)
+		os.Exit(2)
+	}
+	if *par.mzIdRecalFilename != "" && *par.refMzMLFilename != "" {
+		fmt.Fprintf(os.Stderr, `Parameter 'mzidout' can't be used with parameter 'refmzml'.
+Type %s --help for usage
+`, exeName)
+		os.Exit(2)
+	}
+	par.decoyPrefixes = nil
+	for _, prefix := range strings.Split(*par.decoyPrefixStr, ",") {
+		if prefix = strings.TrimSpace(prefix); prefix != "" {
+			par.decoyPrefixes = append(par.decoyPrefixes, prefix)
+		}
+	}
+	var err error
+	par.consensus, err = parseConsensusMode(*par.consensusStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, `Invalid value for parameter 'consensus'.
+Type %s --help for usage
+`, exeName)
+		os.Exit(2)
+	}
+	if *par.xicFrac < 0 || *par.xicFrac >= 1 {
+		fmt.Fprintf(os.Stderr, `Parameter 'xic' must be at least 0 and less than 1.
+Type %s --help for usage
+`, exeName)
+		os.Exit(2)
+	}
+	if *par.irtWindow < 0 {
+		fmt.Fprintf(os.Stderr, `Parameter 'irtwindow' must not be negative.
+Type %s --help for usage
+`, exeName)
+		os.Exit(2)
+	}
+	par.mqFixedMods, err = maxquant.ParseFixedMods(*par.mqFixedModStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, `Invalid value for parameter 'mqfixedmods': %v
+Type %s --help for usage
+`, err, exeName)
+		os.Exit(2)
+	}
+	par.residueLabels, err = parseLabels(*par.labelStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, `Invalid value for parameter 'label': %v
+Type %s --help for usage
+`, err, exeName)
+		os.Exit(2)
+	}
+	if *par.discoverFrac < 0 || *par.discoverFrac > 1 {
+		fmt.Fprintf(os.Stderr, `Parameter 'discover' must be between 0 and 1.
+Type %s --help for usage
+`, exeName)
+		os.Exit(2)
 	}
 	if *par.calFilename == "" {
 		*par.calFilename = startName + "-recal.json"
@@ -1490,7 +2241,6 @@ Type %s --help for usage
 		*par.mzMLRecalFilename = startName + "-recal.mzML"
 	}
 
-	var err error
 	par.lowRT, par.upRT, err = parseFloat64Range(*par.rtWindow,
 		-math.MaxFloat64, math.MaxFloat64)
 	if err != nil {
@@ -1501,6 +2251,8 @@ Type %s --help for usage
 	}
 	if *par.charge == `ident` {
 		par.useIdentCharge = true
+		// Used for calibrants without charge at identification
+		par.minCharge, par.maxCharge = 1, 5
 	} else {
 		par.minCharge, par.maxCharge, err = parseIntRange(*par.charge,
 			1, 5)
@@ -1511,6 +2263,19 @@ Type %s --help for usage
 			os.Exit(2)
 		}
 	}
+	switch strings.ToLower(*par.massSourceStr) {
+	case `computed`:
+		par.massSource = massComputed
+	case `reported`:
+		par.massSource = massReported
+	case `check`:
+		par.massSource = massCheck
+	default:
+		fmt.Fprintf(os.Stderr, `Invalid value for parameter 'mass'.
+Type %s --help for usage
+`, exeName)
+		os.Exit(2)
+	}
 	par.minSpecIdx, par.maxSpecIdx, err = parseIntRange(*par.specFilter,
 		0, math.MaxInt32)
 	if err != nil {
@@ -1547,13 +2312,23 @@ OPTIONS:
 BUILD-IN CALIBRANTS:
   In addition to the identified peptides, %s will also use
   for recalibration a number of compounds that are commonly found in many
-  samples. These compound are all assumed to have +1 charge. The following
-  list shows the build-in compounds with their (uncharged) masses:
+  samples (parameter -lib). The following list shows the ions of the
+  default library with their m/z:
 `, exeName)
 
-	for _, cal := range fixedCalibrants {
-		fmt.Fprintf(os.Stderr, "     %s (%f)\n", cal.name, cal.mass)
+	libCals, err := readCalibrantLibraries(defaultLibraryName)
+	if err != nil {
+		log.Fatal("readCalibrantLibraries failed:", err)
+	}
+	for _, cal := range libCals {
+		fmt.Fprintf(os.Stderr, "     %s (m/z %f, charge %d)\n", cal.name,
+			newChargedCalibrant(cal.idCharge, &cal).mz, cal.idCharge)
 	}
+	fmt.Fprintf(os.Stderr, `  Other background ions (larger cyclosiloxanes, polyethylene and
+  polypropylene glycols, phthalates and fatty acid amides) are added
+  by -lib %s,%s, trypsin autolysis and keratin peptides
+  by -lib %s,%s.
+`, defaultLibraryName, contaminantLibraryName, defaultLibraryName, peptideLibraryName)
 
 	fmt.Fprintf(os.Stderr,
 		`
@@ -1599,7 +2374,117 @@ Valid function names:
 		"`filename` of recalibrated mzML")
 	par.mzIdentMlFilename = flag.String("mzid",
 		"",
-		"mzIdentMl `filename`")
+		"`filename`"+` of identifications. The format is determined by the
+file extension: .pep.xml or .pepXML for pepXML, .mzTab for mzTab
+(1.0 or mzTab-M), .txt or .tsv for tab separated tables, .idXML for
+OpenMS idXML, otherwise mzIdentML. Tables with MaxQuant columns are read
+as MaxQuant msms.txt or evidence.txt (only rows whose "Raw file" matches
+the mzML file name are used), others as DIA-NN or Spectronaut reports
+(only rows of the run that matches the mzML file name are used).
+If the file contains identifications of multiple runs (SpectraData), only
+those of the run that matches the mzML file name are used.
+Multiple files (e.g. of different search engines) can be specified
+separated by commas, these are combined as specified by -consensus.
+Existing files whose name contains a comma are recognized as one file.`)
+	par.mqFixedModStr = flag.String("mqfixedmods",
+		maxquant.DefaultFixedMods,
+		"fixed `modifications`"+` of MaxQuant identifications, which MaxQuant
+doesn't include in the modified sequence. Modifications are separated
+by ";", each a UNIMOD name or mass shift followed by the residues, e.g.
+"Carbamidomethyl:C;Dimethyl:K". Use an empty string for none.`)
+	par.consensusStr = flag.String("consensus",
+		"union",
+		"`mode`"+` for combining the identifications of multiple -mzid files:
+    union: use PSMs that pass the score filter in any file
+    intersection: use PSMs (same spectrum, peptide and charge) that pass
+        the score filter in all files
+    agree: use PSMs of spectra that are identified by at least two files,
+        which all report the same peptide and charge`)
+	par.spectraDataStr = flag.String("spectradata",
+		"",
+		"`location`"+` or name of the SpectraData (spectra file) in the
+identification file that corresponds to the mzML file, or for MaxQuant
+tables and DIA reports the name of the run (raw file). If empty (default),
+the run with the same file name (without extension) as the mzML file is
+used.`)
+	par.refMzMLFilename = flag.String("refmzml",
+		"",
+		"mzML `filename`"+` of the reference run in which the identifications
+(-mzid) were made, e.g. a replicate of a run that was not searched.
+The retention times of the identified calibrants are aligned to the
+recalibrated run by their extracted ion chromatograms in both runs.
+If empty (default), the identifications are of the recalibrated run.`)
+	par.calListFilename = flag.String("callist",
+		"",
+		"`filename`"+` of a tab or comma separated list of calibrants, used in
+addition to the identifications. If specified without -mzid, only the
+calibrant list is used. The first line contains the column names:
+  name      name of the calibrant (required)
+  sequence  peptide sequence, with optional column mods: modifications
+            separated by ";" (UNIMOD/PSI-MOD accession, name, mass shift
+            or formula of the mass shift, e.g. "H-2O-1")
+  formula   elemental formula, e.g. "C6H12O6". Isotopes are written in
+            brackets, e.g. "C4[13C]2H12O6", repeated groups in
+            parentheses, e.g. "H(C2H4O)5OH".
+  mass      uncharged monoisotopic mass
+  charge    charge state(s), e.g. "2", "1;2" or "1:3". If empty, -charge
+            is used.
+  rt        retention time (s) or range, e.g. "600" or "600:660". If empty,
+            the calibrant is used at all retention times.
+  score     score, filtered with -scorefilter 'score(<min>:<max>)'`)
+	par.calLibrary = flag.String("lib",
+		defaultLibraryName,
+		"`filenames`"+` of calibrant libraries, separated by commas. A library has
+the format of -callist, with additional columns:
+  adducts   ion forms, separated by ";", e.g. "[M+H]+;[M+Na]+;[2M+NH4]+".
+            These replace column charge.
+  polarity  "+" or "-": only use the calibrant in spectra of this polarity.
+            Negative ions must be specified by adducts.
+Built-in libraries, used at all retention times:
+  default       cyclosiloxanes 6-12 (listed below)
+  contaminants  other common LC-MS background ions
+  peptides      trypsin autolysis and keratin peptides
+Use e.g. "default,contaminants" or "default,spikes.tsv" to extend the
+default, and an empty string for no library calibrants.`)
+	par.irtSet = flag.String("irt",
+		"",
+		`iRT peptides that are spiked in the sample: "`+irtBiognosys+`" for the Biognosys
+iRT kit, or the `+"`filename`"+` of a tab or comma separated list with columns
+name, sequence, mods, charge (as in -callist) and irt. Other iRT sets,
+e.g. PROCAL, are not built in and must be given as such a list.
+The retention times of the iRT peptides that are identified, or detected
+by accurate mass and isotope pattern, are used to predict the retention
+times of the other iRT peptides, which are then used as calibrants.`)
+	par.irtWindow = flag.Float64("irtwindow",
+		60,
+		"half width of the retention time `window`"+` (s) in which predicted iRT
+peptides are used as calibrants. It is increased to three robust standard
+deviations of the iRT fit if that is larger.`)
+	par.residueFilename = flag.String("residues",
+		"",
+		"`filename`"+` of a tab or comma separated table of amino acid residues,
+which are added or replace the standard residues, e.g. for non-canonical
+amino acids. The first line contains the column names:
+  residue   one letter code (required)
+  formula   elemental formula of the residue (amino acid minus H2O)
+  mass      monoisotopic mass of the residue, if formula is empty`)
+	par.labelStr = flag.String("label",
+		"",
+		"isotope `labels`"+` of residues, separated by ";". A label is written
+as in UNIMOD label names, optionally followed by the labeled residues,
+e.g. "15N" for 15N on all residues, or "13C(6)15N(2):K;13C(6)15N(4):R" for
+SILAC heavy lysine and arginine. Fixed labels in the search modifications
+of mzIdentML files are detected and applied automatically.`)
+	par.discoverFrac = flag.Float64("discover",
+		0,
+		`only use the library ions that are found in at least this `+"`fraction`"+`
+of the MS1 spectra, with stable m/z (standard deviation of the m/z error
+less than a third of -ppmuncal). The discovered ions are reported and
+used at all retention times. 0 uses all library ions.`)
+	par.mzIdRecalFilename = flag.String("mzidout",
+		"",
+		"`filename`"+` of mzIdentML output with recalibrated experimental m/z.
+If empty (default), no mzIdentML file is written.`)
 	par.calFilename = flag.String("cal",
 		"",
 		"`filename` for output of computed calibration parameters")
@@ -1622,6 +2507,11 @@ peaks are considered for computing the recalibration. <1 means all peaks.`)
 	par.rtWindow = flag.String("rt",
 		"-10.0:10.0",
 		"rt window `range`(s)")
+	par.xicFrac = flag.Float64("xic",
+		0,
+		`0 (default): use identified calibrants in the -rt window around their
+identifications. Otherwise, use them in their elution range, traced in
+the MS1 spectra down to this `+"`fraction`"+` of the apex intensity.`)
 	par.mzErrPPM = flag.Float64("ppmuncal",
 		10.0,
 		`max mz error (ppm) for trying to use calibrant for calibration`)
@@ -1631,22 +2521,67 @@ peaks are considered for computing the recalibration. <1 means all peaks.`)
    the rest is accepted.
 > 0: max mz error (ppm) for accepting a calibrant for calibration`)
 	par.scoreFilter = flag.String("scorefilter",
-		"MS:1002257(0.0:1e-2)MS:1001330(0.0:1e-2)MS:1001159(0.0:1e-2)MS:1002466(0.99:)MS:1002319(50:)MS:1001331(40:)",
-		`filter for PSM scores to accept. Format:
+		"",
+		`filter for PSMs to accept. The filter is a list of scores with ranges:
 <CVterm1|scorename1>([<minscore1>]:[<maxscore1>])...
 When multiple score names/CV terms are specified, the first one on the list
 that matches a score in the input file will be used.
-The default contains reasonable values for some common search engines
-and post-search scoring software:
-  MS:1002257 (Comet:expectation value)
-  MS:1001330 (X!Tandem:expectation value)
-  MS:1001159 (SEQUEST:expectation value)
-  MS:1002466 (PeptideShaker PSM score)
- `)
+Lists and comparisons can be combined with AND, OR, NOT and parentheses,
+e.g. 'MS:1002257 < 0.01 AND (charge >= 2 OR NOT modified)'.
+Comparisons (<, <=, >, >=, =, !=) are made with a score (CV term or name,
+quoted if it contains spaces) or a PSM field: charge, length (peptide
+length), rank or modmass (mass shift of modifications). "modified" is
+true for modified peptides. A comparison with a missing score is false.
+If empty (default), a filter is selected for the software that produced
+the identifications (Percolator, PeptideShaker, MS-GF+, Mascot, Andromeda,
+DIA-NN, Spectronaut, Sage, MSFragger, Comet or X!Tandem), or else for the
+scores that are present. The selected filter is printed. If none of the scores of the
+filter is present in the identifications, mzRecal stops with an error.`)
+	par.fdr = flag.Float64("fdr",
+		0.0,
+		`max q-value of PSMs to accept (e.g. 0.01). If > 0, this replaces
+-scorefilter. Q-values are taken from the input file if present, otherwise
+they are computed by target-decoy competition of rank 1 PSMs.`)
+	par.fdrScore = flag.String("fdrscore",
+		"",
+		"`score`"+` (CV term or name) used to compute q-values for -fdr, with
+optional direction: <CVterm|scorename>[:higher|:lower]. If empty,
+q-values in the file or a known search engine score are used.`)
 	par.charge = flag.String("charge",
 		"1:5",
 		"charge `range`"+` of calibrants, or the string "ident". If set to "ident",
 only the charge as found in the mzIdentMl file will be used for calibration.`)
+	par.massSourceStr = flag.String("mass",
+		"computed",
+		"`source`"+` of the theoretical mass of identified peptides:
+    computed: compute from sequence and modifications. If the sequence
+        contains ambiguous residues (B, Z, X), use the mass reported
+        by the search engine (calculatedMassToCharge)
+    reported: use the mass reported by the search engine, if absent
+        compute from sequence and modifications
+    check: compute from sequence and modifications, and skip
+        identifications for which the reported mass differs more than
+        <masstol> ppm
+Modification masses that are absent from the identification file are
+looked up in a built-in table of common UNIMOD and PSI-MOD modifications.
+This table is not complete: identifications with other modifications
+are only used as calibrant if the search engine reports their mass (a
+warning lists the unknown modifications).`)
+	par.massTolPPM = flag.Float64("masstol",
+		1.0,
+		`max difference (ppm) between computed and reported mass for -mass check`)
+	par.maxRank = flag.Int("maxrank",
+		0,
+		`only use PSMs with this rank or better as calibrant (e.g. 1 for only
+the best PSM of each spectrum). 0 (default) means all ranks.`)
+	par.passThreshold = flag.Bool("passthreshold", false,
+		`only use PSMs for which the search engine reports passThreshold="true"`)
+	par.targetOnly = flag.Bool("targetonly", false,
+		`don't use PSMs that only match decoy proteins`)
+	par.decoyPrefixStr = flag.String("decoyprefix",
+		strings.Join(pepxml.DefaultDecoyPrefixes, ","),
+		"comma separated `prefixes`"+` of decoy protein accessions, for
+identification files that don't mark decoys (pepXML)`)
 	par.specFilter = flag.String("specfilter",
 		"",
 		"`range`"+` of spectrum indices to calibrate (e.g. 1000:2000).
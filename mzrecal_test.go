@@ -1,7 +1,10 @@
 package main
 
 import (
+	"bufio"
 	"compress/gzip"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"io"
@@ -9,8 +12,13 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
 
+	"github.com/524D/mzrecal/internal/chem"
+	"github.com/524D/mzrecal/internal/mzidentml"
+	"github.com/524D/mzrecal/internal/mzml"
 	"github.com/google/go-cmp/cmp"
 )
 
@@ -115,6 +123,247 @@ func TestParseFloat64Range(t *testing.T) {
 	}
 }
 
+func TestPepMass(t *testing.T) {
+	// Lower case and J (I or L) must resolve to the same mass
+	m1, err := pepMass("PEPTIDEL")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	m2, err := pepMass("peptidej")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if m1 != m2 {
+		t.Errorf("Expected equal masses, got: %f and %f", m1, m2)
+	}
+
+	// Ambiguous residues
+	for _, seq := range []string{"PEPBIDE", "PEPZIDE", "PEPXIDE"} {
+		_, err = pepMass(seq)
+		if !errors.Is(err, ErrAmbiguousResidue) {
+			t.Errorf("%s: expected error: %v, got: %v", seq, ErrAmbiguousResidue, err)
+		}
+	}
+	_, err = pepMass("PEP1")
+	if !errors.Is(err, ErrInvalidResidue) {
+		t.Errorf("Expected error: %v, got: %v", ErrInvalidResidue, err)
+	}
+}
+
+func TestIdentMass(t *testing.T) {
+	tol := 1.0
+	par := params{massTolPPM: &tol}
+	computed, _ := pepMass("PEPTIDE")
+	ident := mzidentml.Identification{
+		PepSeq:       "PEPTIDE",
+		Charge:       2,
+		CalculatedMz: (computed + 2*chem.MassProton) / 2,
+	}
+	var mismatch massMismatch
+
+	// Ambiguous residue is resolved by the reported mass
+	ident.PepSeq = "PEPTXDE"
+	m, ok := identMass(&ident, par, &mismatch)
+	if !ok || math.Abs(m-computed) > 1e-6 {
+		t.Errorf("Expected mass %f, got: %f (%v)", computed, m, ok)
+	}
+
+	// Disagreeing masses are rejected in check mode
+	par.massSource = massCheck
+	ident.PepSeq = "PEPTIDE"
+	ident.CalculatedMz += 0.01
+	_, ok = identMass(&ident, par, &mismatch)
+	if ok || mismatch.count != 1 {
+		t.Errorf("Expected mass mismatch, got: %v %d", ok, mismatch.count)
+	}
+
+	// Reported mass takes precedence in reported mode
+	par.massSource = massReported
+	m, ok = identMass(&ident, par, &mismatch)
+	if !ok || math.Abs(m-computed-0.02) > 1e-6 {
+		t.Errorf("Expected mass %f, got: %f (%v)", computed+0.02, m, ok)
+	}
+
+	// Small molecule in negative mode, [M-H]- of glucose
+	glucose := chem.MustParseFormula("C6H12O6").Mass()
+	ident = mzidentml.Identification{Charge: -1, CalculatedMz: glucose - chem.MassProton}
+	m, ok = identMass(&ident, par, &mismatch)
+	if !ok || math.Abs(m-glucose) > 1e-6 {
+		t.Errorf("Expected mass %f, got: %f (%v)", glucose, m, ok)
+	}
+	cals := appendIdentCalibrant(nil, &ident, par, &calibrantStats{})
+	if len(cals) != 1 || cals[0].polarity != -1 ||
+		math.Abs(newChargedCalibrant(cals[0].idCharge, &cals[0]).mz-ident.CalculatedMz) > 1e-6 {
+		t.Errorf("Negative ion calibrant %+v", cals)
+	}
+}
+
+// identSlice is an identReader for a slice of identifications
+type identSlice []mzidentml.Identification
+
+func (s *identSlice) Next() (mzidentml.Identification, error) {
+	if len(*s) == 0 {
+		return mzidentml.Identification{}, io.EOF
+	}
+	ident := (*s)[0]
+	*s = (*s)[1:]
+	return ident, nil
+}
+
+func TestNextSelectedIdent(t *testing.T) {
+	const doc = `<?xml version="1.0" encoding="utf-8"?>
+<mzML xmlns="http://psi.hupo.org/ms/mzml" version="1.1.0">
+ <run id="run1">
+  <spectrumList count="3">
+   <spectrum index="0" id="controllerType=0 controllerNumber=1 scan=10" defaultArrayLength="0">
+    <scanList count="1"><scan>
+     <cvParam cvRef="MS" accession="MS:1000016" name="scan start time" value="1.5" unitCvRef="UO" unitAccession="UO:0000031" unitName="minute"/>
+    </scan></scanList>
+   </spectrum>
+   <spectrum index="1" id="controllerType=0 controllerNumber=1 scan=11" defaultArrayLength="0">
+    <scanList count="1"><scan>
+     <cvParam cvRef="MS" accession="MS:1000016" name="scan start time" value="91.0" unitCvRef="UO" unitAccession="UO:0000010" unitName="second"/>
+    </scan></scanList>
+   </spectrum>
+   <spectrum index="2" id="controllerType=0 controllerNumber=1 scan=12" defaultArrayLength="0">
+    <cvParam cvRef="MS" accession="MS:1000511" name="ms level" value="2"/>
+    <scanList count="1"><scan>
+     <cvParam cvRef="MS" accession="MS:1000016" name="scan start time" value="91.5" unitCvRef="UO" unitAccession="UO:0000010" unitName="second"/>
+    </scan></scanList>
+   </spectrum>
+  </spectrumList>
+ </run>
+</mzML>`
+	mzML, err := mzml.Read(strings.NewReader(doc))
+	if err != nil {
+		t.Fatalf("mzml.Read: error return %v", err)
+	}
+	maxRank := 0
+	f := false
+	fdr := 0.0
+	par := params{maxRank: &maxRank, passThreshold: &f, targetOnly: &f, fdr: &fdr}
+
+	idents := identSlice{
+		{PepID: "P1", SpecID: "index=1", RetentionTime: -1},
+		{PepID: "P2", SpecID: "scan=10", RetentionTime: -1},
+		// MS2 spectrum, the retention time of its precursor scan is used
+		{PepID: "P5", SpecID: "scan=12", RetentionTime: -1},
+		{PepID: "P3", SpecID: "scan=99", RetentionTime: 30},
+		{PepID: "P4", SpecID: "scan=99", RetentionTime: -1},
+	}
+	for _, expected := range []float64{91, 90, 91, 30} {
+		ident, err := nextSelectedIdent(&idents, &mzML, par)
+		if err != nil || ident.RetentionTime != expected {
+			t.Errorf("Expected retention time %f, got: %f (%v)", expected, ident.RetentionTime, err)
+		}
+	}
+	_, err = nextSelectedIdent(&idents, &mzML, par)
+	if err == nil || err == io.EOF {
+		t.Errorf("Expected error for missing retention time, got: %v", err)
+	}
+}
+
+func TestComputeQValues(t *testing.T) {
+	scores := []psmScore{
+		{idx: 0, score: 1e-10},
+		{idx: 1, score: 1e-8},
+		{idx: 2, score: 1e-6, decoy: true},
+		{idx: 3, score: 1e-5},
+		{idx: 4, score: 1e-4},
+		{idx: 5, score: 1e-2, decoy: true},
+	}
+	q := computeQValues(scores, false)
+	expected := map[int]float64{0: 0, 1: 0, 2: 0.25, 3: 0.25, 4: 0.25, 5: 0.5}
+	for idx, e := range expected {
+		if math.Abs(q[idx]-e) > 1e-12 {
+			t.Errorf("PSM %d: expected q-value %f, got: %f", idx, e, q[idx])
+		}
+	}
+
+	term, higherBetter, err := parseFdrScore("MS:1002466", nil)
+	if err != nil || term != "MS:1002466" || !higherBetter {
+		t.Errorf("parseFdrScore: got %s %v %v", term, higherBetter, err)
+	}
+	term, higherBetter, err = parseFdrScore("myscore:lower", nil)
+	if err != nil || term != "myscore" || higherBetter {
+		t.Errorf("parseFdrScore: got %s %v %v", term, higherBetter, err)
+	}
+	_, _, err = parseFdrScore("myscore", nil)
+	if err == nil {
+		t.Errorf("parseFdrScore: expected error for unknown score direction")
+	}
+}
+
+func TestFormulaMass(t *testing.T) {
+	m, err := formulaMass("C6H12O6")
+	if err != nil || math.Abs(m-180.063388) > 1e-5 {
+		t.Errorf("formulaMass(C6H12O6): got %f %v", m, err)
+	}
+	m, err = formulaMass("C2H6OSi")
+	if err != nil || math.Abs(m-74.018792) > 1e-5 {
+		t.Errorf("formulaMass(C2H6OSi): got %f %v", m, err)
+	}
+	_, err = formulaMass("C6Xx12")
+	if err == nil {
+		t.Errorf("formulaMass: expected error for unknown element")
+	}
+	_, err = formulaMass("C6H13O6+")
+	if err == nil {
+		t.Errorf("formulaMass: expected error for charged formula")
+	}
+	m, err = calListMass("PEPTIDE", "H-2O-1", "", "")
+	if pep, _ := pepMass("PEPTIDE"); err != nil || math.Abs(m-pep+18.010565) > 1e-5 {
+		t.Errorf("calListMass with formula modification: got %f %v", m, err)
+	}
+}
+
+func TestReadCalibrantList(t *testing.T) {
+	list := "name,sequence,mods,formula,mass,charge,rt,score\n" +
+		"pep1,PEPTIDE,UNIMOD:35,,,2,600:660,0.99\n" +
+		"glucose,,,C6H12O6,,1;2,,\n" +
+		"spike,,,,1000.5,,900,0.5\n"
+	scoreFilt, _ := parseScoreFilter("score(0.9:)")
+	cals, err := readCalibrantList(strings.NewReader(list), scoreFilt)
+	if err != nil {
+		t.Fatalf("readCalibrantList: error return %v", err)
+	}
+	// spike doesn't pass the score filter, glucose has 2 charges
+	if len(cals) != 3 {
+		t.Fatalf("readCalibrantList: expected 3 calibrants, got %+v", cals)
+	}
+	pep, _ := pepMass("PEPTIDE")
+	if math.Abs(cals[0].mass-(pep+15.994915)) > 1e-6 || cals[0].idCharge != 2 ||
+		!cals[0].identChargeOnly || cals[0].retentionTime != 600 || cals[0].rtEnd != 660 {
+		t.Errorf("Unexpected calibrant %+v", cals[0])
+	}
+	if cals[1].retentionTime != -math.MaxFloat64 || cals[1].idCharge != 1 || cals[2].idCharge != 2 {
+		t.Errorf("Unexpected calibrants %+v %+v", cals[1], cals[2])
+	}
+}
+
+func TestCalibsInRtWindows(t *testing.T) {
+	cals := []identifiedCalibrant{
+		{name: "any", retentionTime: -math.MaxFloat64},
+		{name: "range", retentionTime: 100, rtEnd: 300},
+		{name: "early", retentionTime: 150},
+		{name: "xicBefore", retentionTime: 200, rtEnd: 275, xicRange: true},
+		{name: "xic", retentionTime: 260, rtEnd: 285, xicRange: true},
+		{name: "point", retentionTime: 280},
+	}
+	rtRange := calRTRange(cals)
+	if rtRange != 200 {
+		t.Errorf("calRTRange: expected 200, got %f", rtRange)
+	}
+	specCals, _ := calibsInRtWindows(280, -10, 10, rtRange, cals)
+	names := ""
+	for _, cal := range specCals {
+		names += cal.name + " "
+	}
+	if names != "range xic point any " {
+		t.Errorf("calibsInRtWindows: got %s", names)
+	}
+}
+
 // struct for URL, filename, and boolean for whether the file is gzipped
 type testFile struct {
 	url      string
@@ -270,3 +519,780 @@ func TestMain(t *testing.T) {
 	main()
 	JSONCompareFile(t, filepath.Join(testFiles.dir, testFiles.files[3].filename), filepath.Join(testFiles.dir, "test-recal.json"))
 }
+
+func TestSpectraStem(t *testing.T) {
+	for loc, expected := range map[string]string{
+		"file:///data/run1.mzML":    "run1",
+		`C:\data\run1.mzML.gz`:      "run1",
+		"run1.RAW":                  "run1",
+		"/data/run.1.mgf":           "run.1",
+		"run1":                      "run1",
+		"/data/sample.d/analysis.d": "analysis",
+	} {
+		if stem := spectraStem(loc); stem != expected {
+			t.Errorf("spectraStem(%s) is %s, expected %s", loc, stem, expected)
+		}
+	}
+}
+
+func TestRunFilter(t *testing.T) {
+	spectraData := ""
+	par := params{spectraDataStr: &spectraData, verbosity: infoSilent}
+
+	// Only identifications of the mzML file and without SpectraData
+	idents := identSlice{
+		{PepID: "P1", SpectraData: "file:///data/fraction1.mzML"},
+		{PepID: "P2", SpectraData: "file:///data/fraction2.mzML"},
+		{PepID: "P3"},
+		{PepID: "P4", SpectraData: "file:///data/fraction1.mzML"},
+	}
+	rf := newRunFilter(&idents, "/tmp/fraction2.mzML", par)
+	for _, expected := range []string{"P2", "P3"} {
+		ident, err := rf.Next()
+		if err != nil || ident.PepID != expected {
+			t.Errorf("Expected %s, got %s (%v)", expected, ident.PepID, err)
+		}
+	}
+	if _, err := rf.Next(); err != io.EOF {
+		t.Errorf("Expected io.EOF, got %v", err)
+	}
+
+	// A single run that doesn't match is assumed to be the mzML file
+	idents = identSlice{
+		{PepID: "P1", SpectraData: "run1.mzML"},
+		{PepID: "P2", SpectraData: "run1.mzML"},
+	}
+	rf = newRunFilter(&idents, "renamed.mzML", par)
+	for _, expected := range []string{"P1", "P2"} {
+		ident, err := rf.Next()
+		if err != nil || ident.PepID != expected {
+			t.Errorf("Expected %s, got %s (%v)", expected, ident.PepID, err)
+		}
+	}
+	if _, err := rf.Next(); err != io.EOF {
+		t.Errorf("Expected io.EOF, got %v", err)
+	}
+
+	// Multiple runs that don't match
+	idents = identSlice{
+		{PepID: "P1", SpectraData: "run1.mzML"},
+		{PepID: "P2", SpectraData: "run2.mzML"},
+	}
+	rf = newRunFilter(&idents, "run3.mzML", par)
+	if _, err := rf.Next(); err == nil || err == io.EOF {
+		t.Errorf("Expected error for missing run, got %v", err)
+	}
+
+	// Run specified by the user
+	spectraData = "run2.mzML"
+	idents = identSlice{
+		{PepID: "P1", SpectraData: "run1.mzML"},
+		{PepID: "P2", SpectraData: "run2.mzML"},
+	}
+	rf = newRunFilter(&idents, "run3.mzML", par)
+	ident, err := rf.Next()
+	if err != nil || ident.PepID != "P2" {
+		t.Errorf("Expected P2, got %s (%v)", ident.PepID, err)
+	}
+	if name := runName("run3.mzML", par); name != "run2" {
+		t.Errorf("runName: got %s, expected run2", name)
+	}
+
+	// Runs listed by the reader. The only listed run is used without
+	// holding its identifications.
+	spectraData = ""
+	for _, tc := range []struct {
+		list     []mzidentml.SpectraData
+		expected string
+	}{
+		{[]mzidentml.SpectraData{{Location: "file:///run1.mzML"}, {Location: "run2.raw", Name: "fraction2"}}, "P2"},
+		{[]mzidentml.SpectraData{{Location: "run1.mzML"}}, "P1"},
+		{[]mzidentml.SpectraData{{Location: "run1.mzML"}, {Location: "run3.mzML"}}, ""},
+	} {
+		idents := listedIdents{
+			identSlice: identSlice{
+				{PepID: "P1", SpectraData: "run1.mzML"},
+				{PepID: "P2", SpectraData: "run2.raw"},
+			},
+			list: tc.list,
+		}
+		rf = newRunFilter(&idents, "fraction2.mzML", par)
+		ident, err := rf.Next()
+		if tc.expected == "" {
+			if err == nil || err == io.EOF {
+				t.Errorf("Expected error for missing run, got %v", err)
+			}
+			continue
+		}
+		if err != nil || ident.PepID != tc.expected || len(rf.held) != 0 {
+			t.Errorf("Expected %s, got %s (%v, %d held)", tc.expected, ident.PepID, err, len(rf.held))
+		}
+	}
+
+	// Selection of the PSMs that are recalibrated in the mzIdentML output
+	rf = newRunFilter(nil, "run2.mzML", par)
+	err = rf.selectRun([]mzidentml.SpectraData{{Location: "run1.mzML"}, {Location: "run2.raw"}})
+	if err != nil {
+		t.Fatalf("selectRun: error return %v", err)
+	}
+	for spectraData, expected := range map[string]bool{"run1.mzML": false, "run2.raw": true, "": true} {
+		if rf.selected(spectraData) != expected {
+			t.Errorf("selected(%q): got %v, expected %v", spectraData, !expected, expected)
+		}
+	}
+}
+
+// listedIdents is an identReader that lists its SpectraData
+type listedIdents struct {
+	identSlice
+	list []mzidentml.SpectraData
+}
+
+func (l *listedIdents) SpectraData() []mzidentml.SpectraData {
+	return l.list
+}
+
+func TestParseScoreFilter(t *testing.T) {
+	ident := mzidentml.Identification{
+		PepSeq: "PEPTIDE",
+		Charge: 2,
+		Rank:   1,
+		Cv: []mzidentml.CVParam{
+			{Accession: "MS:1002257", Name: "Comet:expectation value", Value: "0.001"},
+			{Accession: "MS:1002466", Name: "PeptideShaker PSM score", Value: "0.5"},
+		},
+	}
+	for _, tc := range []struct {
+		filter   string
+		expected bool
+	}{
+		{"MS:1002257(0.0:1e-2)", true},
+		{"MS:1001330(0.0:1e-2)MS:1002257(0.0:1e-4)", false},
+		{"MS:1002257(0.0:1e-2)MS:1002466(0.99:)", true},
+		{"MS:1002466(0.99:)MS:1002257(0.0:1e-2)", false},
+		{"Comet:expectation value(0.0:1e-2)", true},
+		{"MS:1002257 < 0.01 AND MS:1002466 >= 0.99", false},
+		{"MS:1002257 < 0.01 OR MS:1002466 >= 0.99", true},
+		{`"Comet:expectation value" <= 0.001 && charge = 2`, true},
+		{"MS:1002257(0.0:1e-2) AND NOT (length < 8 OR modified)", false},
+		{"MS:1002257(0.0:1e-2) AND length >= 7 AND !modified", true},
+		{"MS:1001330 > 0 OR rank > 1", false},
+		{"NOT MS:1001330 > 0", true},
+	} {
+		scoreFilt, err := parseScoreFilter(tc.filter)
+		if err != nil {
+			t.Errorf("parseScoreFilter(%s): error return %v", tc.filter, err)
+			continue
+		}
+		ok, err := scoreFilterPasses(&ident, scoreFilt)
+		if err != nil || ok != tc.expected {
+			t.Errorf("Filter %s returns %v (%v), expected %v", tc.filter, ok, err, tc.expected)
+		}
+	}
+	for _, filter := range []string{"MS:1002257 <", "(charge > 1", "charge > x",
+		"MS:1002257(0:1)MS:1002257(0:1)", "charge & 1"} {
+		_, err := parseScoreFilter(filter)
+		if err == nil {
+			t.Errorf("parseScoreFilter(%s): expected error", filter)
+		}
+	}
+}
+
+func TestDefaultEngineFilter(t *testing.T) {
+	msgf := []mzidentml.AnalysisSoftware{{Name: "MS-GF+",
+		SoftwareName: []mzidentml.CVParam{{Accession: "MS:1002048", Name: "MS-GF+"}}}}
+	percolator := append([]mzidentml.AnalysisSoftware{{ID: "AS_2",
+		UserName: []mzidentml.CVParam{{Name: "Percolator"}}}}, msgf...)
+	xtandem := []mzidentml.AnalysisSoftware{{Name: "X! Tandem"}}
+	diann := []mzidentml.AnalysisSoftware{{Name: "DIA-NN"}}
+	msgfScores := []mzidentml.CVParam{{Accession: "MS:1002053", Name: "MS-GF:EValue"}}
+	percScores := append([]mzidentml.CVParam{{Accession: "MS:1001491", Name: "percolator:Q value"}}, msgfScores...)
+	for _, tc := range []struct {
+		software []mzidentml.AnalysisSoftware
+		scores   []mzidentml.CVParam
+		expected string
+	}{
+		{msgf, msgfScores, "MS-GF+"},
+		{percolator, percScores, "Percolator"},
+		{percolator, msgfScores, "MS-GF+"},
+		{nil, msgfScores, "scores of MS-GF+ (software not recognized)"},
+		{xtandem, []mzidentml.CVParam{{Accession: "MS:1001330"}}, "X!Tandem"},
+		{diann, []mzidentml.CVParam{{Accession: "MS:1002354", Name: "Q.Value"}}, "DIA-NN"},
+		{nil, []mzidentml.CVParam{{Name: "q-value"}}, "unknown software"},
+	} {
+		name, _, err := defaultEngineFilter(tc.software, tc.scores)
+		if err != nil || name != tc.expected {
+			t.Errorf("Detected %s (%v), expected %s", name, err, tc.expected)
+		}
+	}
+	_, _, err := defaultEngineFilter(msgf, []mzidentml.CVParam{{Name: "some score"}})
+	if err == nil {
+		t.Errorf("Expected error for unknown score")
+	}
+}
+
+func TestCombineIdents(t *testing.T) {
+	lists := [][]mzidentml.Identification{
+		{
+			{PepID: "A1", PepSeq: "PEPTIDE", Charge: 2, SpecID: "scan=1"},
+			{PepID: "B1", PepSeq: "PEPTLDE", Charge: 2, SpecID: "scan=2"},
+			{PepID: "C1", PepSeq: "ELVISK", Charge: 2, SpecID: "scan=3"},
+		},
+		{
+			{PepID: "A2", PepSeq: "PEPTIDE", Charge: 2, SpecID: "scan=1"},
+			{PepID: "B2", PepSeq: "PEPTIDE", Charge: 2, SpecID: "scan=2"},
+			{PepID: "D2", PepSeq: "LIVESK", Charge: 2, SpecID: "scan=3"},
+			{PepID: "E2", PepSeq: "ELVISK", Charge: 3, SpecID: "scan=4"},
+		},
+		{
+			{PepID: "A3", PepSeq: "PEPTIDE", Charge: 2, SpecID: "scan=1"},
+		},
+	}
+	combiner := newPSMCombiner(nil)
+	for _, list := range lists {
+		combiner.add(list)
+	}
+	// Spectrum 2 is identified by two files that agree, spectrum 4 by
+	// only one file
+	for _, tc := range []struct {
+		mode     consensusMode
+		expected []string
+	}{
+		{consensusUnion, []string{"A1", "B1", "C1", "D2", "E2"}},
+		{consensusIntersection, []string{"A1"}},
+		{consensusAgree, []string{"A1", "B1"}},
+	} {
+		var pepIDs []string
+		for _, ident := range combiner.combined(tc.mode) {
+			pepIDs = append(pepIDs, ident.PepID)
+		}
+		if !cmp.Equal(pepIDs, tc.expected) {
+			t.Errorf("Mode %d: got %v, expected %v", tc.mode, pepIDs, tc.expected)
+		}
+	}
+}
+
+func TestSplitFilenames(t *testing.T) {
+	dir := t.TempDir()
+	withComma := filepath.Join(dir, "a,b.mzid")
+	if err := os.WriteFile(withComma, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	other := filepath.Join(dir, "c.mzid")
+	names := splitFilenames(withComma + "," + other)
+	if !cmp.Equal(names, []string{withComma, other}) {
+		t.Errorf("splitFilenames: got %v, expected %v", names, []string{withComma, other})
+	}
+	names = splitFilenames("x.mzid,y.mzid")
+	if !cmp.Equal(names, []string{"x.mzid", "y.mzid"}) {
+		t.Errorf("splitFilenames: got %v, expected [x.mzid y.mzid]", names)
+	}
+}
+
+func TestCollapseCalibrants(t *testing.T) {
+	cals := []identifiedCalibrant{
+		{name: "A", pepSeq: "A", mass: 1000.0, idCharge: 2, retentionTime: 100},
+		{name: "B", pepSeq: "B", mass: 1200.0, idCharge: 2, retentionTime: 105},
+		{name: "A", pepSeq: "A", mass: 1000.0, idCharge: 2, retentionTime: 110},
+		{name: "A", pepSeq: "A", mass: 1000.0, idCharge: 3, retentionTime: 112},
+		{name: "C", pepSeq: "C", mass: 1000.0, idCharge: 2, retentionTime: 115},
+		{name: "A", pepSeq: "A", mass: 1000.0, idCharge: 2, retentionTime: 125},
+		{name: "A", pepSeq: "A", mass: 1000.0, idCharge: 2, retentionTime: 200},
+	}
+	collapsed := collapseCalibrants(cals, 20)
+	expected := []identifiedCalibrant{
+		{name: "A", pepSeq: "A", mass: 1000.0, idCharge: 2, retentionTime: 100, rtEnd: 125},
+		{name: "A", pepSeq: "A", mass: 1000.0, idCharge: 2, retentionTime: 200, rtEnd: 200},
+		{name: "B", pepSeq: "B", mass: 1200.0, idCharge: 2, retentionTime: 105, rtEnd: 105},
+		{name: "A", pepSeq: "A", mass: 1000.0, idCharge: 3, retentionTime: 112, rtEnd: 112},
+		{name: "C", pepSeq: "C", mass: 1000.0, idCharge: 2, retentionTime: 115, rtEnd: 115},
+	}
+	if !cmp.Equal(collapsed, expected, cmp.AllowUnexported(identifiedCalibrant{})) {
+		t.Errorf("Collapsed calibrants: %+v, expected %+v", collapsed, expected)
+	}
+}
+
+func TestCalibrantLibrary(t *testing.T) {
+	cals, err := readCalibrantLibraries(defaultLibraryName)
+	if err != nil || len(cals) == 0 {
+		t.Fatalf("readCalibrantLibraries: %d calibrants, error return %v", len(cals), err)
+	}
+	mz := newChargedCalibrant(cals[0].idCharge, &cals[0]).mz
+	if cals[0].name != "cyclosiloxane6" || math.Abs(mz-445.120025) > 1e-6 {
+		t.Errorf("First calibrant is %s (m/z %f), expected cyclosiloxane6 (m/z 445.120025)",
+			cals[0].name, mz)
+	}
+	// The default library has the cyclosiloxanes that were always used,
+	// in spectra of any polarity
+	nrDefault := len(cals)
+	if nrDefault != 7 || cals[6].name != "cyclosiloxane12" ||
+		math.Abs(cals[6].mass-888.2254961) > 1e-6 || cals[6].polarity != 0 {
+		t.Errorf("Default library: %d calibrants, last %+v, expected 7 up to cyclosiloxane12",
+			nrDefault, cals[nrDefault-1])
+	}
+	for _, lib := range []string{contaminantLibraryName, peptideLibraryName} {
+		cals, err = readCalibrantLibraries(defaultLibraryName + "," + lib)
+		if err != nil || len(cals) <= nrDefault {
+			t.Errorf("readCalibrantLibraries: %d calibrants with %s, %d without, error return %v",
+				len(cals), lib, nrDefault, err)
+		}
+	}
+	for _, cal := range cals[:nrDefault] {
+		if strings.HasPrefix(cal.name, "trypsin") || strings.HasPrefix(cal.name, "keratin") {
+			t.Errorf("Peptide calibrant %s in default library", cal.name)
+		}
+	}
+
+	const lib = "# Test library\n" +
+		"name\tformula\tadducts\tpolarity\n" +
+		"glucose\tC6H12O6\t[M+Na]+;[M-H]-;[2M+H]+\t\n" +
+		"formate\tCH2O2\t[M-H]-\t-\n"
+	cals, err = readCalibrantList(strings.NewReader(lib), scoreFilter{})
+	if err != nil {
+		t.Fatalf("readCalibrantList: error return %v", err)
+	}
+	expected := []struct {
+		mz       float64
+		polarity int
+	}{{203.052609, 1}, {179.056112, -1}, {361.134053, 1}, {44.998203, -1}}
+	if len(cals) != len(expected) {
+		t.Fatalf("%d calibrants, expected %d", len(cals), len(expected))
+	}
+	for i, e := range expected {
+		mz := newChargedCalibrant(cals[i].idCharge, &cals[i]).mz
+		if math.Abs(mz-e.mz) > 1e-5 || cals[i].polarity != e.polarity || !cals[i].identChargeOnly {
+			t.Errorf("Calibrant %s: m/z %f polarity %d, expected %f %d",
+				cals[i].name, mz, cals[i].polarity, e.mz, e.polarity)
+		}
+	}
+	if n := len(calibsWithPolarity(cals, -1)); n != 2 {
+		t.Errorf("%d negative calibrants, expected 2", n)
+	}
+
+	for _, bad := range []string{"name\tformula\tadducts\tpolarity\nx\tCH4\t[M+H]+\t-\n",
+		"name\tformula\tadducts\nx\tCH4\t[M+Q]+\n",
+		"name\tformula\tpolarity\nx\tCH4\t-\n"} {
+		_, err = readCalibrantList(strings.NewReader(bad), scoreFilter{})
+		if err == nil {
+			t.Errorf("Expected error for library %q", bad)
+		}
+	}
+}
+
+// encodePeaks returns the mzML binary data arrays of peaks
+func encodePeaks(mz, intens []float64) string {
+	arrays := ""
+	for i, values := range [][]float64{mz, intens} {
+		data := make([]byte, 8*len(values))
+		for j, v := range values {
+			binary.LittleEndian.PutUint64(data[j*8:], math.Float64bits(v))
+		}
+		accession := []string{"MS:1000514", "MS:1000515"}[i]
+		arrays += `<binaryDataArray><cvParam cvRef="MS" accession="MS:1000523"/>` +
+			`<cvParam cvRef="MS" accession="` + accession + `"/>` +
+			`<binary>` + base64.StdEncoding.EncodeToString(data) + `</binary></binaryDataArray>`
+	}
+	return arrays
+}
+
+// testSpectrum is a positive mode spectrum for testMzML
+type testSpectrum struct {
+	msLevel    int
+	rt         float64 // Scan start time (s)
+	mz, intens []float64
+}
+
+// testMzML returns an mzML run with the given spectra
+func testMzML(t *testing.T, spectra []testSpectrum) mzml.MzML {
+	t.Helper()
+	doc := `<?xml version="1.0" encoding="utf-8"?>
+<mzML xmlns="http://psi.hupo.org/ms/mzml" version="1.1.0">
+ <run id="run1">
+  <spectrumList count="` + strconv.Itoa(len(spectra)) + `">
+`
+	for s, spec := range spectra {
+		doc += `<spectrum index="` + strconv.Itoa(s) + `" id="scan=` + strconv.Itoa(s+1) +
+			`" defaultArrayLength="` + strconv.Itoa(len(spec.mz)) + `">` +
+			`<cvParam cvRef="MS" accession="MS:1000511" value="` + strconv.Itoa(spec.msLevel) + `"/>` +
+			`<cvParam cvRef="MS" accession="MS:1000130"/>` +
+			`<scanList count="1"><scan><cvParam cvRef="MS" accession="MS:1000016" value="` +
+			strconv.FormatFloat(spec.rt, 'f', -1, 64) + `"/></scan></scanList>` +
+			`<binaryDataArrayList count="2">` + encodePeaks(spec.mz, spec.intens) +
+			"</binaryDataArrayList></spectrum>\n"
+	}
+	doc += "  </spectrumList>\n </run>\n</mzML>"
+	mzML, err := mzml.Read(strings.NewReader(doc))
+	if err != nil {
+		t.Fatalf("mzml.Read: error return %v", err)
+	}
+	return mzML
+}
+
+// testMS1Spectra returns the MS1 spectra of mzML (see ms1Spectra)
+func testMS1Spectra(t *testing.T, mzML *mzml.MzML) []ms1Spectrum {
+	t.Helper()
+	specs, err := ms1Spectra(mzML)
+	if err != nil {
+		t.Fatalf("ms1Spectra: error return %v", err)
+	}
+	return specs
+}
+
+func TestDiscoverBackgroundIons(t *testing.T) {
+	const lib = "name\tformula\tcharge\tadducts\n" +
+		"cyclosiloxane6\tC12H36O6Si6\t1\t\n" +
+		"cyclosiloxane7\tC14H42O7Si7\t1\t\n" +
+		"PEG5\tC10H22O6\t\t[M+H]+;[M+Na]+\n" +
+		"erucamide\tC22H43NO\t1:2\t\n"
+	libCals, err := readCalibrantList(strings.NewReader(lib), scoreFilter{})
+	if err != nil {
+		t.Fatalf("readCalibrantList: error return %v", err)
+	}
+	ionMz := func(i, charge int) float64 {
+		return newChargedCalibrant(charge, &libCals[i]).mz
+	}
+	// m/z errors (ppm) of the ions in 4 MS1 spectra. NaN: not present
+	nan := math.NaN()
+	ions := []struct {
+		mz     float64
+		errPPM []float64
+	}{
+		{ionMz(0, 1), []float64{1, 1.5, 0.5, 1}},   // Stable
+		{ionMz(1, 1), []float64{8, -8, 8, -8}},     // Unstable m/z
+		{ionMz(3, 1), []float64{0, nan, nan, nan}}, // PEG5 [M+Na]+, rare
+		{ionMz(4, 2), []float64{2, 2, 2, 2}},       // Erucamide, charge 2
+	}
+	var spectra []testSpectrum
+	for s := 0; s < 5; s++ {
+		spec := testSpectrum{msLevel: 1, rt: float64(s)}
+		if s == 2 {
+			// MS2 spectrum with all ions at their exact m/z
+			spec.msLevel = 2
+			for _, ion := range ions {
+				spec.mz = append(spec.mz, ion.mz)
+				spec.intens = append(spec.intens, 1000)
+			}
+		} else {
+			for _, ion := range ions {
+				e := ion.errPPM[s-s/3]
+				if !math.IsNaN(e) {
+					spec.mz = append(spec.mz, ion.mz*(1+e*1e-6))
+					spec.intens = append(spec.intens, 1000)
+				}
+			}
+		}
+		spectra = append(spectra, spec)
+	}
+	mzML := testMzML(t, spectra)
+	ms1Specs := testMS1Spectra(t, &mzML)
+
+	mzErrPPM := 10.0
+	calPeaks := 0
+	minPeak := 0.0
+	frac := 0.5
+	par := params{mzErrPPM: &mzErrPPM, calPeaks: &calPeaks, minPeak: &minPeak,
+		discoverFrac: &frac, minCharge: 1, maxCharge: 3, verbosity: infoSilent}
+	discovered, err := discoverBackgroundIons(&mzML, ms1Specs, libCals, par)
+	if err != nil {
+		t.Fatalf("discoverBackgroundIons: error return %v", err)
+	}
+	expected := map[string]int{"cyclosiloxane6": 1, "erucamide": 2}
+	if len(discovered) != len(expected) {
+		t.Fatalf("Discovered %d ions, expected %d: %+v", len(discovered), len(expected), discovered)
+	}
+	for _, cal := range discovered {
+		if charge, ok := expected[cal.name]; !ok || cal.idCharge != charge || !cal.identChargeOnly {
+			t.Errorf("Discovered %s charge %d, expected %v", cal.name, cal.idCharge, expected)
+		}
+	}
+
+	frac = 0.25
+	discovered, err = discoverBackgroundIons(&mzML, ms1Specs, libCals, par)
+	if err != nil || len(discovered) != 3 {
+		t.Errorf("Discovered %d ions with -discover 0.25, expected 3 (%v)", len(discovered), err)
+	}
+}
+
+func TestResidueLabels(t *testing.T) {
+	labels, err := parseLabels("15N; 13C(6)15N(2):K")
+	if err != nil || len(labels) != 2 || labels[0].String() != "15N" ||
+		labels[1].String() != "13C(6)15N(2):K" || labels[1].isotopes[1].count != 2 {
+		t.Fatalf("parseLabels: got %+v %v", labels, err)
+	}
+	for _, bad := range []string{"C13", "13C(6):k", "13C(6)x", "15N:K;N"} {
+		if _, err = parseLabels(bad); err == nil {
+			t.Errorf("parseLabels(%s): expected error", bad)
+		}
+	}
+
+	// Restore the standard residues afterwards
+	defer func() { aaFormula, aaMass = residueTable(residueFormulas) }()
+	natural, _ := pepMass("PEPTIDEK")
+	const table = "residue\tformula\tmass\n" +
+		"X\tC5H9NO2\t\n" +
+		"Z\t\t128.5\n"
+	if err = readResidueTable(strings.NewReader(table)); err != nil {
+		t.Fatalf("readResidueTable: error return %v", err)
+	}
+	if m, err := pepMass("XZ"); err != nil || math.Abs(m-18.010565-115.063329-128.5) > 1e-5 {
+		t.Errorf("pepMass with residue table: got %f %v", m, err)
+	}
+	if err = setResidues("", labels[1:]); err != nil {
+		t.Fatalf("setResidues: error return %v", err)
+	}
+	if m, _ := pepMass("PEPTIDEK"); math.Abs(m-natural-8.014199) > 1e-5 {
+		t.Errorf("Heavy lysine: mass shift %f, expected 8.014199", m-natural)
+	}
+	if _, err = labelMasses([]residueLabel{{isotopes: []isotopeLabel{{"C", 13, 1}}, residues: "Z"}}); err == nil {
+		t.Errorf("labelMasses: expected error for residue without formula")
+	}
+	if _, err = labelMasses([]residueLabel{{isotopes: []isotopeLabel{{"C", 13, 7}}, residues: "K"}}); err == nil {
+		t.Errorf("labelMasses: expected error for too many labeled atoms")
+	}
+}
+
+func TestDeclaredLabels(t *testing.T) {
+	const doc = `<?xml version="1.0" encoding="UTF-8"?>
+<MzIdentML id="test" version="1.1.0" xmlns="http://psidev.info/psi/pi/mzIdentML/1.1">
+<SequenceCollection>
+  <Peptide id="PEP_1">
+    <PeptideSequence>PEPTIDEK</PeptideSequence>
+    <Modification location="8" residues="K" monoisotopicMassDelta="8.014199">
+      <cvParam cvRef="UNIMOD" accession="UNIMOD:259" name="Label:13C(6)15N(2)"/>
+    </Modification>
+    <Modification location="9" monoisotopicMassDelta="4.008491">
+      <cvParam cvRef="UNIMOD" accession="UNIMOD:193" name="Label:18O(2)"/>
+    </Modification>
+  </Peptide>
+</SequenceCollection>
+<AnalysisProtocolCollection>
+<SpectrumIdentificationProtocol id="SIP_1">
+  <ModificationParams>
+    <SearchModification fixedMod="true" massDelta="8.014199" residues="K">
+      <cvParam cvRef="UNIMOD" accession="UNIMOD:259" name="Label:13C(6)15N(2)"/>
+    </SearchModification>
+    <SearchModification fixedMod="true" massDelta="4.008491" residues=".">
+      <cvParam cvRef="UNIMOD" accession="UNIMOD:193" name="Label:18O(2)"/>
+      <SpecificityRules>
+        <cvParam cvRef="PSI-MS" accession="MS:1001190" name="modification specificity peptide C-term"/>
+      </SpecificityRules>
+    </SearchModification>
+  </ModificationParams>
+</SpectrumIdentificationProtocol>
+</AnalysisProtocolCollection>
+<DataCollection>
+<AnalysisData>
+<SpectrumIdentificationList id="SIL_1">
+  <SpectrumIdentificationResult id="SIR_1" spectrumID="index=5">
+    <SpectrumIdentificationItem id="SII_1" chargeState="2" peptide_ref="PEP_1" rank="1"/>
+  </SpectrumIdentificationResult>
+</SpectrumIdentificationList>
+</AnalysisData>
+</DataCollection>
+</MzIdentML>`
+	// The C-terminal 18O label is not a residue label, and is counted
+	// once. With -label 15N, only the 13C of the lysine label remains.
+	const n15 = 15.0001088984 - 14.0030740052
+	natural, _ := pepMass("PEPTIDEK")
+	for _, test := range []struct {
+		labelStr string
+		shift    float64
+	}{
+		{"", 8.014199 + 4.008491},
+		{"13C(6)15N(2):K", 8.014199 + 4.008491},
+		{"15N", 8.014199 + 7*n15 + 4.008491},
+	} {
+		labelStr := test.labelStr
+		labels, _ := parseLabels(labelStr)
+		par := params{residueLabels: labels, verbosity: infoSilent}
+		if err := setResidues("", labels); err != nil {
+			t.Fatalf("setResidues: error return %v", err)
+		}
+		r := newRunFilter(mzidentml.NewReader(strings.NewReader(doc)), "run.mzML", params{spectraDataStr: new(string)})
+		ident, err := r.Next()
+		if err != nil {
+			t.Fatalf("Next: error return %v", err)
+		}
+		idents := []mzidentml.Identification{ident}
+		if err = applyDeclaredLabels(r, idents, par); err != nil {
+			t.Fatalf("applyDeclaredLabels: error return %v", err)
+		}
+		m, _ := pepMass(idents[0].PepSeq)
+		m += idents[0].ModMass
+		if math.Abs(m-natural-test.shift) > 1e-5 {
+			t.Errorf("-label '%s': mass shift %f, expected %f", labelStr, m-natural, test.shift)
+		}
+		aaFormula, aaMass = residueTable(residueFormulas)
+	}
+}
+
+func TestIRTCalibrants(t *testing.T) {
+	peps, err := readIRTSet(irtBiognosys)
+	if err != nil || len(peps) != 11 {
+		t.Fatalf("readIRTSet: %d peptides, error return %v", len(peps), err)
+	}
+	if a, b := theilSen([]float64{0, 1, 2, 3, 4}, []float64{1, 3, 5, 100, 9}); a != 1 || b != 2 {
+		t.Errorf("theilSen: got %f + %f x, expected 1 + 2 x", a, b)
+	}
+
+	// RT = 1000 + 10 iRT. Peptides 0 and 10 are identified, peptide 5 is
+	// detected 40 s later than predicted. Peptide 6 has a wrong isotope
+	// pattern. A peptide with the mass of peptide 5 but another sequence
+	// is not an identification of peptide 5.
+	rtOf := func(i int) float64 { return 1000 + 10*peps[i].irt }
+	idCals := []identifiedCalibrant{
+		{name: "id0", pepSeq: peps[0].seq, mass: peps[0].cals[0].mass, retentionTime: rtOf(0)},
+		{name: "id10", pepSeq: peps[10].seq, mass: peps[10].cals[0].mass, retentionTime: rtOf(10)},
+		{name: "isobaric", pepSeq: "PEPTIDE", mass: peps[5].cals[0].mass, retentionTime: 0},
+	}
+	isotopeMzs := func(i int) ([]float64, []float64) {
+		f, _ := pepFormula(peps[i].seq)
+		dist, _ := f.IsotopeDistribution(irtNrIsotopes)
+		var mz, intens []float64
+		for _, p := range dist {
+			mz = append(mz, (p.Mass+2*chem.MassProton)/2)
+			intens = append(intens, 1000*p.Abundance)
+		}
+		return mz, intens
+	}
+	mz5, intens5 := isotopeMzs(5)
+	mz6, intens6 := isotopeMzs(6)
+	intens6[0] *= 10
+	mzML := testMzML(t, []testSpectrum{
+		{1, rtOf(5), mz5[:1], intens5[:1]},
+		{1, rtOf(5) + 40, mz5, intens5},
+		{1, rtOf(6), mz6, intens6},
+	})
+	ms1Specs := testMS1Spectra(t, &mzML)
+
+	mzErrPPM := 10.0
+	irtSet := irtBiognosys
+	irtWindow := 60.0
+	par := params{mzErrPPM: &mzErrPPM, irtSet: &irtSet,
+		irtWindow: &irtWindow, minCharge: 1, maxCharge: 3, verbosity: infoSilent}
+	cals, err := irtCalibrants(&mzML, ms1Specs, idCals, par)
+	if err != nil {
+		t.Fatalf("irtCalibrants: error return %v", err)
+	}
+	if len(cals) != 9 {
+		t.Fatalf("irtCalibrants: got %d calibrants, expected 9", len(cals))
+	}
+	// The deviation of the detected peptide is an outlier, which doesn't
+	// widen the window
+	for _, cal := range cals {
+		if cal.name == peps[6].cals[0].name {
+			if math.Abs(cal.retentionTime-(rtOf(6)-60)) > 1e-6 ||
+				math.Abs(cal.rtEnd-(rtOf(6)+60)) > 1e-6 || cal.idCharge != 2 {
+				t.Errorf("%s: got RT %f-%f charge %d, expected %f-%f charge 2", cal.name,
+					cal.retentionTime, cal.rtEnd, cal.idCharge, rtOf(6)-60, rtOf(6)+60)
+			}
+		}
+	}
+
+	// Only the detected peptide is too few for a fit
+	cals, err = irtCalibrants(&mzML, ms1Specs, nil, par)
+	if err != nil || len(cals) != 0 {
+		t.Errorf("irtCalibrants without identifications: got %d calibrants, expected 0 (%v)", len(cals), err)
+	}
+}
+
+func TestTraceElution(t *testing.T) {
+	cals := []identifiedCalibrant{
+		{name: "peptide", mass: 1000, retentionTime: 80, idCharge: 2},
+		{name: "absent", mass: 1200, retentionTime: 80, idCharge: 2},
+	}
+	// XIC of the peptide in MS1 spectra every 10 s, with a second peak
+	xic := []float64{0, 0, 0, 0, 0, 0, 50, 200, 600, 1000, 800, 400, 150, 30, 0, 0, 0, 500, 900, 300, 0}
+	mz := newChargedCalibrant(2, &cals[0]).mz
+	var spectra []testSpectrum
+	for s, intens := range xic {
+		spectra = append(spectra, testSpectrum{1, float64(10 * s), []float64{mz}, []float64{intens}})
+	}
+	mzML := testMzML(t, spectra)
+	ms1Specs := testMS1Spectra(t, &mzML)
+
+	mzErrPPM := 10.0
+	xicFrac := 0.1
+	par := params{mzErrPPM: &mzErrPPM, xicFrac: &xicFrac, verbosity: infoSilent}
+	if err := traceElution(&mzML, ms1Specs, cals, par); err != nil {
+		t.Fatalf("traceElution: error return %v", err)
+	}
+	// The apex is at 90 s, the peak is above 10% from 70 to 120 s
+	if cals[0].retentionTime != 70 || cals[0].rtEnd != 120 || !cals[0].xicRange {
+		t.Errorf("peptide: got elution range %f-%f (%v), expected 70-120",
+			cals[0].retentionTime, cals[0].rtEnd, cals[0].xicRange)
+	}
+	if cals[1].retentionTime != 80 || cals[1].xicRange {
+		t.Errorf("absent: got elution range %f-%f (%v), expected unchanged",
+			cals[1].retentionTime, cals[1].rtEnd, cals[1].xicRange)
+	}
+}
+
+func TestAlignCalibrants(t *testing.T) {
+	a := fitAlignment([]rtAnchor{{100, 10}, {200, 30}, {300, 20}})
+	if rt := a.align(50); rt != 70 {
+		t.Errorf("align with 1 node: got %f, expected 70", rt)
+	}
+	a = rtAlignment{refRT: []float64{100, 200}, shift: []float64{10, 30}}
+	for _, tc := range [][2]float64{{50, 60}, {150, 170}, {250, 280}} {
+		if rt := a.align(tc[0]); math.Abs(rt-tc[1]) > 1e-9 {
+			t.Errorf("align(%f): got %f, expected %f", tc[0], rt, tc[1])
+		}
+	}
+
+	// Peptides elute 40 s later in the recalibrated run, the last one is
+	// absent. The identifications are 10 s after the apex.
+	apexRTs := []float64{100, 150, 200, 250, 300}
+	var cals []identifiedCalibrant
+	for i, rt := range apexRTs {
+		cals = append(cals, identifiedCalibrant{name: "pep" + strconv.Itoa(i),
+			mass: 1000 + 100*float64(i), retentionTime: rt + 10, rtEnd: rt + 10, idCharge: 2})
+	}
+	runSpectra := func(shift float64, nrPeptides int) []testSpectrum {
+		var spectra []testSpectrum
+		for s := 0; s <= 40; s++ {
+			spec := testSpectrum{msLevel: 1, rt: 10 * float64(s)}
+			for i := 0; i < nrPeptides; i++ {
+				spec.mz = append(spec.mz, newChargedCalibrant(2, &cals[i]).mz)
+				d := (spec.rt - apexRTs[i] - shift) / 15
+				spec.intens = append(spec.intens, 1000*math.Exp(-d*d))
+			}
+			spectra = append(spectra, spec)
+		}
+		return spectra
+	}
+	refMzML := testMzML(t, runSpectra(0, 5))
+	mzML := testMzML(t, runSpectra(40, 4))
+	ms1Specs := testMS1Spectra(t, &mzML)
+
+	mzErrPPM := 10.0
+	par := params{mzErrPPM: &mzErrPPM, verbosity: infoSilent}
+	if err := alignCalibrants(&refMzML, &mzML, ms1Specs, cals, par); err != nil {
+		t.Fatalf("alignCalibrants: error return %v", err)
+	}
+	for i, cal := range cals {
+		if math.Abs(cal.retentionTime-(apexRTs[i]+50)) > 1e-9 || cal.rtEnd != cal.retentionTime {
+			t.Errorf("%s: got RT %f-%f, expected %f", cal.name, cal.retentionTime, cal.rtEnd, apexRTs[i]+50)
+		}
+	}
+}
+
+func TestTableFormat(t *testing.T) {
+	tables := []struct {
+		filename string
+		header   string
+		format   identFormatType
+	}{
+		{"msms.txt", "Raw file\tScan number\tModified sequence\tCharge\tMass\tRetention time\n", identMaxQuant},
+		{"evidence.tsv", "Raw file\tModified sequence\tCharge\tMass\tRetention time\n", identMaxQuant},
+		{"report.txt", "Run\tModified.Sequence\tPrecursor.Charge\tRT\n", identDIAReport},
+	}
+	for _, tc := range tables {
+		if identFormat(tc.filename) != identTable {
+			t.Errorf("identFormat(%s): expected table", tc.filename)
+		}
+		if format := tableFormat(bufio.NewReader(strings.NewReader(tc.header))); format != tc.format {
+			t.Errorf("%s: got format %d, expected %d", tc.filename, format, tc.format)
+		}
+	}
+}
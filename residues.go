@@ -0,0 +1,387 @@
+// This file contains the residue table and the isotope labels that
+// are applied to it (parameters -residues and -label)
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/524D/mzrecal/internal/chem"
+	"github.com/524D/mzrecal/internal/mzidentml"
+)
+
+// isotopeLabel replaces atoms of an element by one of its isotopes
+type isotopeLabel struct {
+	element    string
+	massNumber int
+	count      int // Number of atoms per residue, 0 for all atoms
+}
+
+// residueLabel is a set of isotope labels of residues, e.g.
+// "13C(6)15N(2):K" for 13C6 15N2 lysine or "15N" for 15N on all residues
+type residueLabel struct {
+	isotopes []isotopeLabel
+	residues string // Labeled residues, empty for all
+}
+
+// Isotope of a label, with optional number of atoms, e.g. "13C(6)"
+var isotopeLabelRe = regexp.MustCompile(`(\d+)([A-Z][a-z]?)(?:\((\d+)\))?`)
+
+// parseLabels parses isotope labels separated by ";", in the notation
+// of UNIMOD label names, optionally followed by the labeled residues,
+// e.g. "15N" or "13C(6)15N(2):K;13C(6)15N(4):R"
+func parseLabels(s string) ([]residueLabel, error) {
+	var labels []residueLabel
+	for _, l := range strings.Split(s, `;`) {
+		l = strings.TrimSpace(l)
+		if l == `` {
+			continue
+		}
+		label, err := parseLabel(l)
+		if err != nil {
+			return nil, err
+		}
+		labels = append(labels, label)
+	}
+	return labels, nil
+}
+
+// parseLabel parses a single label, e.g. "13C(6)15N(2):K"
+func parseLabel(s string) (residueLabel, error) {
+	var label residueLabel
+	composition, residues, _ := strings.Cut(s, `:`)
+	for _, r := range residues {
+		if !unicode.IsUpper(r) {
+			return label, errors.New(`invalid residues in label ` + s)
+		}
+	}
+	label.residues = residues
+	n := 0
+	for _, m := range isotopeLabelRe.FindAllStringSubmatchIndex(composition, -1) {
+		if m[0] != n {
+			break
+		}
+		n = m[1]
+		var iso isotopeLabel
+		iso.massNumber, _ = strconv.Atoi(composition[m[2]:m[3]])
+		iso.element = composition[m[4]:m[5]]
+		if m[6] >= 0 {
+			iso.count, _ = strconv.Atoi(composition[m[6]:m[7]])
+		}
+		label.isotopes = append(label.isotopes, iso)
+	}
+	if n == 0 || n != len(composition) {
+		return label, errors.New(`invalid label ` + s)
+	}
+	return label, nil
+}
+
+// String returns the label in the notation of parseLabel
+func (label residueLabel) String() string {
+	var sb strings.Builder
+	for _, iso := range label.isotopes {
+		sb.WriteString(strconv.Itoa(iso.massNumber) + iso.element)
+		if iso.count > 0 {
+			sb.WriteString(`(` + strconv.Itoa(iso.count) + `)`)
+		}
+	}
+	if label.residues != `` {
+		sb.WriteString(`:` + label.residues)
+	}
+	return sb.String()
+}
+
+// labelFormula returns the labeled formula of a residue
+func (label residueLabel) labelFormula(f chem.Formula) (chem.Formula, error) {
+	for _, iso := range label.isotopes {
+		n := iso.count
+		available := f.Atoms[chem.Atom{Element: iso.element}]
+		if n == 0 {
+			n = available
+		} else if n > available {
+			return f, errors.New(`label ` + label.String() + ` has more ` +
+				iso.element + ` atoms than residue ` + f.String())
+		}
+		cnt := strconv.Itoa(n)
+		delta, err := chem.ParseFormula(`[` + strconv.Itoa(iso.massNumber) + iso.element +
+			`]` + cnt + iso.element + `-` + cnt)
+		if err != nil {
+			return f, errors.New(`invalid label ` + label.String() + `: ` + err.Error())
+		}
+		f = f.Add(delta, 1)
+	}
+	return f, nil
+}
+
+// labeledResidues returns the residues of a label. Labels of all
+// residues only apply to the residues with a formula.
+func (label residueLabel) labeledResidues() string {
+	if label.residues != `` {
+		return label.residues
+	}
+	residues := make([]rune, 0, len(aaFormula))
+	for aa := range aaFormula {
+		residues = append(residues, aa)
+	}
+	sort.Slice(residues, func(i, j int) bool { return residues[i] < residues[j] })
+	return string(residues)
+}
+
+// labelMasses returns the mass shifts of the residues by labels
+func labelMasses(labels []residueLabel) (map[rune]float64, error) {
+	shifts := make(map[rune]float64)
+	for _, label := range labels {
+		for _, aa := range label.labeledResidues() {
+			f, ok := aaFormula[aa]
+			if !ok {
+				return nil, errors.New(`label ` + label.String() + `: no formula of residue ` + string(aa))
+			}
+			labeled, err := label.labelFormula(f)
+			if err != nil {
+				return nil, err
+			}
+			shifts[aa] += labeled.Mass() - f.Mass()
+		}
+	}
+	return shifts, nil
+}
+
+// setResidues sets the formulas and masses of the residues from the
+// residue table of parameter -residues, and applies the labels of
+// parameter -label
+func setResidues(residueFilename string, labels []residueLabel) error {
+	if residueFilename != `` {
+		f, err := os.Open(residueFilename)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		err = readResidueTable(f)
+		if err != nil {
+			return errors.New(residueFilename + `: ` + err.Error())
+		}
+	}
+	for _, label := range labels {
+		for _, aa := range label.labeledResidues() {
+			f, ok := aaFormula[aa]
+			if !ok {
+				return errors.New(`label ` + label.String() + `: no formula of residue ` + string(aa))
+			}
+			labeled, err := label.labelFormula(f)
+			if err != nil {
+				return err
+			}
+			aaFormula[aa] = labeled
+			aaMass[aa] = labeled.Mass()
+		}
+	}
+	return nil
+}
+
+// readResidueTable reads a tab or comma separated table of residues,
+// which are added to or replace the residues in aaFormula and aaMass.
+// The first line contains the column names (case insensitive):
+//
+//	residue   one letter code of the residue (required)
+//	formula   elemental formula of the residue (amino acid minus H2O)
+//	mass      monoisotopic mass of the residue, if formula is empty
+//
+// Residues that are specified by mass can't be labeled.
+func readResidueTable(reader io.Reader) error {
+	s := bufio.NewScanner(reader)
+	if !s.Scan() {
+		if err := s.Err(); err != nil {
+			return err
+		}
+		return errors.New(`residue table is empty`)
+	}
+	header := strings.TrimRight(s.Text(), "\r")
+	sep := `,`
+	if strings.Contains(header, "\t") {
+		sep = "\t"
+	}
+	cols := make(map[string]int)
+	for i, name := range strings.Split(header, sep) {
+		cols[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	if _, ok := cols[`residue`]; !ok {
+		return errors.New(`residue table has no column "residue"`)
+	}
+	for lineNr := 2; s.Scan(); lineNr++ {
+		line := strings.TrimRight(s.Text(), "\r")
+		if strings.TrimSpace(line) == `` || strings.HasPrefix(line, `#`) {
+			continue
+		}
+		fields := strings.Split(line, sep)
+		field := func(name string) string {
+			i, ok := cols[name]
+			if !ok || i >= len(fields) {
+				return ``
+			}
+			return strings.TrimSpace(fields[i])
+		}
+		lineErr := func(msg string) error {
+			return errors.New(`residue table line ` + strconv.Itoa(lineNr) + `: ` + msg)
+		}
+
+		residue := []rune(field(`residue`))
+		if len(residue) != 1 || !unicode.IsUpper(residue[0]) {
+			return lineErr(`invalid residue ` + field(`residue`))
+		}
+		aa := residue[0]
+		switch {
+		case field(`formula`) != ``:
+			f, err := chem.ParseFormula(field(`formula`))
+			if err != nil || f.Charge != 0 {
+				return lineErr(`invalid formula ` + field(`formula`))
+			}
+			aaFormula[aa] = f
+			aaMass[aa] = f.Mass()
+		case field(`mass`) != ``:
+			m, err := strconv.ParseFloat(field(`mass`), 64)
+			if err != nil {
+				return lineErr(`invalid mass ` + field(`mass`))
+			}
+			delete(aaFormula, aa)
+			aaMass[aa] = m
+		default:
+			return lineErr(`no formula or mass`)
+		}
+	}
+	return s.Err()
+}
+
+// searchModLister is implemented by identification readers that know
+// the modifications that were searched for
+type searchModLister interface {
+	SearchModifications() []mzidentml.SearchModification
+}
+
+// declaredLabel is a fixed isotope label that is declared in the search
+// modifications of an identification file
+type declaredLabel struct {
+	label residueLabel
+	// Mass shift per residue according to the search engine, used if
+	// the label can't be applied to the residue formula
+	massDelta float64
+	// true if some isotopes of the declared label are left out,
+	// because they are specified by parameter -label
+	partial bool
+}
+
+// declaredLabels returns the fixed isotope labels of residues that are
+// declared in the search modifications of an identification file.
+// Isotopes of residues that are also labeled by parameter -label are
+// left out. Terminal labels are not returned, the identification reader
+// includes these in ModMass.
+func declaredLabels(idents identReader, par params) ([]declaredLabel, error) {
+	sl, ok := idents.(searchModLister)
+	if !ok {
+		return nil, nil
+	}
+	// specified returns true if -label replaces the atoms of residue aa
+	// by the same isotope
+	specified := func(aa rune, iso isotopeLabel) bool {
+		for _, label := range par.residueLabels {
+			if label.residues != `` && !strings.ContainsRune(label.residues, aa) {
+				continue
+			}
+			for _, spec := range label.isotopes {
+				if spec.element == iso.element && spec.massNumber == iso.massNumber {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	var labels []declaredLabel
+	for _, sm := range sl.SearchModifications() {
+		if !sm.FixedMod || sm.Label() == `` || sm.Terminal() {
+			continue
+		}
+		// Residues are separated by spaces, "." means any residue
+		residues := strings.ReplaceAll(sm.Residues, ` `, ``)
+		if residues == `.` {
+			residues = ``
+		}
+		label, err := parseLabel(sm.Label() + `:` + residues)
+		if err != nil {
+			return nil, err
+		}
+		// Group the residues by the isotopes that are not specified
+		var keys []string
+		groups := make(map[string]*declaredLabel)
+		for _, aa := range label.labeledResidues() {
+			var isotopes []isotopeLabel
+			for _, iso := range label.isotopes {
+				if !specified(aa, iso) {
+					isotopes = append(isotopes, iso)
+				}
+			}
+			if len(isotopes) == 0 {
+				continue
+			}
+			key := residueLabel{isotopes: isotopes}.String()
+			g, ok := groups[key]
+			if !ok {
+				g = &declaredLabel{label: residueLabel{isotopes: isotopes},
+					massDelta: sm.MassDelta, partial: len(isotopes) < len(label.isotopes)}
+				groups[key] = g
+				keys = append(keys, key)
+			}
+			g.label.residues += string(aa)
+		}
+		for _, key := range keys {
+			labels = append(labels, *groups[key])
+		}
+	}
+	return labels, nil
+}
+
+// applyDeclaredLabels adds the mass shift of the fixed isotope labels
+// declared in the identification file to the identified peptides.
+// The identification reader doesn't include these in ModMass.
+func applyDeclaredLabels(idents identReader, passIdents []mzidentml.Identification,
+	par params) error {
+	labels, err := declaredLabels(idents, par)
+	if err != nil || len(labels) == 0 {
+		return err
+	}
+	shifts := make(map[rune]float64)
+	names := make([]string, len(labels))
+	for i, d := range labels {
+		names[i] = d.label.String()
+		for _, aa := range d.label.residues {
+			labelShifts, err := labelMasses([]residueLabel{{isotopes: d.label.isotopes,
+				residues: string(aa)}})
+			if err != nil {
+				if d.partial {
+					return err
+				}
+				// E.g. a residue of the -residues table without formula
+				labelShifts = map[rune]float64{aa: d.massDelta}
+			}
+			shifts[aa] += labelShifts[aa]
+		}
+	}
+	if par.verbosity != infoSilent {
+		sort.Strings(names)
+		log.Printf("Using isotope labels declared in identification file: %s",
+			strings.Join(names, `, `))
+	}
+	for i := range passIdents {
+		for _, aa := range strings.ToUpper(passIdents[i].PepSeq) {
+			passIdents[i].ModMass += shifts[aa]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,244 @@
+// This file contains the selection of the identifications of the
+// current run from identification files with multiple runs
+
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/524D/mzrecal/internal/mzidentml"
+)
+
+// File extensions of spectra files, which are removed to obtain the
+// name of a run
+var spectraExt = map[string]bool{
+	`.gz`:     true,
+	`.zip`:    true,
+	`.mzml`:   true,
+	`.mzxml`:  true,
+	`.mzdata`: true,
+	`.mz5`:    true,
+	`.mgf`:    true,
+	`.ms2`:    true,
+	`.raw`:    true,
+	`.wiff`:   true,
+	`.d`:      true,
+}
+
+// spectraStem returns the name of the run from the location of a
+// spectra file, e.g. "run1" for "file:///C:\data\run1.mzML.gz"
+func spectraStem(location string) string {
+	base := location[strings.LastIndexAny(location, `/\`)+1:]
+	for {
+		ext := filepath.Ext(base)
+		if !spectraExt[strings.ToLower(ext)] || len(ext) == len(base) {
+			return base
+		}
+		base = base[:len(base)-len(ext)]
+	}
+}
+
+// runFilter is an identReader that only returns the identifications
+// of the run that is recalibrated, for identification files that
+// contain multiple runs (e.g. fractions). Identifications without
+// SpectraData are always returned.
+// If no SpectraData was specified by the user and the file contains
+// identifications of only one other run, that run is assumed to be
+// the recalibrated one, e.g. because the mzML file was renamed.
+// If the reader lists the SpectraData of the file before the
+// identifications (see spectraDataLister), the run is selected from that
+// list and the identifications are streamed. Otherwise, the
+// identifications of the only other run must be held until the end of
+// the file.
+type runFilter struct {
+	idents      identReader
+	spectraData string // SpectraData specified by the user
+	stem        string // Run name to match
+	verbosity   int
+	started     bool                       // The first identification was read
+	listed      bool                       // The run was selected from the SpectraData list
+	matched     bool                       // An identification of the run was found
+	otherRuns   map[string]bool            // SpectraData of other runs
+	held        []mzidentml.Identification // Identifications of the only other run
+	flush       bool                       // Return held identifications
+}
+
+// spectraDataLister is implemented by identification readers that list
+// the spectra files of the identifications, known after the first call
+// of Next
+type spectraDataLister interface {
+	SpectraData() []mzidentml.SpectraData
+}
+
+// newRunFilter returns a runFilter that selects identifications of
+// the run specified by -spectradata, or else of mzMLFilename
+func newRunFilter(idents identReader, mzMLFilename string, par params) *runFilter {
+	rf := runFilter{
+		idents:      idents,
+		spectraData: *par.spectraDataStr,
+		stem:        spectraStem(mzMLFilename),
+		verbosity:   par.verbosity,
+		otherRuns:   make(map[string]bool),
+	}
+	if rf.spectraData != `` {
+		rf.stem = spectraStem(rf.spectraData)
+	}
+	return &rf
+}
+
+// Next returns the next identification of the run.
+// At the end, io.EOF is returned.
+func (rf *runFilter) Next() (mzidentml.Identification, error) {
+	for !rf.flush {
+		ident, err := rf.idents.Next()
+		if err == io.EOF {
+			err = rf.endOfRun()
+		}
+		if err != nil {
+			return ident, err
+		}
+		if rf.flush {
+			break
+		}
+		if !rf.started {
+			rf.started = true
+			if err = rf.selectListedRun(); err != nil {
+				return mzidentml.Identification{}, err
+			}
+		}
+		if rf.selected(ident.SpectraData) {
+			rf.matched = true
+			rf.held = nil
+			return ident, nil
+		}
+		rf.otherRuns[ident.SpectraData] = true
+		if !rf.matched && !rf.listed && rf.spectraData == `` && len(rf.otherRuns) == 1 {
+			rf.held = append(rf.held, ident)
+		} else {
+			rf.held = nil
+		}
+	}
+	if len(rf.held) == 0 {
+		return mzidentml.Identification{}, io.EOF
+	}
+	ident := rf.held[0]
+	rf.held = rf.held[1:]
+	return ident, nil
+}
+
+// ScoreDirection forwards to the underlying reader, if that
+// specifies the direction of its scores
+func (rf *runFilter) ScoreDirection(score string) (higherBetter bool, ok bool) {
+	if sd, isSD := rf.idents.(scoreDirector); isSD {
+		return sd.ScoreDirection(score)
+	}
+	return false, false
+}
+
+// AnalysisSoftware forwards to the underlying reader, if that knows
+// the software that produced the identifications
+func (rf *runFilter) AnalysisSoftware() []mzidentml.AnalysisSoftware {
+	if sl, ok := rf.idents.(softwareLister); ok {
+		return sl.AnalysisSoftware()
+	}
+	return nil
+}
+
+// SearchModifications forwards to the underlying reader, if that
+// knows the modifications that were searched for
+func (rf *runFilter) SearchModifications() []mzidentml.SearchModification {
+	if sl, ok := rf.idents.(searchModLister); ok {
+		return sl.SearchModifications()
+	}
+	return nil
+}
+
+// selectListedRun selects the run from the SpectraData list of the
+// reader, if it has one (see selectRun)
+func (rf *runFilter) selectListedRun() error {
+	sl, ok := rf.idents.(spectraDataLister)
+	if !ok {
+		return nil
+	}
+	return rf.selectRun(sl.SpectraData())
+}
+
+// selectRun selects the run from a list of SpectraData. If the run is
+// not in the list, the only SpectraData of the list is selected, or an
+// error is returned if there are several.
+func (rf *runFilter) selectRun(list []mzidentml.SpectraData) error {
+	if len(list) == 0 {
+		return nil
+	}
+	runs := make([]string, len(list))
+	for i, sd := range list {
+		runs[i] = sd.Location
+		if runs[i] == `` {
+			runs[i] = sd.Name
+		}
+		if rf.matches(runs[i]) || (sd.Name != `` && rf.matches(sd.Name)) {
+			// The identifications refer to the location
+			rf.stem = spectraStem(runs[i])
+			rf.listed = true
+			return nil
+		}
+	}
+	if len(runs) == 1 && rf.spectraData == `` {
+		if rf.verbosity != infoSilent {
+			log.Printf("WARNING: no identifications of run %s, using those of %s",
+				rf.stem, runs[0])
+		}
+		rf.stem = spectraStem(runs[0])
+		rf.listed = true
+		return nil
+	}
+	sort.Strings(runs)
+	return errors.New("no identifications of run " + rf.stem +
+		" (use -spectradata to select one of: " + strings.Join(runs, `, `) + ")")
+}
+
+// selected returns true if an identification with the given SpectraData
+// belongs to the selected run. Identifications without SpectraData are
+// always selected.
+func (rf *runFilter) selected(spectraData string) bool {
+	return spectraData == `` || rf.matches(spectraData)
+}
+
+// matches returns true if spectraData is the location or name of the
+// selected run
+func (rf *runFilter) matches(spectraData string) bool {
+	if rf.spectraData != `` && spectraData == rf.spectraData {
+		return true
+	}
+	return strings.EqualFold(spectraStem(spectraData), rf.stem)
+}
+
+// endOfRun is called at the end of the identifications. It decides
+// whether the held identifications of the only other run are used.
+// It returns io.EOF if there are no more identifications, or an error
+// if the run was not found.
+func (rf *runFilter) endOfRun() error {
+	if rf.matched || rf.listed || len(rf.otherRuns) == 0 {
+		return io.EOF
+	}
+	if len(rf.held) > 0 {
+		if rf.verbosity != infoSilent {
+			log.Printf("WARNING: no identifications of run %s, using those of %s",
+				rf.stem, rf.held[0].SpectraData)
+		}
+		rf.flush = true
+		return nil
+	}
+	runs := make([]string, 0, len(rf.otherRuns))
+	for run := range rf.otherRuns {
+		runs = append(runs, run)
+	}
+	sort.Strings(runs)
+	return errors.New("no identifications of run " + rf.stem +
+		" (use -spectradata to select one of: " + strings.Join(runs, `, `) + ")")
+}
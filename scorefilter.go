@@ -0,0 +1,648 @@
+// This file contains the parser and evaluation of score filter
+// expressions (parameter -scorefilter)
+
+package main
+
+import (
+	"errors"
+	"log"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/524D/mzrecal/internal/mzidentml"
+)
+
+// A score filter is an expression with the following syntax:
+//
+//	expr       := term { ("OR" | "||") term }
+//	term       := factor { ("AND" | "&&") factor }
+//	factor     := ("NOT" | "!") factor | "(" expr ")" | comparison |
+//	              "modified" | priorityList
+//	comparison := name op number
+//	op         := "<" | "<=" | ">" | ">=" | "=" | "==" | "!="
+//	priorityList := name "(" [min] ":" [max] ")" { name "(" [min] ":" [max] ")" }
+//
+// A name is a CV accession or name of a score, or one of the PSM
+// fields charge, length (of the peptide), rank or modmass (total mass
+// shift of the modifications). Names that contain spaces or operator
+// characters must be quoted, e.g. "Comet:expectation value" < 0.01.
+// "modified" is true for PSMs with modifications.
+// A priority list is the original score filter syntax: the first score
+// of the list that is present in the PSM must be within its range.
+// A comparison with a score that is not present in the PSM is false.
+type filterExpr interface {
+	eval(ident *mzidentml.Identification) (bool, error)
+}
+
+// scoreFilter is a parsed score filter expression
+type scoreFilter struct {
+	expr   filterExpr
+	scores map[string]bool // Names of the scores used in the expression
+}
+
+// usesScore returns true if the filter refers to the named score
+func (f scoreFilter) usesScore(name string) bool {
+	return f.scores[name]
+}
+
+type scoreRange struct {
+	minScore float64 // Minimum score to accept
+	maxScore float64 // Maximum score to accept
+	priority int     // Priority of the score, lowest is best
+}
+
+// scorePriorityList is a list of score ranges, of which the one with
+// the highest priority that is present in a PSM is used
+type scorePriorityList map[string]scoreRange
+
+func (l scorePriorityList) eval(ident *mzidentml.Identification) (bool, error) {
+	scoreOK := false
+	curPrio := math.MaxInt32
+	for _, cv := range ident.Cv {
+		// Check if the CV accession number or CV name matches scorefilter
+		filt, ok := l[cv.Accession]
+		if !ok {
+			filt, ok = l[cv.Name]
+		}
+		if ok {
+			if filt.priority < curPrio {
+				score, err := strconv.ParseFloat(cv.Value, 64)
+				if err != nil {
+					return false, errors.New("Invalid score value " + cv.Value)
+				}
+				scoreOK = score >= filt.minScore && score <= filt.maxScore
+				curPrio = filt.priority
+			}
+		}
+	}
+	return scoreOK, nil
+}
+
+type andExpr struct{ a, b filterExpr }
+
+func (e andExpr) eval(ident *mzidentml.Identification) (bool, error) {
+	ok, err := e.a.eval(ident)
+	if err != nil || !ok {
+		return false, err
+	}
+	return e.b.eval(ident)
+}
+
+type orExpr struct{ a, b filterExpr }
+
+func (e orExpr) eval(ident *mzidentml.Identification) (bool, error) {
+	ok, err := e.a.eval(ident)
+	if err != nil || ok {
+		return ok, err
+	}
+	return e.b.eval(ident)
+}
+
+type notExpr struct{ a filterExpr }
+
+func (e notExpr) eval(ident *mzidentml.Identification) (bool, error) {
+	ok, err := e.a.eval(ident)
+	return !ok, err
+}
+
+// Comparison operators
+type compareOp int
+
+const (
+	opLT compareOp = iota
+	opLE
+	opGT
+	opGE
+	opEQ
+	opNE
+)
+
+var compareOps = map[string]compareOp{
+	`<`:  opLT,
+	`<=`: opLE,
+	`>`:  opGT,
+	`>=`: opGE,
+	`=`:  opEQ,
+	`==`: opEQ,
+	`!=`: opNE,
+}
+
+func (op compareOp) compare(a, b float64) bool {
+	switch op {
+	case opLT:
+		return a < b
+	case opLE:
+		return a <= b
+	case opGT:
+		return a > b
+	case opGE:
+		return a >= b
+	case opEQ:
+		return a == b
+	}
+	return a != b
+}
+
+// scoreCompare compares a score (CV accession or name) with a value
+type scoreCompare struct {
+	name  string
+	op    compareOp
+	value float64
+}
+
+func (e scoreCompare) eval(ident *mzidentml.Identification) (bool, error) {
+	for _, cv := range ident.Cv {
+		if cv.Accession == e.name || cv.Name == e.name {
+			score, err := strconv.ParseFloat(cv.Value, 64)
+			if err != nil {
+				return false, errors.New("Invalid score value " + cv.Value)
+			}
+			return e.op.compare(score, e.value), nil
+		}
+	}
+	return false, nil
+}
+
+// PSM fields that can be used in a comparison
+var filterFields = map[string]func(ident *mzidentml.Identification) float64{
+	`charge`:  func(ident *mzidentml.Identification) float64 { return float64(ident.Charge) },
+	`length`:  func(ident *mzidentml.Identification) float64 { return float64(len(ident.PepSeq)) },
+	`rank`:    func(ident *mzidentml.Identification) float64 { return float64(ident.Rank) },
+	`modmass`: func(ident *mzidentml.Identification) float64 { return ident.ModMass },
+}
+
+// fieldCompare compares a PSM field with a value
+type fieldCompare struct {
+	field func(ident *mzidentml.Identification) float64
+	op    compareOp
+	value float64
+}
+
+func (e fieldCompare) eval(ident *mzidentml.Identification) (bool, error) {
+	return e.op.compare(e.field(ident), e.value), nil
+}
+
+// modifiedExpr is true for PSMs with modifications
+type modifiedExpr struct{}
+
+func (e modifiedExpr) eval(ident *mzidentml.Identification) (bool, error) {
+	return ident.ModMass != 0 || len(ident.UnknownMods) > 0, nil
+}
+
+// filterToken is a token of a score filter expression
+type filterToken struct {
+	text   string
+	pos    int  // Position in the expression
+	end    int  // Position after the token
+	quoted bool // Name between quotes, never an operator or keyword
+}
+
+// Characters that end a name
+const filterSpecialChars = ` ()<>=!&|"`
+
+// tokenizeFilter splits a score filter expression into tokens
+func tokenizeFilter(s string) ([]filterToken, error) {
+	var toks []filterToken
+	for i := 0; i < len(s); {
+		start := i
+		switch c := s[i]; {
+		case c == ' ' || c == '\t':
+			i++
+			continue
+		case c == '(' || c == ')':
+			i++
+		case c == '<' || c == '>' || c == '=' || c == '!':
+			i++
+			if i < len(s) && s[i] == '=' {
+				i++
+			}
+		case c == '&' || c == '|':
+			if i+1 >= len(s) || s[i+1] != c {
+				return nil, errors.New(`invalid operator in score filter at "` + s[i:] + `"`)
+			}
+			i += 2
+		case c == '"':
+			end := strings.IndexByte(s[i+1:], '"')
+			if end < 0 {
+				return nil, errors.New(`missing closing quote in score filter`)
+			}
+			i += end + 2
+			toks = append(toks, filterToken{text: s[start+1 : i-1], pos: start, end: i, quoted: true})
+			continue
+		default:
+			for i < len(s) && !strings.ContainsRune(filterSpecialChars+"\t", rune(s[i])) {
+				i++
+			}
+		}
+		toks = append(toks, filterToken{text: s[start:i], pos: start, end: i})
+	}
+	return toks, nil
+}
+
+// filterParser is a recursive descent parser of score filter expressions
+type filterParser struct {
+	toks   []filterToken
+	i      int
+	scores map[string]bool
+}
+
+// peek returns the next token, or nil at the end of the expression
+func (p *filterParser) peek() *filterToken {
+	if p.i >= len(p.toks) {
+		return nil
+	}
+	return &p.toks[p.i]
+}
+
+// isKeyword returns true if the next token is one of the operators
+// or keywords
+func (p *filterParser) isKeyword(words ...string) bool {
+	tok := p.peek()
+	if tok == nil || tok.quoted {
+		return false
+	}
+	for _, w := range words {
+		if strings.EqualFold(tok.text, w) {
+			return true
+		}
+	}
+	return false
+}
+
+// isName returns true if the next token is a score or field name
+func (p *filterParser) isName() bool {
+	tok := p.peek()
+	return tok != nil && (tok.quoted ||
+		(!strings.ContainsAny(tok.text, filterSpecialChars) &&
+			!p.isKeyword(`AND`, `OR`, `NOT`)))
+}
+
+// isPriorityTerm returns true if the next tokens are a name directly
+// followed by "(", as in the original score filter syntax
+func (p *filterParser) isPriorityTerm() bool {
+	if !p.isName() || p.toks[p.i].quoted || p.i+1 >= len(p.toks) {
+		return false
+	}
+	open := p.toks[p.i+1]
+	return open.text == `(` && open.pos == p.toks[p.i].end
+}
+
+func (p *filterParser) unexpected() error {
+	tok := p.peek()
+	if tok == nil {
+		return errors.New(`unexpected end of score filter`)
+	}
+	return errors.New(`unexpected "` + tok.text + `" in score filter`)
+}
+
+func (p *filterParser) parseOr() (filterExpr, error) {
+	a, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword(`OR`, `||`) {
+		p.i++
+		b, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		a = orExpr{a, b}
+	}
+	return a, nil
+}
+
+func (p *filterParser) parseAnd() (filterExpr, error) {
+	a, err := p.parseFactor()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword(`AND`, `&&`) {
+		p.i++
+		b, err := p.parseFactor()
+		if err != nil {
+			return nil, err
+		}
+		a = andExpr{a, b}
+	}
+	return a, nil
+}
+
+func (p *filterParser) parseFactor() (filterExpr, error) {
+	switch {
+	case p.isKeyword(`NOT`, `!`):
+		p.i++
+		a, err := p.parseFactor()
+		if err != nil {
+			return nil, err
+		}
+		return notExpr{a}, nil
+	case p.isKeyword(`(`):
+		p.i++
+		a, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.isKeyword(`)`) {
+			return nil, p.unexpected()
+		}
+		p.i++
+		return a, nil
+	case p.isPriorityTerm():
+		return p.parsePriorityList()
+	case !p.isName():
+		return nil, p.unexpected()
+	}
+	name := p.toks[p.i]
+	p.i++
+	if !name.quoted && strings.EqualFold(name.text, `modified`) {
+		return modifiedExpr{}, nil
+	}
+	tok := p.peek()
+	if tok == nil || tok.quoted {
+		return nil, p.unexpected()
+	}
+	op, ok := compareOps[tok.text]
+	if !ok {
+		return nil, p.unexpected()
+	}
+	p.i++
+	tok = p.peek()
+	if tok == nil {
+		return nil, p.unexpected()
+	}
+	value, err := strconv.ParseFloat(tok.text, 64)
+	if err != nil {
+		return nil, errors.New(`invalid value "` + tok.text + `" for ` + name.text)
+	}
+	p.i++
+	if field, ok := filterFields[strings.ToLower(name.text)]; ok && !name.quoted {
+		return fieldCompare{field: field, op: op, value: value}, nil
+	}
+	p.scores[name.text] = true
+	return scoreCompare{name: name.text, op: op, value: value}, nil
+}
+
+// parsePriorityList parses consecutive scores with a range, e.g.
+// MS:1002257(0.0:1e-2)MS:1001330(0.0:1e-2)
+func (p *filterParser) parsePriorityList() (filterExpr, error) {
+	l := make(scorePriorityList)
+	for n := 0; p.isPriorityTerm(); n++ {
+		scoreName := p.toks[p.i].text
+		p.i += 2
+		scoreRangeStr := ``
+		if !p.isKeyword(`)`) {
+			tok := p.peek()
+			if tok == nil {
+				return nil, p.unexpected()
+			}
+			scoreRangeStr = tok.text
+			p.i++
+		}
+		if !p.isKeyword(`)`) {
+			return nil, p.unexpected()
+		}
+		p.i++
+		r, err := parsePriorityTerm(l, scoreName, scoreRangeStr, n)
+		if err != nil {
+			return nil, err
+		}
+		l[scoreName] = r
+		p.scores[scoreName] = true
+	}
+	return l, nil
+}
+
+// parsePriorityTerm parses the range of a score in a priority list
+func parsePriorityTerm(l scorePriorityList, scoreName string,
+	scoreRangeStr string, priority int) (scoreRange, error) {
+	_, ok := l[scoreName]
+	if ok {
+		return scoreRange{}, errors.New(scoreName + ` defined more than once.`)
+	}
+	minScore, maxScore, err := parseFloat64Range(scoreRangeStr,
+		-math.MaxFloat64, math.MaxFloat64)
+	if err != nil {
+		return scoreRange{}, errors.New(`Invalid range for score ` + scoreName)
+	}
+	return scoreRange{minScore: minScore, maxScore: maxScore, priority: priority}, nil
+}
+
+// Score filter in the original syntax, which allows spaces in names
+var legacyScoreFilterRe = regexp.MustCompile(`^(?:[^\(\)]+\([^\(\)]*\))+$`)
+
+// parseScoreFilter parses a score filter expression. Filters in the
+// original syntax that are not valid expressions (e.g. because score
+// names contain spaces) are parsed as a priority list.
+func parseScoreFilter(scoreFilterStr string) (scoreFilter, error) {
+	toks, err := tokenizeFilter(scoreFilterStr)
+	p := filterParser{toks: toks, scores: make(map[string]bool)}
+	if len(toks) == 0 && err == nil {
+		// Nothing passes an empty filter
+		return scoreFilter{expr: scorePriorityList{}, scores: p.scores}, nil
+	}
+	var expr filterExpr
+	if err == nil {
+		expr, err = p.parseOr()
+		if err == nil && p.i < len(toks) {
+			err = p.unexpected()
+		}
+	}
+	if err == nil {
+		return scoreFilter{expr: expr, scores: p.scores}, nil
+	}
+	if !legacyScoreFilterRe.MatchString(scoreFilterStr) {
+		return scoreFilter{}, err
+	}
+
+	l := make(scorePriorityList)
+	scores := make(map[string]bool)
+	re := regexp.MustCompile(`([^\(]+)\(([^\)]*)\)`)
+	matchedStringsList := re.FindAllStringSubmatch(scoreFilterStr, -1)
+	for n, matchedStrings := range matchedStringsList {
+		scoreName := matchedStrings[1]
+		r, err := parsePriorityTerm(l, scoreName, matchedStrings[2], n)
+		if err != nil {
+			return scoreFilter{}, err
+		}
+		l[scoreName] = r
+		scores[scoreName] = true
+	}
+	return scoreFilter{expr: l, scores: scores}, nil
+}
+
+// scoreFilterPasses returns true if the identification passes the
+// score filter
+func scoreFilterPasses(ident *mzidentml.Identification, scoreFilt scoreFilter) (bool, error) {
+	return scoreFilt.expr.eval(ident)
+}
+
+// Score filter that is used if the search engine is not recognized
+const defaultScoreFilter = `MS:1002257(0.0:1e-2)MS:1001330(0.0:1e-2)MS:1001159(0.0:1e-2)MS:1002466(0.99:)MS:1002319(50:)MS:1001331(40:)Q.Value(0.0:1e-2)EG.Qvalue(0.0:1e-2)q-value(0.0:1e-2)`
+
+// Default score filters of search engines and post-processing software.
+// Post-processing software comes first, because its scores are
+// preferred over those of the search engine.
+var engineScoreFilters = []struct {
+	names    []string // Names of the software
+	software []string // CV terms of the software
+	filter   string
+}{
+	{[]string{`Percolator`}, []string{`MS:1001490`}, `MS:1001491(0:1e-2)MS:1002354(0:1e-2)MS:1001493(0:1e-2)`},
+	{[]string{`PeptideShaker`}, []string{`MS:1002458`}, `MS:1002466(0.99:)`},
+	{[]string{`MS-GF+`, `MSGF+`, `MSGFPlus`}, []string{`MS:1002048`}, `MS:1002054(0:1e-2)MS:1002053(0:1e-3)`},
+	{[]string{`Mascot`}, []string{`MS:1001207`}, `MS:1001172(0:1e-2)`},
+	{[]string{`Andromeda`, `MaxQuant`}, []string{`MS:1002337`, `MS:1001583`}, `MS:1001493(0:1e-2)MS:1002338(40:)`},
+	{[]string{`DIA-NN`}, nil, `Q.Value(0:1e-2)`},
+	{[]string{`Spectronaut`}, nil, `EG.Qvalue(0:1e-2)`},
+	{[]string{`Sage`}, nil, `MS:1002354(0:1e-2)spectrum_q(0:1e-2)`},
+	{[]string{`MSFragger`}, nil, `MS:1001330(0:1e-2)expect(0:1e-2)`},
+	{[]string{`Comet`}, []string{`MS:1002251`}, `MS:1002257(0:1e-2)`},
+	{[]string{`X!Tandem`}, []string{`MS:1001476`}, `MS:1001330(0:1e-2)`},
+}
+
+// softwareLister is implemented by identification readers that know
+// which software produced the identifications
+type softwareLister interface {
+	AnalysisSoftware() []mzidentml.AnalysisSoftware
+}
+
+// softwareMatches returns true if the software has one of the CV terms
+// or names
+func softwareMatches(as *mzidentml.AnalysisSoftware, names []string, accessions []string) bool {
+	// Spaces are removed, to match e.g. "X! Tandem" with "X!Tandem"
+	normalize := func(s string) string {
+		return strings.ToLower(strings.ReplaceAll(s, ` `, ``))
+	}
+	asNames := []string{as.Name}
+	for _, cvs := range [][]mzidentml.CVParam{as.SoftwareName, as.UserName} {
+		for _, cv := range cvs {
+			for _, acc := range accessions {
+				if cv.Accession == acc {
+					return true
+				}
+			}
+			asNames = append(asNames, cv.Name)
+		}
+	}
+	for _, asName := range asNames {
+		for _, name := range names {
+			if asName != `` && strings.Contains(normalize(asName), normalize(name)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// filterHasScore returns true if the filter refers to one of the scores
+func filterHasScore(scoreFilt scoreFilter, scores []mzidentml.CVParam) bool {
+	for _, cv := range scores {
+		if scoreFilt.usesScore(cv.Accession) || scoreFilt.usesScore(cv.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultEngineFilter selects the default score filter for the software
+// that produced the identifications. If the software is not recognized,
+// the filter is selected by the scores that are present.
+func defaultEngineFilter(software []mzidentml.AnalysisSoftware,
+	scores []mzidentml.CVParam) (name string, filter string, err error) {
+	for _, ef := range engineScoreFilters {
+		for i := range software {
+			if !softwareMatches(&software[i], ef.names, ef.software) {
+				continue
+			}
+			scoreFilt, err := parseScoreFilter(ef.filter)
+			if err != nil {
+				return ``, ``, err
+			}
+			if filterHasScore(scoreFilt, scores) {
+				return ef.names[0], ef.filter, nil
+			}
+		}
+	}
+	for _, ef := range engineScoreFilters {
+		scoreFilt, err := parseScoreFilter(ef.filter)
+		if err != nil {
+			return ``, ``, err
+		}
+		if filterHasScore(scoreFilt, scores) {
+			return `scores of ` + ef.names[0] + ` (software not recognized)`, ef.filter, nil
+		}
+	}
+	scoreFilt, err := parseScoreFilter(defaultScoreFilter)
+	if err != nil {
+		return ``, ``, err
+	}
+	if filterHasScore(scoreFilt, scores) {
+		return `unknown software`, defaultScoreFilter, nil
+	}
+	return ``, ``, errors.New(`no default score filter for scores ` +
+		scoreNames(scores) + `, use parameter -scorefilter`)
+}
+
+// scoreNames returns the names of the scores as a printable list
+func scoreNames(scores []mzidentml.CVParam) string {
+	if len(scores) == 0 {
+		return `(none)`
+	}
+	names := make([]string, 0, len(scores))
+	for _, cv := range scores {
+		if cv.Accession != `` {
+			names = append(names, cv.Accession+` (`+cv.Name+`)`)
+		} else {
+			names = append(names, cv.Name)
+		}
+	}
+	return strings.Join(names, `, `)
+}
+
+// identScores returns the distinct scores of the identifications, in
+// order of their first occurrence. Only the accession and name of the
+// scores are set.
+func identScores(idents []mzidentml.Identification) []mzidentml.CVParam {
+	var scores []mzidentml.CVParam
+	seen := make(map[mzidentml.CVParam]bool)
+	for i := range idents {
+		for _, cv := range idents[i].Cv {
+			key := mzidentml.CVParam{Accession: cv.Accession, Name: cv.Name}
+			if !seen[key] {
+				seen[key] = true
+				scores = append(scores, key)
+			}
+		}
+	}
+	return scores
+}
+
+// checkScoreFilter is called with the scores of the identifications of
+// a file (see identScores). If no score filter was specified, it selects
+// the default filter for the software that produced the identifications.
+// An error is returned if the filter refers to scores, but none of these
+// is present.
+func checkScoreFilter(idents identReader, scores []mzidentml.CVParam,
+	scoreFilt scoreFilter, par params) (scoreFilter, error) {
+	if scoreFilt.expr == nil {
+		var software []mzidentml.AnalysisSoftware
+		if sl, ok := idents.(softwareLister); ok {
+			software = sl.AnalysisSoftware()
+		}
+		name, filter, err := defaultEngineFilter(software, scores)
+		if err != nil {
+			return scoreFilt, err
+		}
+		if par.verbosity != infoSilent {
+			log.Printf("Using score filter for %s: %s", name, filter)
+		}
+		return parseScoreFilter(filter)
+	}
+	if len(scoreFilt.scores) > 0 && !filterHasScore(scoreFilt, scores) {
+		return scoreFilt, errors.New(`none of the scores of the score filter is present, scores found: ` +
+			scoreNames(scores))
+	}
+	return scoreFilt, nil
+}
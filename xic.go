@@ -0,0 +1,229 @@
+// This file contains the code for tracing the elution ranges of
+// calibrants in extracted ion chromatograms (parameter -xic)
+
+package main
+
+import (
+	"log"
+	"math"
+	"sort"
+
+	"github.com/524D/mzrecal/internal/mzml"
+)
+
+// Maximum distance (s) from the identifications of a calibrant over
+// which its extracted ion chromatogram is traced
+const xicSearchRange = 300.0
+
+// Number of consecutive MS1 spectra in which a calibrant may be below
+// the intensity threshold within its elution range
+const xicMaxGap = 1
+
+// xicPoint is the intensity of a calibrant in an MS1 spectrum
+type xicPoint struct {
+	rt     float64
+	intens float64
+}
+
+// ms1Spectrum is the index, retention time and polarity of an MS1
+// spectrum. The MS1 spectra are listed once (see ms1Spectra) and shared
+// by the steps that search calibrants in them.
+type ms1Spectrum struct {
+	idx      int
+	rt       float64
+	polarity int
+}
+
+// ms1Spectra returns the MS1 spectra, ordered by retention time.
+// Spectra of unknown polarity are assumed to be positive.
+func ms1Spectra(mzML *mzml.MzML) ([]ms1Spectrum, error) {
+	var specs []ms1Spectrum
+	for i := 0; i < mzML.NumSpecs(); i++ {
+		msLevel, err := mzML.MSLevel(i)
+		if err != nil {
+			return nil, err
+		}
+		if msLevel != 1 {
+			continue
+		}
+		rt, err := mzML.RetentionTime(i)
+		if err != nil {
+			return nil, err
+		}
+		polarity, err := mzML.Polarity(i)
+		if err != nil {
+			return nil, err
+		}
+		if polarity == 0 {
+			polarity = 1
+		}
+		specs = append(specs, ms1Spectrum{idx: i, rt: rt, polarity: polarity})
+	}
+	sort.SliceStable(specs, func(i, j int) bool { return specs[i].rt < specs[j].rt })
+	return specs, nil
+}
+
+// identifiedOrder returns the indices of the calibrants with an
+// identified charge and retention time, ordered by retention time
+func identifiedOrder(cals []identifiedCalibrant) []int {
+	var order []int
+	for i := range cals {
+		if cals[i].retentionTime != -math.MaxFloat64 && cals[i].idCharge > 0 {
+			order = append(order, i)
+		}
+	}
+	sort.Slice(order, func(a, b int) bool {
+		return cals[order[a]].retentionTime < cals[order[b]].retentionTime
+	})
+	return order
+}
+
+// idRTEnd returns the end of the retention time range of the
+// identifications of a calibrant
+func idRTEnd(cal *identifiedCalibrant) float64 {
+	return math.Max(cal.retentionTime, cal.rtEnd)
+}
+
+// forEachXICPoint calls add with the intensity of the calibrants of order
+// (see identifiedOrder) at their identified charge state in each MS1
+// spectrum of specs within searchRange of their identifications, in order
+// of retention time
+func forEachXICPoint(mzML *mzml.MzML, specs []ms1Spectrum, cals []identifiedCalibrant,
+	order []int, searchRange float64, par params, add func(i int, p xicPoint)) error {
+	var active []int
+	next := 0
+	for _, spec := range specs {
+		for next < len(order) && cals[order[next]].retentionTime-searchRange <= spec.rt {
+			active = append(active, order[next])
+			next++
+		}
+		n := 0
+		for _, i := range active {
+			if idRTEnd(&cals[i])+searchRange >= spec.rt {
+				active[n] = i
+				n++
+			}
+		}
+		active = active[:n]
+		if len(active) == 0 {
+			continue
+		}
+
+		peaks, err := mzML.ReadScan(spec.idx)
+		if err != nil {
+			return err
+		}
+		sort.Slice(peaks,
+			func(i, j int) bool { return peaks[i].Mz < peaks[j].Mz })
+		for _, i := range active {
+			if cals[i].polarity != 0 && cals[i].polarity != spec.polarity {
+				continue
+			}
+			mz := newChargedCalibrant(cals[i].idCharge, &cals[i]).mz
+			mzErr := *par.mzErrPPM * mz / 1000000.0
+			peak := maxPeakInMzWindow(mz-mzErr, mz+mzErr, peaks)
+			add(i, xicPoint{rt: spec.rt, intens: peak.Intens})
+		}
+	}
+	return nil
+}
+
+// traceElution replaces the retention time range of identified
+// calibrants by their elution range, as determined from their extracted
+// ion chromatogram (XIC) at the identified charge state. The elution
+// range runs from the apex of the peak that contains the identifications
+// to the first and last MS1 spectrum in which the intensity is at least
+// fraction -xic of the apex intensity, and always includes the retention
+// times of the identifications. These calibrants are used in the spectra
+// within their elution range, instead of the -rt window.
+// Calibrants that are not found in the MS1 spectra are not changed.
+func traceElution(mzML *mzml.MzML, specs []ms1Spectrum, cals []identifiedCalibrant,
+	par params) error {
+	order := identifiedOrder(cals)
+	xics := make([][]xicPoint, len(cals))
+	err := forEachXICPoint(mzML, specs, cals, order, xicSearchRange, par,
+		func(i int, p xicPoint) { xics[i] = append(xics[i], p) })
+	if err != nil {
+		return err
+	}
+
+	nrTraced := 0
+	for _, i := range order {
+		idStart, idEnd := cals[i].retentionTime, idRTEnd(&cals[i])
+		start, end, ok := elutionRange(xics[i], idStart, idEnd, *par.xicFrac)
+		if !ok {
+			continue
+		}
+		cals[i].retentionTime = math.Min(start, idStart)
+		cals[i].rtEnd = math.Max(end, idEnd)
+		cals[i].xicRange = true
+		nrTraced++
+	}
+	if par.verbosity != infoSilent && nrTraced < len(order) {
+		log.Printf("Elution range of %d of %d identified calibrants found in XIC, using -rt window for the others",
+			nrTraced, len(order))
+	}
+	return nil
+}
+
+// elutionRange returns the retention times of the first and last point
+// of the XIC peak that contains the identifications at rtStart..rtEnd,
+// where the intensity is at least fraction frac of the apex intensity.
+// It returns false if the XIC has no intensity at the identifications.
+func elutionRange(xic []xicPoint, rtStart, rtEnd, frac float64) (float64, float64, bool) {
+	apex := xicApex(xic, rtStart, rtEnd)
+	if apex < 0 {
+		return 0, 0, false
+	}
+	threshold := frac * xic[apex].intens
+	first, last := apex, apex
+	for k, gap := apex-1, 0; k >= 0 && gap <= xicMaxGap; k-- {
+		if xic[k].intens >= threshold {
+			first, gap = k, 0
+		} else {
+			gap++
+		}
+	}
+	for k, gap := apex+1, 0; k < len(xic) && gap <= xicMaxGap; k++ {
+		if xic[k].intens >= threshold {
+			last, gap = k, 0
+		} else {
+			gap++
+		}
+	}
+	return xic[first].rt, xic[last].rt, true
+}
+
+// xicApex returns the index of the apex of the XIC peak that contains
+// the identifications at rtStart..rtEnd, or -1 if the XIC has no
+// intensity at the identifications
+func xicApex(xic []xicPoint, rtStart, rtEnd float64) int {
+	if len(xic) == 0 {
+		return -1
+	}
+	// Start at the most intense point of the identifications, or
+	// the point nearest to the identification
+	apex := sort.Search(len(xic), func(k int) bool { return xic[k].rt >= rtStart })
+	if apex == len(xic) || (apex > 0 && rtStart-xic[apex-1].rt < xic[apex].rt-rtStart) {
+		apex = max(apex-1, 0)
+	}
+	for k := apex + 1; k < len(xic) && xic[k].rt <= rtEnd; k++ {
+		if xic[k].intens > xic[apex].intens {
+			apex = k
+		}
+	}
+	if xic[apex].intens <= 0 {
+		return -1
+	}
+	// Climb to the apex of the peak
+	for {
+		if apex > 0 && xic[apex-1].intens > xic[apex].intens {
+			apex--
+		} else if apex < len(xic)-1 && xic[apex+1].intens > xic[apex].intens {
+			apex++
+		} else {
+			break
+		}
+	}
+	return apex
+}